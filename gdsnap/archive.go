@@ -0,0 +1,450 @@
+package gdsnap
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// an archive is a self-contained copy of a backup made by export and loaded by import.
+// it starts with the archiveMagic line and the archiveheader as a json line,
+// followed by a tar encrypted in the gdsnap/stream format with the current data key.
+// the header has the key header of the backup so the archive opens with the backup's password alone.
+// the tar has the following entries:
+//   - file/[id]: the fileinfo of the head of a file as json, all of them come first.
+//   - rev/[id]/[revid].json and rev/[id]/[revid]: the revinfo and the stored content of a revision.
+//   - meta/[name]: the metadata blobs other than the key header and the lease, they come last.
+//
+// the revisions of a file are oldest first but a gdsnap/ref revision comes only after its target
+// so that import can rewrite the file and revision IDs of the references in a single pass.
+const archiveMagic = "gdsnap-archive\n"
+
+type archiveheader struct {
+	Version      int             `json:"version"`
+	Created      string          `json:"created"`
+	Profile      string          `json:"profile"`
+	EncryptNames bool            `json:"encryptnames"`
+	Keys         json.RawMessage `json:"keys"`
+}
+
+// archiverev is a revision to export.
+type archiverev struct {
+	fi  fileinfo
+	rev revinfo
+}
+
+// exportorder returns the revisions of the files in the export order, see archiveMagic.
+// the references to revisions that no longer exist are exported as they are.
+func (gs *gdsnap) exportorder(files map[string]fileinfo) ([]archiverev, error) {
+	byid := map[string]fileinfo{}
+	for _, fi := range files {
+		byid[fi.ID] = fi
+	}
+	ids := slices.Sorted(maps.Keys(byid))
+	revs := map[string][]revinfo{}
+	exists := map[contentref]bool{}
+	targets := map[contentref]contentref{}
+	total := 0
+	for _, id := range ids {
+		fi := byid[id]
+		rs, err := gs.backend.revisions(&fi)
+		if err != nil {
+			return nil, err
+		}
+		revs[id], total = rs, total+len(rs)
+		for _, r := range rs {
+			self := contentref{fileID: id, revID: r.ID}
+			exists[self] = true
+			if !strings.HasPrefix(r.MimeType, "gdsnap/ref") {
+				continue
+			}
+			target, _, err := gs.readref(&fi, r.ID)
+			if err != nil {
+				return nil, err
+			}
+			targets[self] = contentref{fileID: target.fileID, revID: target.revID}
+		}
+	}
+
+	// a reference always points to an earlier upload so this never gets stuck on a consistent backup.
+	done := map[contentref]bool{}
+	next := map[string]int{}
+	order := make([]archiverev, 0, total)
+	for progress := true; progress; {
+		progress = false
+		for _, id := range ids {
+			for ; next[id] < len(revs[id]); next[id]++ {
+				r := revs[id][next[id]]
+				self := contentref{fileID: id, revID: r.ID}
+				if target, ok := targets[self]; ok && exists[target] && !done[target] {
+					break
+				}
+				done[self], progress = true, true
+				order = append(order, archiverev{byid[id], r})
+			}
+		}
+	}
+	if len(order) != total {
+		return nil, fmt.Errorf("gdsnap.CyclicReferences exported=%d revisions=%d", len(order), total)
+	}
+	return order, nil
+}
+
+// export writes the archive of the backup into w.
+func (gs *gdsnap) export(w io.Writer) error {
+	keys, err := gs.backend.getmeta("keys")
+	if err != nil {
+		return fmt.Errorf("gdsnap.ReadKeyHeader: %v", err)
+	}
+	header := archiveheader{Version: 1, Created: time.Now().UTC().Format(tLayout), Profile: gs.set.profile, EncryptNames: gs.set.encryptnames, Keys: keys}
+	js, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("gdsnap.MarshalArchiveHeader: %v", err)
+	}
+	if _, err := io.WriteString(w, archiveMagic+string(js)+"\n"); err != nil {
+		return fmt.Errorf("gdsnap.WriteArchiveHeader: %v", err)
+	}
+	sw, err := newstreamwriter(gs.keys.currentaead(), w)
+	if err != nil {
+		return fmt.Errorf("gdsnap.WriteArchiveHeader: %v", err)
+	}
+	tw := tar.NewWriter(sw)
+	add := func(name string, size int64, r io.Reader) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: size}); err != nil {
+			return fmt.Errorf("gdsnap.WriteArchiveEntry name=%s: %v", name, err)
+		}
+		if _, err := io.Copy(tw, r); err != nil {
+			return fmt.Errorf("gdsnap.WriteArchiveEntry name=%s: %v", name, err)
+		}
+		return nil
+	}
+	addjson := func(name string, v any) error {
+		js, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("gdsnap.MarshalArchiveEntry name=%s: %v", name, err)
+		}
+		return add(name, int64(len(js)), bytes.NewReader(js))
+	}
+
+	files, err := gs.backend.list()
+	if err != nil {
+		return err
+	}
+	order, err := gs.exportorder(files)
+	if err != nil {
+		return err
+	}
+	for _, relpath := range slices.Sorted(maps.Keys(files)) {
+		if err := addjson("file/"+files[relpath].ID, files[relpath]); err != nil {
+			return err
+		}
+	}
+	for _, ar := range order {
+		name := "rev/" + ar.fi.ID + "/" + ar.rev.ID
+		if err := addjson(name+".json", ar.rev); err != nil {
+			return err
+		}
+		rc, err := gs.backend.fetch(&ar.fi, ar.rev.ID)
+		if err != nil {
+			return err
+		}
+		var content io.Reader = rc
+		size, err := strconv.ParseInt(ar.rev.Size, 10, 64)
+		if err != nil {
+			// the size must be known upfront for the tar header.
+			data, err := io.ReadAll(rc)
+			if err != nil {
+				rc.Close()
+				return fmt.Errorf("gdsnap.FetchContent name=%s rev=%s: %v", namePart(ar.fi.Name), ar.rev.ID, err)
+			}
+			content, size = bytes.NewReader(data), int64(len(data))
+		}
+		err = add(name, size, content)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	metas, err := gs.backend.listmeta("")
+	if err != nil {
+		return err
+	}
+	exported := 0
+	for _, name := range metas {
+		if name == "keys" || name == "lease" {
+			continue
+		}
+		data, err := gs.backend.getmeta(name)
+		if err != nil {
+			return err
+		}
+		if err := add("meta/"+name, int64(len(data)), bytes.NewReader(data)); err != nil {
+			return err
+		}
+		exported++
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("gdsnap.CloseArchive: %v", err)
+	}
+	if err := sw.Close(); err != nil {
+		return fmt.Errorf("gdsnap.CloseArchive: %v", err)
+	}
+	log.Printf("exported %d files with %d revisions and %d metadata blobs.", len(files), len(order), exported)
+	return nil
+}
+
+func (gs *gdsnap) subcommandExport(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("gdsnap.BadExportArgs (usage: gdsnap export [archive])")
+	}
+	if args[0] == "-" {
+		w := bufio.NewWriter(os.Stdout)
+		if err := gs.export(w); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("gdsnap.WriteArchive: %v", err)
+		}
+		return nil
+	}
+	// an interrupted export leaves no archive behind that looks complete.
+	tmpname := args[0] + ".tmp"
+	f, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("gdsnap.CreateArchive file=%s: %v", tmpname, err)
+	}
+	w := bufio.NewWriter(f)
+	err = gs.export(w)
+	if ferr := w.Flush(); err == nil && ferr != nil {
+		err = fmt.Errorf("gdsnap.WriteArchive: %v", ferr)
+	}
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("gdsnap.WriteArchive: %v", cerr)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	if err := os.Rename(tmpname, args[0]); err != nil {
+		return fmt.Errorf("gdsnap.RenameArchive file=%s: %v", args[0], err)
+	}
+	return nil
+}
+
+// importer loads the entries of an archive into the backup.
+type importer struct {
+	gs *gdsnap
+
+	// heads are the fileinfos of the files' heads from the archive by their archived ID.
+	heads map[string]fileinfo
+
+	// files are the imported files by their archived ID.
+	files map[string]fileinfo
+
+	// revs are the imported files at the upload of each archived revision, keyed by the archived IDs.
+	revs map[contentref]fileinfo
+
+	metas int
+}
+
+// importrev uploads an archived revision as the new head of its file.
+func (im *importer) importrev(id, revid string, ri revinfo, size int64, r io.Reader) error {
+	head, ok := im.heads[id]
+	if !ok {
+		return fmt.Errorf("gdsnap.MissingArchivedFile id=%s", id)
+	}
+	if ri.ID != revid {
+		return fmt.Errorf("gdsnap.MissingArchivedRevinfo id=%s rev=%s", id, revid)
+	}
+	fi := im.files[id]
+	fi.Name, fi.MimeType, fi.ModifiedTime, fi.Size = ri.OriginalFilename, ri.MimeType, ri.ModifiedTime, strconv.FormatInt(size, 10)
+	if fi.Name == "" {
+		fi.Name = head.Name
+	}
+	// the deletions in the history stay out of the trash like the referenced ones of savepath.
+	fi.Trashed = head.Trashed && revid == head.HeadRevisionID
+	if strings.HasPrefix(ri.MimeType, "gdsnap/ref") {
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("gdsnap.ReadArchive id=%s rev=%s: %v", id, revid, err)
+		}
+		line, record, found := bytes.Cut(content, []byte("\n"))
+		target, ok := parsecontentref(string(line))
+		if !ok {
+			return fmt.Errorf("gdsnap.InvalidReference name=%s content=%q", namePart(fi.Name), line)
+		}
+		if newfi, ok := im.revs[contentref{fileID: target.fileID, revID: target.revID}]; ok {
+			target.fileID, target.revID = newfi.ID, newfi.HeadRevisionID
+			content = []byte(target.String())
+			if found {
+				content = append(append(content, '\n'), record...)
+			}
+		} else {
+			log.Printf("[warning] %s references the missing %s, importing it as is.", namePart(fi.Name), target)
+		}
+		r, fi.Size = bytes.NewReader(content), strconv.Itoa(len(content))
+	}
+	newfi, err := im.gs.backend.upload(fi, r)
+	if err != nil {
+		return fmt.Errorf("gdsnap.ImportRevision name=%s rev=%s: %v", namePart(fi.Name), revid, err)
+	}
+	if ri.KeepForever {
+		if err := im.gs.backend.keep(&newfi, newfi.HeadRevisionID); err != nil {
+			return fmt.Errorf("gdsnap.ImportKeep name=%s rev=%s: %v", namePart(fi.Name), revid, err)
+		}
+	}
+	im.files[id], im.revs[contentref{fileID: id, revID: revid}] = newfi, newfi
+	return nil
+}
+
+// importmeta stores an archived metadata blob, the snapshots get the new IDs of their revisions.
+func (im *importer) importmeta(name string, data []byte) error {
+	if id, ok := strings.CutPrefix(name, "snapshot."); ok {
+		files, err := im.gs.opensnapshot(id, data)
+		if err != nil {
+			return err
+		}
+		for relpath, fi := range files {
+			newfi, ok := im.revs[contentref{fileID: fi.ID, revID: fi.HeadRevisionID}]
+			if !ok {
+				log.Printf("[warning] snapshot %s has the missing revision %s of %s, importing it as is.", id, fi.HeadRevisionID, relpath)
+				continue
+			}
+			fi.ID, fi.HeadRevisionID, fi.Size = newfi.ID, newfi.HeadRevisionID, newfi.Size
+			files[relpath] = fi
+		}
+		if data, err = im.gs.sealsnapshot(snapshot{ID: id, Files: files}); err != nil {
+			return err
+		}
+	}
+	im.metas++
+	return im.gs.backend.putmeta(name, data)
+}
+
+// importtar loads the entries of an archive's tar.
+func (im *importer) importtar(tr *tar.Reader) error {
+	var ri revinfo
+	revisions := 0
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("gdsnap.ReadArchive: %v", err)
+		}
+		kind, name, _ := strings.Cut(h.Name, "/")
+		switch {
+		case kind == "file":
+			var fi fileinfo
+			if err := json.NewDecoder(tr).Decode(&fi); err != nil {
+				return fmt.Errorf("gdsnap.ParseArchiveEntry name=%s: %v", h.Name, err)
+			}
+			im.heads[name] = fi
+		case kind == "rev" && strings.HasSuffix(name, ".json"):
+			ri = revinfo{}
+			if err := json.NewDecoder(tr).Decode(&ri); err != nil {
+				return fmt.Errorf("gdsnap.ParseArchiveEntry name=%s: %v", h.Name, err)
+			}
+		case kind == "rev":
+			id, revid, _ := strings.Cut(name, "/")
+			if err := im.importrev(id, revid, ri, h.Size, tr); err != nil {
+				return err
+			}
+			revisions++
+		case kind == "meta":
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return fmt.Errorf("gdsnap.ReadArchive name=%s: %v", h.Name, err)
+			}
+			if err := im.importmeta(name, data); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("gdsnap.UnknownArchiveEntry name=%s", h.Name)
+		}
+	}
+	log.Printf("imported %d files with %d revisions and %d metadata blobs.", len(im.files), revisions, im.metas)
+	return nil
+}
+
+func (gs *gdsnap) subcommandImport(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("gdsnap.BadImportArgs (usage: gdsnap import [archive])")
+	}
+	in := os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("gdsnap.OpenArchive: %v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	r := bufio.NewReader(in)
+	magic := make([]byte, len(archiveMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != archiveMagic {
+		return fmt.Errorf("gdsnap.NotAnArchive file=%s", args[0])
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("gdsnap.ReadArchiveHeader: %v", err)
+	}
+	var header archiveheader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return fmt.Errorf("gdsnap.ParseArchiveHeader: %v", err)
+	}
+	if header.Version != 1 {
+		return fmt.Errorf("gdsnap.UnsupportedArchiveVersion version=%d", header.Version)
+	}
+	if header.EncryptNames != gs.set.encryptnames {
+		return fmt.Errorf("gdsnap.EncryptnamesMismatch archive=%t (import it with -encryptnames=%t)", header.EncryptNames, header.EncryptNames)
+	}
+	var kh keyheader
+	if err := json.Unmarshal(header.Keys, &kh); err != nil {
+		return fmt.Errorf("gdsnap.ParseKeyHeader: %v", err)
+	}
+	keys, err := kh.unwrap(gs.set.password)
+	if err != nil {
+		return err
+	}
+	kr, err := newkeyring(keys, kh.Current)
+	if err != nil {
+		return err
+	}
+	sr, err := newstreamreader(kr.candidates(kr.current), r)
+	if err != nil {
+		return err
+	}
+
+	files, err := gs.backend.list()
+	if err != nil {
+		return err
+	}
+	snapshots, err := gs.snapshots()
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 || len(snapshots) > 0 {
+		return fmt.Errorf("gdsnap.ImportIntoNonEmpty files=%d snapshots=%d (import into a new -gdir or -profile)", len(files), len(snapshots))
+	}
+	// the archive's keys replace the header of the empty backup if it has one.
+	if err := gs.backend.putmeta("keys", header.Keys); err != nil {
+		return err
+	}
+	if err := gs.initkeys(false); err != nil {
+		return err
+	}
+	im := &importer{gs: gs, heads: map[string]fileinfo{}, files: map[string]fileinfo{}, revs: map[contentref]fileinfo{}}
+	return im.importtar(tar.NewReader(sr))
+}
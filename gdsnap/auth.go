@@ -0,0 +1,271 @@
+package gdsnap
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const oaScope = "https://www.googleapis.com/auth/drive.file"
+
+// openurl tries to open the authorization page in a browser.
+// it's a variable so that the tests can play the browser.
+var openurl = func(u string) error { return exec.Command("xdg-open", u).Start() }
+
+// deviceinterval is the unit of the polling interval the device flow returns.
+var deviceinterval = time.Second
+
+// authtimeout is how long auth waits for the user to authorize.
+const authtimeout = 10 * time.Minute
+
+// randstr returns a random url-safe string.
+func randstr() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("gdsnap.RandRead: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// tokenrequest posts a request to the token endpoint and returns the parsed response.
+// the error responses are returned too because the device flow polls through them.
+func tokenrequest(q url.Values) (map[string]any, error) {
+	q.Set("client_id", oaClientID)
+	q.Set("client_secret", oaSecret)
+	response, err := http.Post(tokenURL, "application/x-www-form-urlencoded", strings.NewReader(q.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.PostToken: %v", err)
+	}
+	responseBody, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.ReadTokenResponse: %v", err)
+	}
+	var r map[string]any
+	if err = json.Unmarshal(responseBody, &r); err != nil {
+		return nil, fmt.Errorf("gdsnap.ParseTokenResponse status=%q: %v", response.Status, err)
+	}
+	return r, nil
+}
+
+// loopbackauth runs the authorization code flow with pkce.
+// the browser is redirected to a local listener that captures the code.
+func loopbackauth(ln net.Listener) (string, error) {
+	verifier, err := randstr()
+	if err != nil {
+		return "", err
+	}
+	state, err := randstr()
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	redirect := fmt.Sprintf("http://%s/", ln.Addr())
+
+	codech := make(chan string, 1)
+	errch := make(chan error, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/" || q.Get("state") != state {
+			http.Error(w, "gdsnap: unexpected request.", http.StatusBadRequest)
+			return
+		}
+		if e := q.Get("error"); e != "" {
+			http.Error(w, "gdsnap: the authorization failed: "+e, http.StatusForbidden)
+			select {
+			case errch <- fmt.Errorf("gdsnap.AuthDenied error=%q", e):
+			default:
+			}
+			return
+		}
+		fmt.Fprintln(w, "gdsnap is authorized, you can close this page.")
+		select {
+		case codech <- q.Get("code"):
+		default:
+		}
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	q := url.Values{}
+	q.Set("client_id", oaClientID)
+	q.Set("scope", oaScope)
+	q.Set("response_type", "code")
+	q.Set("redirect_uri", redirect)
+	q.Set("state", state)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	u := authURL + "?" + q.Encode()
+	fmt.Println("visit and authorize gdsnap (use -headless if the browser runs on another machine):")
+	fmt.Println(u)
+	if err := openurl(u); err != nil {
+		fmt.Println("couldn't open a browser, open the above address manually.")
+	}
+
+	var code string
+	select {
+	case code = <-codech:
+	case err := <-errch:
+		return "", err
+	case <-time.After(authtimeout):
+		return "", fmt.Errorf("gdsnap.AuthTimeout")
+	}
+
+	q = url.Values{}
+	q.Set("code", code)
+	q.Set("code_verifier", verifier)
+	q.Set("redirect_uri", redirect)
+	q.Set("grant_type", "authorization_code")
+	r, err := tokenrequest(q)
+	if err != nil {
+		return "", err
+	}
+	rt, ok := r["refresh_token"].(string)
+	if !ok {
+		return "", fmt.Errorf("gdsnap.MissingRefreshToken response=%v", r)
+	}
+	return rt, nil
+}
+
+// deviceauth runs the device flow: the user enters a code on another device and gdsnap polls until it's authorized.
+func deviceauth() (string, error) {
+	q := url.Values{}
+	q.Set("client_id", oaClientID)
+	q.Set("scope", oaScope)
+	response, err := http.PostForm(deviceURL, q)
+	if err != nil {
+		return "", fmt.Errorf("gdsnap.RequestDeviceCode: %v", err)
+	}
+	responseBody, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("gdsnap.ReadDeviceCode: %v", err)
+	}
+	var dc struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURL string `json:"verification_url"`
+		ExpiresIn       int    `json:"expires_in"`
+		Interval        int    `json:"interval"`
+	}
+	if err := json.Unmarshal(responseBody, &dc); err != nil || dc.DeviceCode == "" {
+		return "", fmt.Errorf("gdsnap.ParseDeviceCode status=%q response=%q: %v", response.Status, responseBody, err)
+	}
+	fmt.Printf("visit %s on any device and enter the code %s to authorize gdsnap.\n", dc.VerificationURL, dc.UserCode)
+
+	interval := max(dc.Interval, 1)
+	deadline := time.Now().Add(authtimeout)
+	if dc.ExpiresIn > 0 {
+		deadline = time.Now().Add(time.Duration(dc.ExpiresIn) * deviceinterval)
+	}
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Duration(interval) * deviceinterval)
+		q := url.Values{}
+		q.Set("device_code", dc.DeviceCode)
+		q.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+		r, err := tokenrequest(q)
+		if err != nil {
+			return "", err
+		}
+		switch r["error"] {
+		case nil:
+			rt, ok := r["refresh_token"].(string)
+			if !ok {
+				return "", fmt.Errorf("gdsnap.MissingRefreshToken response=%v", r)
+			}
+			return rt, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5
+		default:
+			return "", fmt.Errorf("gdsnap.DeviceAuth error=%q", r["error"])
+		}
+	}
+	return "", fmt.Errorf("gdsnap.AuthTimeout")
+}
+
+// savetoken writes the refresh token of the -profile into ~/.cache/gdsnap readable only by the user.
+// it replaces the profile's earlier refreshtoken line and keeps the rest of the file.
+func savetoken(rt string) (string, error) {
+	cfgfile := path.Join(os.Getenv("HOME"), ".cache/gdsnap")
+	contents, err := os.ReadFile(cfgfile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("gdsnap.ReadConfig file=%s: %v", cfgfile, err)
+	}
+	var out strings.Builder
+	for _, line := range strings.SplitAfter(string(contents), "\n") {
+		var matcher, flagname string
+		fmt.Sscanf(strings.TrimSpace(line), "%s %s", &matcher, &flagname)
+		if line == "" || matcher == *profileFlag && flagname == "refreshtoken" {
+			continue
+		}
+		out.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(&out, "%s refreshtoken %q\n", *profileFlag, rt)
+
+	if err := os.MkdirAll(filepath.Dir(cfgfile), 0700); err != nil {
+		return "", fmt.Errorf("gdsnap.MkdirConfig: %v", err)
+	}
+	// CreateTemp creates the file with 0600.
+	f, err := os.CreateTemp(filepath.Dir(cfgfile), ".gdsnap.tmp")
+	if err != nil {
+		return "", fmt.Errorf("gdsnap.CreateConfig: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(out.String()); err != nil {
+		f.Close()
+		return "", fmt.Errorf("gdsnap.WriteConfig: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("gdsnap.CloseConfig: %v", err)
+	}
+	if err := os.Rename(f.Name(), cfgfile); err != nil {
+		return "", fmt.Errorf("gdsnap.RenameConfig: %v", err)
+	}
+	return cfgfile, nil
+}
+
+func (gs *gdsnap) subcommandAuth(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("gdsnap.UnexpectedArgs")
+	}
+	if len(*refreshtokenFlag) > 0 {
+		return fmt.Errorf(`gdsnap.RefreshtokenAlreadyDefined (use "gdsnap -refreshtoken= auth" to force auth regardless)`)
+	}
+
+	var rt string
+	var err error
+	if *headlessFlag {
+		rt, err = deviceauth()
+	} else if ln, lnErr := net.Listen("tcp", "127.0.0.1:0"); lnErr != nil {
+		fmt.Printf("can't listen on the loopback interface, falling back to the device flow: %v.\n", lnErr)
+		rt, err = deviceauth()
+	} else {
+		rt, err = loopbackauth(ln)
+	}
+	if err != nil {
+		return err
+	}
+	cfgfile, err := savetoken(rt)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("saved the refresh token of the %s profile into %s (this is a sensitive token, don't share it!).\n", *profileFlag, cfgfile)
+	return nil
+}
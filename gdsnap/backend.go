@@ -0,0 +1,445 @@
+package gdsnap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// revinfo describes a single revision of a backed up file.
+type revinfo struct {
+	ID           string `json:"id"`
+	MimeType     string `json:"mimeType"`
+	ModifiedTime string `json:"modifiedTime"`
+	Size         string `json:"size,omitempty"`
+
+	// OriginalFilename is the fileinfo.Name at the time of the upload of this revision.
+	OriginalFilename string `json:"originalFilename,omitempty"`
+
+	// KeepForever is set for the revisions protected from the automatic pruning, see backend.keep.
+	KeepForever bool `json:"keepForever,omitempty"`
+}
+
+// backend is the storage into which gdsnap saves the revisions of the files.
+// each backed up file has a backend assigned ID and a list of revisions.
+// the fileinfo.Name is "relpath/sha256sum" where the checksum is of the plaintext of the head revision.
+type backend interface {
+	// list returns the latest state of each file of the profile keyed by the relpath.
+	list() (map[string]fileinfo, error)
+
+	// changes returns the files changed since token and the token for the next call.
+	// an empty token returns only the token of the current state.
+	// the files that no longer belong to the profile (e.g. the permanently deleted ones) only have their ID set.
+	// the error is errors.ErrUnsupported if the backend has no change feed.
+	changes(token string) ([]fileinfo, string, error)
+
+	// upload adds a new head revision to a file and returns the updated fileinfo.
+	// if fi.ID is empty then a new file is created.
+	// fi.Size is the length of the content in r or empty if it's unknown.
+	// the returned fi.Size is the uploaded length.
+	upload(fi fileinfo, r io.Reader) (fileinfo, error)
+
+	// trash adds a gdsnap/deleted head revision to the file and marks it trashed.
+	trash(fi fileinfo) (fileinfo, error)
+
+	// revisions lists the available revisions of a file, oldest first.
+	revisions(fi *fileinfo) ([]revinfo, error)
+
+	// fetch returns the content of a revision.
+	// an empty revid means the head revision.
+	fetch(fi *fileinfo, revid string) (io.ReadCloser, error)
+
+	// keep protects a revision from the automatic pruning of the old revisions.
+	keep(fi *fileinfo, revid string) error
+
+	// deleterev permanently deletes a revision other than the head revision.
+	deleterev(fi *fileinfo, revid string) error
+
+	// getmeta returns a small metadata blob of the profile, e.g. the key header.
+	// the error wraps fs.ErrNotExist if the blob doesn't exist yet.
+	getmeta(name string) ([]byte, error)
+
+	// putmeta creates or replaces a metadata blob of the profile.
+	putmeta(name string, data []byte) error
+
+	// listmeta returns the sorted names of the metadata blobs starting with prefix.
+	listmeta(prefix string) ([]string, error)
+
+	// deletemeta permanently deletes a metadata blob.
+	deletemeta(name string) error
+
+	// metacopies returns every copy of a metadata blob, the oldest first, bypassing any cache.
+	// gdrive holds several copies when hosts create the same blob at once, the other backends hold at most one.
+	// the later getmeta, putmeta and deletemeta calls operate on the oldest copy.
+	metacopies(name string) ([]metacopy, error)
+
+	// addmetacopy creates a new copy of a metadata blob and returns its ID.
+	// unlike putmeta it never overwrites an existing copy, the error wraps fs.ErrExist if the backend can't hold another one.
+	addmetacopy(name string, data []byte) (string, error)
+
+	// deletemetacopy permanently deletes a copy of a metadata blob returned by metacopies or addmetacopy.
+	deletemetacopy(name, id string) error
+
+	quota() (quota, error)
+}
+
+// metacopy is a copy of a metadata blob, see backend.metacopies.
+type metacopy struct {
+	id   string
+	data []byte
+}
+
+// newbackend returns the backend of a backup set.
+// the drive backends authorize with tok.
+func newbackend(set *backupset, tok *accesstoken) (backend, error) {
+	switch set.backend {
+	case "drive":
+		return &driveBackend{gdir: set.gdir, profile: set.profile, tok: tok, metaids: map[string]string{}}, nil
+	case "local":
+		if !filepath.IsAbs(set.gdir) {
+			return nil, fmt.Errorf("gdsnap.LocalGdirNotAbsolute gdir=%q", set.gdir)
+		}
+		return &localBackend{root: filepath.Join(set.gdir, set.profile)}, nil
+	default:
+		return nil, fmt.Errorf("gdsnap.UnknownBackend backend=%q", set.backend)
+	}
+}
+
+// localBackend keeps the backup in a plain local directory, e.g. on a mounted NAS.
+// the gdir is the path of the directory and each profile gets its own subdirectory.
+// the metadata blobs are the meta.[name] files in the profile's directory.
+// each file is a directory named after its ID in which
+// info.json is the fileinfo of the head,
+// and each revision has the content in a file named after the revid and its revinfo next to it in revid.json.
+// the revids are increasing integers.
+type localBackend struct {
+	root string
+}
+
+// writeatomic writes a file via a rename so that readers never see a partial file.
+func writeatomic(name string, r io.Reader) (int64, error) {
+	tmpname := name + ".tmp"
+	f, err := os.Create(tmpname)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(tmpname)
+		return n, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpname)
+		return n, err
+	}
+	return n, os.Rename(tmpname, name)
+}
+
+func writejson(name string, v any) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = writeatomic(name, strings.NewReader(string(js)+"\n"))
+	return err
+}
+
+func readjson(name string, v any) error {
+	js, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(js, v)
+}
+
+func (lb *localBackend) list() (map[string]fileinfo, error) {
+	files := map[string]fileinfo{}
+	entries, err := os.ReadDir(lb.root)
+	if os.IsNotExist(err) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.ListLocalRoot: %v", err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		var fi fileinfo
+		err := readjson(filepath.Join(lb.root, e.Name(), "info.json"), &fi)
+		if errors.Is(err, fs.ErrNotExist) {
+			// an upload of a new file was interrupted before its info.json was written.
+			log.Printf("[warning] skipping %s without an info.json in the local backup.", filepath.Join(lb.root, e.Name()))
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("gdsnap.ReadLocalInfo id=%s: %v", e.Name(), err)
+		}
+		files[namePart(fi.Name)] = fi
+	}
+	return files, nil
+}
+
+// changes is unsupported because listing the local directory is cheap anyway.
+func (lb *localBackend) changes(token string) ([]fileinfo, string, error) {
+	return nil, "", errors.ErrUnsupported
+}
+
+func (lb *localBackend) upload(fi fileinfo, r io.Reader) (fileinfo, error) {
+	if fi.ID == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return fi, fmt.Errorf("gdsnap.NewLocalID: %v", err)
+		}
+		fi.ID = hex.EncodeToString(id)
+		if err := os.MkdirAll(filepath.Join(lb.root, fi.ID), 0700); err != nil {
+			return fi, fmt.Errorf("gdsnap.CreateLocalFile name=%s: %v", namePart(fi.Name), err)
+		}
+	}
+	revs, err := lb.revisions(&fi)
+	if err != nil {
+		return fi, err
+	}
+	revid := 1
+	if len(revs) > 0 {
+		last, _ := strconv.Atoi(revs[len(revs)-1].ID)
+		revid = last + 1
+	}
+	if fi.ModifiedTime == "" {
+		fi.ModifiedTime = time.Now().UTC().Format(tLayout)
+	}
+
+	ri := revinfo{ID: fmt.Sprintf("%08d", revid), MimeType: fi.MimeType, ModifiedTime: fi.ModifiedTime, OriginalFilename: fi.Name}
+	dir := filepath.Join(lb.root, fi.ID)
+	n, err := writeatomic(filepath.Join(dir, ri.ID), r)
+	if err != nil {
+		return fi, fmt.Errorf("gdsnap.WriteLocalRevision name=%s: %v", namePart(fi.Name), err)
+	}
+	ri.Size, fi.Size, fi.HeadRevisionID = strconv.FormatInt(n, 10), strconv.FormatInt(n, 10), ri.ID
+	if err := writejson(filepath.Join(dir, ri.ID+".json"), ri); err != nil {
+		return fi, fmt.Errorf("gdsnap.WriteLocalRevinfo name=%s: %v", namePart(fi.Name), err)
+	}
+	if err := writejson(filepath.Join(dir, "info.json"), fi); err != nil {
+		return fi, fmt.Errorf("gdsnap.WriteLocalInfo name=%s: %v", namePart(fi.Name), err)
+	}
+	return fi, nil
+}
+
+func (lb *localBackend) trash(fi fileinfo) (fileinfo, error) {
+	fi.Trashed, fi.MimeType, fi.ModifiedTime = true, "gdsnap/deleted", ""
+	return lb.upload(fi, strings.NewReader(""))
+}
+
+func (lb *localBackend) revisions(fi *fileinfo) ([]revinfo, error) {
+	entries, err := os.ReadDir(filepath.Join(lb.root, fi.ID))
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.ListLocalRevisions name=%s: %v", namePart(fi.Name), err)
+	}
+	revs := []revinfo{}
+	for _, e := range entries {
+		if e.Name() == "info.json" || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		var ri revinfo
+		if err := readjson(filepath.Join(lb.root, fi.ID, e.Name()), &ri); err != nil {
+			return nil, fmt.Errorf("gdsnap.ReadLocalRevinfo name=%s rev=%s: %v", namePart(fi.Name), e.Name(), err)
+		}
+		revs = append(revs, ri)
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].ID < revs[j].ID })
+	return revs, nil
+}
+
+func (lb *localBackend) fetch(fi *fileinfo, revid string) (io.ReadCloser, error) {
+	if revid == "" {
+		revs, err := lb.revisions(fi)
+		if err != nil {
+			return nil, err
+		}
+		if len(revs) == 0 {
+			return nil, fmt.Errorf("gdsnap.NoLocalRevisions name=%s", namePart(fi.Name))
+		}
+		revid = revs[len(revs)-1].ID
+	}
+	f, err := os.Open(filepath.Join(lb.root, fi.ID, revid))
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.OpenLocalRevision name=%s rev=%s: %v", namePart(fi.Name), revid, err)
+	}
+	return f, nil
+}
+
+// keep is a noop because the local backend keeps all revisions.
+func (lb *localBackend) keep(fi *fileinfo, revid string) error {
+	return nil
+}
+
+func (lb *localBackend) deleterev(fi *fileinfo, revid string) error {
+	revs, err := lb.revisions(fi)
+	if err != nil {
+		return err
+	}
+	if len(revs) > 0 && revs[len(revs)-1].ID == revid {
+		return fmt.Errorf("gdsnap.DeleteLocalHead name=%s rev=%s", namePart(fi.Name), revid)
+	}
+	if err := os.Remove(filepath.Join(lb.root, fi.ID, revid+".json")); err != nil {
+		return fmt.Errorf("gdsnap.DeleteLocalRevision name=%s rev=%s: %v", namePart(fi.Name), revid, err)
+	}
+	if err := os.Remove(filepath.Join(lb.root, fi.ID, revid)); err != nil {
+		return fmt.Errorf("gdsnap.DeleteLocalRevision name=%s rev=%s: %v", namePart(fi.Name), revid, err)
+	}
+	return nil
+}
+
+func (lb *localBackend) getmeta(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(lb.root, "meta."+name))
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.ReadLocalMeta name=%s: %w", name, err)
+	}
+	return data, nil
+}
+
+func (lb *localBackend) putmeta(name string, data []byte) error {
+	if err := os.MkdirAll(lb.root, 0700); err != nil {
+		return fmt.Errorf("gdsnap.CreateLocalRoot: %v", err)
+	}
+	if _, err := writeatomic(filepath.Join(lb.root, "meta."+name), bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("gdsnap.WriteLocalMeta name=%s: %v", name, err)
+	}
+	return nil
+}
+
+func (lb *localBackend) listmeta(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(lb.root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.ListLocalRoot: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if name, ok := strings.CutPrefix(e.Name(), "meta."+prefix); ok && !e.IsDir() && !strings.HasSuffix(name, ".tmp") {
+			names = append(names, prefix+name)
+		}
+	}
+	return names, nil
+}
+
+func (lb *localBackend) deletemeta(name string) error {
+	if err := os.Remove(filepath.Join(lb.root, "meta."+name)); err != nil {
+		return fmt.Errorf("gdsnap.DeleteLocalMeta name=%s: %v", name, err)
+	}
+	return nil
+}
+
+// metacopies returns the only copy of the blob, a directory can't hold more.
+// the ID contains the inode so that deletemetacopy doesn't delete a copy that a racing host has just replaced.
+func (lb *localBackend) metacopies(name string) ([]metacopy, error) {
+	f, err := os.Open(filepath.Join(lb.root, "meta."+name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.ReadLocalMeta name=%s: %v", name, err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.StatLocalMeta name=%s: %v", name, err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.ReadLocalMeta name=%s: %v", name, err)
+	}
+	return []metacopy{{localmetaid(name, st), data}}, nil
+}
+
+func localmetaid(name string, st fs.FileInfo) string {
+	return fmt.Sprintf("meta.%s@%d", name, st.Sys().(*syscall.Stat_t).Ino)
+}
+
+// addmetacopy creates the blob only if it doesn't exist yet so that the racing hosts can't overwrite each other's copy.
+func (lb *localBackend) addmetacopy(name string, data []byte) (string, error) {
+	if err := os.MkdirAll(lb.root, 0700); err != nil {
+		return "", fmt.Errorf("gdsnap.CreateLocalRoot: %v", err)
+	}
+	f, err := os.CreateTemp(lb.root, "meta."+name+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("gdsnap.CreateLocalMeta name=%s: %v", name, err)
+	}
+	tmpname := f.Name()
+	defer os.Remove(tmpname)
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("gdsnap.WriteLocalMeta name=%s: %v", name, err)
+	}
+	// a link fails if the target exists unlike a rename.
+	if err := os.Link(tmpname, filepath.Join(lb.root, "meta."+name)); err != nil {
+		return "", fmt.Errorf("gdsnap.LinkLocalMeta name=%s: %w", name, err)
+	}
+	st, err := os.Stat(tmpname)
+	if err != nil {
+		return "", fmt.Errorf("gdsnap.StatLocalMeta name=%s: %v", name, err)
+	}
+	return localmetaid(name, st), nil
+}
+
+// deletemetacopy deletes the blob only if it's still the copy with the given ID.
+func (lb *localBackend) deletemetacopy(name, id string) error {
+	st, err := os.Stat(filepath.Join(lb.root, "meta."+name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("gdsnap.StatLocalMeta name=%s: %v", name, err)
+	}
+	if localmetaid(name, st) != id {
+		return nil
+	}
+	return lb.deletemeta(name)
+}
+
+func (lb *localBackend) quota() (quota, error) {
+	var st syscall.Statfs_t
+	if err := os.MkdirAll(lb.root, 0700); err != nil {
+		return quota{}, fmt.Errorf("gdsnap.CreateLocalRoot: %v", err)
+	}
+	if err := syscall.Statfs(lb.root, &st); err != nil {
+		return quota{}, fmt.Errorf("gdsnap.StatfsLocalRoot: %v", err)
+	}
+	var used int64
+	filepath.WalkDir(lb.root, func(_ string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if fi, err := d.Info(); err == nil {
+				used += fi.Size()
+			}
+		}
+		return nil
+	})
+	bsize := int64(st.Bsize)
+	limit, free := int64(st.Blocks)*bsize, int64(st.Bavail)*bsize
+	q := quota{
+		LimitMB: (limit + 1e6 - 1) / 1e6,
+		UsageMB: (limit - free + 1e6 - 1) / 1e6,
+		DriveMB: (used + 1e6 - 1) / 1e6,
+		FreeMB:  free / 1e6,
+	}
+	return q, nil
+}
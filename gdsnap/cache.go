@@ -0,0 +1,182 @@
+package gdsnap
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+)
+
+// statecache is the on-disk copy of the backend's listing.
+// with it listfiles fetches only the changes since the last run rather than the whole listing.
+type statecache struct {
+	// Token is the backend's change feed position at which Files was up to date.
+	Token string
+
+	// Files is the raw listing of the backend.
+	// the names and the mimetypes stay encrypted in the -encryptnames mode, see openlisting.
+	Files map[string]fileinfo
+}
+
+// cacheversion is the format of the state cache.
+// version 1 had the decrypted names in the -encryptnames mode, loadcache removes those.
+const cacheversion = 2
+
+// cachepath returns the path of the state cache file.
+// the backup's identity is hashed into the name so that a different -gdir, -encryptnames or -password gets a separate cache.
+// note that ~/.cache/gdsnap is a config file so the cache goes to ~/.cache/gdsnapstate.
+func (gs *gdsnap) cachepath() (string, error) {
+	return gs.versionedcachepath(cacheversion)
+}
+
+// versionedcachepath returns the path of the state cache file of a cache format version.
+func (gs *gdsnap) versionedcachepath(version int) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("gdsnap.UserCacheDir: %v", err)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%t\x00", gs.set.backend, gs.set.gdir, gs.set.profile, gs.set.encryptnames)
+	if version > 1 {
+		fmt.Fprintf(h, "v%d\x00", version)
+	}
+	h.Write(gs.sumkey)
+	return filepath.Join(dir, "gdsnapstate", fmt.Sprintf("%s-%x.json", gs.set.profile, h.Sum(nil)[:8])), nil
+}
+
+// loadcache returns the state cache or nil if it's missing or unreadable.
+func (gs *gdsnap) loadcache() *statecache {
+	if gs.set.encryptnames {
+		if legacy, err := gs.versionedcachepath(1); err == nil {
+			os.Remove(legacy)
+		}
+	}
+	name, err := gs.cachepath()
+	if err != nil {
+		log.Printf("[warning] %v", err)
+		return nil
+	}
+	c := &statecache{}
+	if err := readjson(name, c); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[warning] ignoring the unreadable state cache %s: %v", name, err)
+		}
+		return nil
+	}
+	if c.Token == "" || c.Files == nil {
+		return nil
+	}
+	return c
+}
+
+// savecache writes the state cache.
+// it writes via a unique temp file so that concurrent gdsnap processes don't corrupt it.
+func (gs *gdsnap) savecache(c *statecache) error {
+	name, err := gs.cachepath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return fmt.Errorf("gdsnap.CreateCacheDir: %v", err)
+	}
+	js, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("gdsnap.MarshalCache: %v", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("gdsnap.CreateCache: %v", err)
+	}
+	_, err = f.Write(js)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("gdsnap.WriteCache: %v", err)
+	}
+	return nil
+}
+
+// cachedlist returns the backend's listing using the state cache and the backend's change feed.
+// the full listing is fetched only on the first run, with -rebuildcache or if the change feed fails.
+// the caller may modify the returned map.
+func (gs *gdsnap) cachedlist() (map[string]fileinfo, error) {
+	// the cache has the raw listing so that the names are not stored decrypted on the disk.
+	raw := gs.backend
+	if nb, ok := gs.backend.(*nameBackend); ok {
+		raw = nb.backend
+	}
+	if gs.cache == nil && !*rebuildcacheFlag {
+		gs.cache = gs.loadcache()
+	}
+	if gs.cache != nil {
+		changed, token, err := raw.changes(gs.cache.Token)
+		if err == nil {
+			if token != gs.cache.Token {
+				applychanges(gs.cache.Files, changed)
+				gs.cache.Token = token
+				if err := gs.savecache(gs.cache); err != nil {
+					log.Printf("[warning] couldn't save the state cache: %v", err)
+				}
+			}
+			return gs.openlisting(gs.cache.Files)
+		}
+		if !errors.Is(err, errors.ErrUnsupported) {
+			log.Printf("[warning] couldn't fetch the changes, listing all files: %v", err)
+		}
+	}
+
+	// the token is fetched first so that the changes made during the listing are not missed.
+	_, token, err := raw.changes("")
+	if errors.Is(err, errors.ErrUnsupported) {
+		return gs.backend.list()
+	}
+	if err != nil {
+		return nil, err
+	}
+	files, err := raw.list()
+	if err != nil {
+		return nil, err
+	}
+	gs.cache = &statecache{Token: token, Files: files}
+	if err := gs.savecache(gs.cache); err != nil {
+		log.Printf("[warning] couldn't save the state cache: %v", err)
+	}
+	return gs.openlisting(files)
+}
+
+// openlisting returns a copy of a raw listing with the names and the mimetypes decrypted in the -encryptnames mode.
+func (gs *gdsnap) openlisting(files map[string]fileinfo) (map[string]fileinfo, error) {
+	if nb, ok := gs.backend.(*nameBackend); ok {
+		return nb.decryptlisting(files)
+	}
+	return maps.Clone(files), nil
+}
+
+// applychanges updates a listing with the changed files from the backend's change feed.
+func applychanges(files map[string]fileinfo, changed []fileinfo) {
+	if len(changed) == 0 {
+		return
+	}
+	relpaths := map[string]string{}
+	for relpath, fi := range files {
+		relpaths[fi.ID] = relpath
+	}
+	for _, fi := range changed {
+		if relpath, ok := relpaths[fi.ID]; ok && files[relpath].ID == fi.ID {
+			delete(files, relpath)
+		}
+		if fi.Name != "" {
+			files[namePart(fi.Name)] = fi
+			relpaths[fi.ID] = namePart(fi.Name)
+		}
+	}
+}
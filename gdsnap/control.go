@@ -0,0 +1,311 @@
+package gdsnap
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ctlrequest is a command received on the -controlsock.
+// the watch loop handles it and sends the result on reply.
+type ctlrequest struct {
+	cmd, arg string
+	// config is the config of reload-config, the dispatcher reads it for the sets.
+	config *daemonconfig
+	reply  chan error
+}
+
+// daemonconfig is the reloaded config of a running watch.
+// the watch loops apply it between their cycles, the flags keep their startup values while the daemon runs.
+type daemonconfig struct {
+	// values are the flag values keyed by the flag name.
+	values map[string]string
+	opts   options
+}
+
+// ctlcommands are the commands of the control protocol with their argument's name if they take one.
+var ctlcommands = map[string]string{
+	"flush":         "",
+	"pause":         "",
+	"quit":          "",
+	"reload-config": "",
+	"resume":        "",
+	"save":          "path",
+}
+
+// restartflags are the flags that reload-config can't change in a running watch.
+var restartflags = []string{"backend", "controlsock", "dir", "encryptnames", "gdir", "jobs", "password", "profile", "refreshtoken", "scandur", "statusaddr", "warncmd", "watcher"}
+
+// controllisten listens on the -controlsock unix socket accessible only by the user.
+func controllisten(sock string) (net.Listener, error) {
+	// remove the socket of an earlier daemon that didn't clean up.
+	if finfo, err := os.Lstat(sock); err == nil && finfo.Mode().Type() == os.ModeSocket {
+		os.Remove(sock)
+	}
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.ListenControl sock=%s: %v", sock, err)
+	}
+	if err := os.Chmod(sock, 0600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("gdsnap.ChmodControl sock=%s: %v", sock, err)
+	}
+	return ln, nil
+}
+
+// servecontrol accepts the control connections on ln and forwards their requests to ctlch.
+// a connection is a single request line of a command and its argument separated by a space.
+// the response is a single "ok" or "error: [message]" line once the command completes.
+func servecontrol(ln net.Listener, ctlch chan<- ctlrequest) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("[warning] the control socket stopped: %v", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				fmt.Fprintf(conn, "error: gdsnap.ReadControlRequest: %v\n", err)
+				return
+			}
+			cmd, arg, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+			argname, ok := ctlcommands[cmd]
+			if !ok {
+				fmt.Fprintf(conn, "error: gdsnap.UnknownControlCommand cmd=%q\n", cmd)
+				return
+			}
+			if (argname != "") != (arg != "") {
+				fmt.Fprintf(conn, "error: gdsnap.BadControlArgs cmd=%s (usage: %s)\n", cmd, strings.TrimSpace(cmd+" "+argname))
+				return
+			}
+			req := ctlrequest{cmd: cmd, arg: arg, reply: make(chan error, 1)}
+			ctlch <- req
+			if err := <-req.reply; err != nil {
+				fmt.Fprintf(conn, "error: %v\n", err)
+			} else {
+				fmt.Fprintln(conn, "ok")
+			}
+		}()
+	}
+}
+
+// dispatchcontrol forwards the control requests to the watch loops of the sets, setchs[i] is the channel of sets[i].
+// save goes to the set of the path, the rest goes to all sets and fails if any of them fails.
+// reload-config rereads the config into the values of the flags and sends them to the sets.
+// it stops when ctx is done, the sets don't read their channels after that.
+func dispatchcontrol(ctx context.Context, ctlch <-chan ctlrequest, sets []*gdsnap, setchs []chan ctlrequest) {
+	values := flagvalues()
+	for {
+		var req ctlrequest
+		select {
+		case req = <-ctlch:
+		case <-ctx.Done():
+			return
+		}
+		targets := setchs
+		var cfg *daemonconfig
+		var err error
+		switch req.cmd {
+		case "save":
+			targets = nil
+			abspath := filepath.Clean(req.arg)
+			for i, gs := range sets {
+				if strings.HasPrefix(abspath+"/", gs.set.dir) {
+					targets = setchs[i : i+1]
+				}
+			}
+			if targets == nil {
+				var dirs []string
+				for _, gs := range sets {
+					dirs = append(dirs, gs.set.dir)
+				}
+				err = fmt.Errorf("gdsnap.SaveOutsideDir path=%s dir=%s", abspath, strings.Join(dirs, ","))
+			}
+		case "reload-config":
+			if cfg, err = reloadconfig(values); cfg == nil {
+				targets = nil
+			} else {
+				values = cfg.values
+			}
+		}
+		replies := make([]chan error, len(targets))
+		for i, ch := range targets {
+			replies[i] = make(chan error, 1)
+			select {
+			case ch <- ctlrequest{cmd: req.cmd, arg: req.arg, config: cfg, reply: replies[i]}:
+			case <-ctx.Done():
+				replies[i] <- ctx.Err()
+			}
+		}
+		errs := []error{err}
+		for _, reply := range replies {
+			errs = append(errs, <-reply)
+		}
+		req.reply <- errors.Join(errs...)
+		if req.cmd == "quit" {
+			return
+		}
+	}
+}
+
+// control handles the control commands that don't need a backup cycle.
+func (gs *gdsnap) control(req ctlrequest, touched map[string]bool) error {
+	switch req.cmd {
+	case "pause":
+		gs.stats.paused.Store(true)
+		log.Print("paused the backup cycles.")
+	case "resume":
+		gs.stats.paused.Store(false)
+		log.Print("resumed the backup cycles.")
+	case "save":
+		abspath := filepath.Clean(req.arg)
+		if err := gs.listfiles(); err != nil {
+			return err
+		}
+		if err := gs.savepath(abspath, true); err != nil {
+			gs.markfailure(abspath, err)
+			touched[abspath] = true
+			return err
+		}
+		delete(touched, abspath)
+		delete(gs.retries, abspath)
+		return gs.savesnapshot()
+	case "reload-config":
+		return gs.reloadset(req.config)
+	}
+	return nil
+}
+
+// flagvalues returns the values of all flags keyed by their name.
+func flagvalues() map[string]string {
+	values := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) { values[f.Name] = f.Value.String() })
+	return values
+}
+
+// checkflagvalue reports whether the flag accepts value without setting it.
+func checkflagvalue(name, value string) error {
+	var err error
+	switch flag.Lookup(name).Value.(flag.Getter).Get().(type) {
+	case bool:
+		_, err = strconv.ParseBool(value)
+	case int:
+		_, err = strconv.ParseInt(value, 0, strconv.IntSize)
+	case time.Duration:
+		_, err = time.ParseDuration(value)
+	}
+	return err
+}
+
+// reloadconfig rereads the config files on top of the old flag values.
+// the flags set on the command line keep their values, so do the ones removed from the config.
+// the restartflags keep their values too and it fails if the config changed them, the rest of the config still applies then.
+func reloadconfig(old map[string]string) (*daemonconfig, error) {
+	overridden := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { overridden[f.Name] = true })
+	values := maps.Clone(old)
+	err := configlines(old["profile"], func(cfgfile, flagname, value string) error {
+		if overridden[flagname] {
+			return nil
+		}
+		if err := checkflagvalue(flagname, value); err != nil {
+			return fmt.Errorf("gdsnap.SetConfigFlag file=%s flag=%s: %v", cfgfile, flagname, err)
+		}
+		values[flagname] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var restart []string
+	for _, name := range restartflags {
+		if values[name] != old[name] {
+			values[name] = old[name]
+			restart = append(restart, name)
+		}
+	}
+	cfg := &daemonconfig{values: values}
+	// checkflagvalue accepted both values.
+	cfg.opts.cycledur, _ = time.ParseDuration(values["cycledur"])
+	sizelimitmb, _ := strconv.ParseInt(values["sizelimitmb"], 0, strconv.IntSize)
+	cfg.opts.sizelimitmb = int(sizelimitmb)
+	if len(restart) > 0 {
+		log.Printf("[warning] reloaded the config but the changes of %s need a restart.", strings.Join(restart, ", "))
+		return cfg, fmt.Errorf("gdsnap.RestartNeeded flags=%s", strings.Join(restart, ","))
+	}
+	return cfg, nil
+}
+
+// reloadset applies the reloaded config to the set.
+// only the ignore globs, the retention policy and the options can change without a restart.
+func (gs *gdsnap) reloadset(cfg *daemonconfig) error {
+	gs.opts = cfg.opts
+	set := valueset(cfg.values)
+	if gs.set.configured {
+		var err error
+		if set, err = configset(gs.set.profile); err != nil {
+			return err
+		}
+	}
+	retention, err := parseretention(set.retention)
+	if err != nil {
+		return err
+	}
+	gs.set.ignore, gs.set.retention, gs.retention = set.ignore, set.retention, retention
+	gs.ignore.reset(set.ignore)
+	if set.backend != gs.set.backend || set.dir != gs.set.dir || set.gdir != gs.set.gdir || set.password != gs.set.password || set.encryptnames != gs.set.encryptnames {
+		log.Printf("[warning] reloaded the config of the %s set but its backend, dir, gdir, password or encryptnames changes need a restart.", gs.set.profile)
+		return fmt.Errorf("gdsnap.RestartNeeded set=%s", gs.set.profile)
+	}
+	log.Printf("reloaded the config of the %s set.", gs.set.profile)
+	return nil
+}
+
+func subcommandCtl(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("gdsnap.BadCtlArgs (usage: gdsnap ctl flush|pause|resume|save [path]|reload-config|quit)")
+	}
+	if *controlsockFlag == "" {
+		return fmt.Errorf("gdsnap.MissingControlsock (set -controlsock to the watch daemon's)")
+	}
+	req := strings.Join(args, " ")
+	if args[0] == "save" && len(args) == 2 {
+		// the daemon might run in another directory.
+		abspath, err := filepath.Abs(args[1])
+		if err != nil {
+			return fmt.Errorf("gdsnap.AbsPath path=%s: %v", args[1], err)
+		}
+		req = "save " + abspath
+	}
+	conn, err := net.Dial("unix", *controlsockFlag)
+	if err != nil {
+		return fmt.Errorf("gdsnap.DialControl sock=%s (is watch running with this -controlsock?): %v", *controlsockFlag, err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, req); err != nil {
+		return fmt.Errorf("gdsnap.SendControl: %v", err)
+	}
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("gdsnap.ReadControlResponse: %v", err)
+	}
+	response = strings.TrimSuffix(response, "\n")
+	if msg, ok := strings.CutPrefix(response, "error: "); ok {
+		return fmt.Errorf("gdsnap.ControlFailed cmd=%s: %s", args[0], msg)
+	}
+	return nil
+}
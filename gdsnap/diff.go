@@ -0,0 +1,435 @@
+package gdsnap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// editop is a line of a line based edit script: ' ' keeps, '-' deletes and '+' inserts the line.
+type editop struct {
+	op   byte
+	line string
+}
+
+// splitlines splits the content into lines, each keeps its newline except possibly the last one.
+func splitlines(content []byte) []string {
+	var lines []string
+	for len(content) > 0 {
+		i := bytes.IndexByte(content, '\n') + 1
+		if i == 0 {
+			i = len(content)
+		}
+		lines = append(lines, string(content[:i]))
+		content = content[i:]
+	}
+	return lines
+}
+
+// linediff returns a shortest edit script that turns a into b.
+// it's myers' algorithm in linear space: bisect finds a point on an optimal path in the middle and the halves are diffed recursively.
+func linediff(a, b []string) []editop {
+	var ops []editop
+	emit := func(op byte, lines []string) {
+		for _, line := range lines {
+			ops = append(ops, editop{op, line})
+		}
+	}
+	var rec func(a, b []string)
+	rec = func(a, b []string) {
+		n := 0
+		for n < len(a) && n < len(b) && a[n] == b[n] {
+			n++
+		}
+		emit(' ', a[:n])
+		a, b = a[n:], b[n:]
+		m := 0
+		for m < len(a) && m < len(b) && a[len(a)-1-m] == b[len(b)-1-m] {
+			m++
+		}
+		suffix := a[len(a)-m:]
+		a, b = a[:len(a)-m], b[:len(b)-m]
+		if len(a) == 0 || len(b) == 0 {
+			emit('-', a)
+			emit('+', b)
+		} else if x, y, ok := bisect(a, b); ok {
+			rec(a[:x], b[:y])
+			rec(a[x:], b[y:])
+		} else {
+			emit('-', a)
+			emit('+', b)
+		}
+		emit(' ', suffix)
+	}
+	rec(a, b)
+	return ops
+}
+
+// bisect returns a point of an optimal path through the edit graph of a and b where the forward and the backward searches meet.
+// ok is false if a and b have nothing in common.
+func bisect(a, b []string) (x, y int, ok bool) {
+	n, m := len(a), len(b)
+	maxd := (n + m + 1) / 2
+	off := maxd
+	vf, vb := make([]int, 2*maxd+2), make([]int, 2*maxd+2)
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+	vf[off+1], vb[off+1] = 0, 0
+	delta := n - m
+	front := delta%2 != 0
+	// the diagonals that run off the edit graph are skipped by narrowing the range of k.
+	var fstart, fend, bstart, bend int
+	for d := 0; d < maxd; d++ {
+		for k := -d + fstart; k <= d-fend; k += 2 {
+			var x1 int
+			if k == -d || k != d && vf[off+k-1] < vf[off+k+1] {
+				x1 = vf[off+k+1]
+			} else {
+				x1 = vf[off+k-1] + 1
+			}
+			y1 := x1 - k
+			for x1 < n && y1 < m && a[x1] == b[y1] {
+				x1, y1 = x1+1, y1+1
+			}
+			vf[off+k] = x1
+			if x1 > n {
+				fend += 2
+			} else if y1 > m {
+				fstart += 2
+			} else if kb := off + delta - k; front && kb >= 0 && kb < len(vb) && vb[kb] != -1 && x1 >= n-vb[kb] {
+				return x1, y1, true
+			}
+		}
+		for k := -d + bstart; k <= d-bend; k += 2 {
+			var x2 int
+			if k == -d || k != d && vb[off+k-1] < vb[off+k+1] {
+				x2 = vb[off+k+1]
+			} else {
+				x2 = vb[off+k-1] + 1
+			}
+			y2 := x2 - k
+			for x2 < n && y2 < m && a[n-x2-1] == b[m-y2-1] {
+				x2, y2 = x2+1, y2+1
+			}
+			vb[off+k] = x2
+			if x2 > n {
+				bend += 2
+			} else if y2 > m {
+				bstart += 2
+			} else if kf := off + delta - k; !front && kf >= 0 && kf < len(vf) && vf[kf] != -1 && vf[kf] >= n-x2 {
+				return vf[kf], vf[kf] - (kf - off), true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// unifieddiff writes the diff of a and b in the format of diff -u.
+// it writes nothing if they are the same.
+func unifieddiff(w io.Writer, alabel, blabel string, a, b []byte) {
+	if bytes.Equal(a, b) {
+		return
+	}
+	if bytes.IndexByte(a, 0) >= 0 || bytes.IndexByte(b, 0) >= 0 {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", alabel, blabel)
+		return
+	}
+	const context = 3
+	ops := linediff(splitlines(a), splitlines(b))
+	// aline[i] and bline[i] are the number of lines of a and b before ops[i].
+	aline, bline := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		aline[i+1], bline[i+1] = aline[i], bline[i]
+		if op.op != '+' {
+			aline[i+1]++
+		}
+		if op.op != '-' {
+			bline[i+1]++
+		}
+	}
+	rangestr := func(start, n int) string {
+		if n == 1 {
+			return fmt.Sprint(start + 1)
+		}
+		if n == 0 {
+			return fmt.Sprintf("%d,0", start)
+		}
+		return fmt.Sprintf("%d,%d", start+1, n)
+	}
+
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", alabel, blabel)
+	for i := 0; i < len(ops); {
+		if ops[i].op == ' ' {
+			i++
+			continue
+		}
+		// extend the hunk while the next change is within the context of the previous one.
+		start, end := max(i-context, 0), i
+		for end < len(ops) {
+			for end < len(ops) && ops[end].op != ' ' {
+				end++
+			}
+			next := end
+			for next < len(ops) && ops[next].op == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*context {
+				break
+			}
+			end = next
+		}
+		end = min(end+context, len(ops))
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", rangestr(aline[start], aline[end]-aline[start]), rangestr(bline[start], bline[end]-bline[start]))
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(w, "%c%s", op.op, op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				fmt.Fprint(w, "\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+}
+
+// diffversion is one side of a diff: a file at some point in time.
+type diffversion struct {
+	// kind is "regular file", "symlink" or "directory", empty if the file doesn't exist.
+	kind string
+
+	// content is the symlink's target for symlinks.
+	// it's nil if the file is larger than -sizelimitmb, only its sum is kept then.
+	content []byte
+	sum     [32]byte
+}
+
+// readversion reads the content of a version.
+func readversion(kind string, r io.Reader) (diffversion, error) {
+	v := diffversion{kind: kind}
+	limit := int64(*sizelimitmbFlag) * 1e6
+	content, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return v, err
+	}
+	if int64(len(content)) <= limit {
+		v.content, v.sum = content, sha256.Sum256(content)
+		return v, nil
+	}
+	h := sha256.New()
+	h.Write(content)
+	if _, err := io.Copy(h, r); err != nil {
+		return v, err
+	}
+	h.Sum(v.sum[:0])
+	return v, nil
+}
+
+// archiveversion fetches the revision of fi in its HeadRevisionID.
+func (gs *gdsnap) archiveversion(fi fileinfo) (diffversion, error) {
+	mime, _, content, err := gs.fetchrev(&fi, fi.HeadRevisionID, fi.MimeType)
+	if err != nil {
+		return diffversion{}, err
+	}
+	defer content.Close()
+	kind := "regular file"
+	if mime == "gdsnap/symlink" {
+		kind = "symlink"
+	} else if strings.HasPrefix(mime, "gdsnap/dir") {
+		return diffversion{kind: "directory"}, nil
+	}
+	return readversion(kind, content)
+}
+
+// localversion reads a file from the disk.
+func localversion(abspath string, finfo fs.FileInfo) (diffversion, error) {
+	switch {
+	case finfo.Mode().Type() == fs.ModeSymlink:
+		target, err := os.Readlink(abspath)
+		return diffversion{kind: "symlink", content: []byte(target), sum: sha256.Sum256([]byte(target))}, err
+	case finfo.IsDir():
+		return diffversion{kind: "directory"}, nil
+	}
+	f, err := os.Open(abspath)
+	if err != nil {
+		return diffversion{}, err
+	}
+	defer f.Close()
+	return readversion("regular file", f)
+}
+
+// difftree resolves the argument of -from and -to to a tree.
+// it's either a time in the -t format or "snapshot:" followed by a snapshot ID or a time to pick the latest snapshot before it.
+func (gs *gdsnap) difftree(s string) (map[string]fileinfo, error) {
+	if id, ok := strings.CutPrefix(s, "snapshot:"); ok {
+		id, err := gs.findsnapshot(id)
+		if err != nil {
+			return nil, err
+		}
+		return gs.readsnapshot(id)
+	}
+	t, err := parsetime(s, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return gs.treeat(t)
+}
+
+func (gs *gdsnap) subcommandDiff(args []string) error {
+	if *toFlag != "" && *fromFlag == "" {
+		return fmt.Errorf("gdsnap.ToWithoutFrom (-to needs -from)")
+	}
+	if *fromFlag != "" && (*tFlag != "" || *snapshotFlag != "") {
+		return fmt.Errorf("gdsnap.FromWithT (-from is mutually exclusive with -t and -snapshot)")
+	}
+	if err := gs.listtree(); err != nil {
+		return err
+	}
+
+	// from is the old side, to is the new side or nil for the files on disk.
+	var from, to map[string]fileinfo
+	var err error
+	alabel, blabel := "archive/", "current/"
+	switch {
+	case *fromFlag != "":
+		if from, err = gs.difftree(*fromFlag); err != nil {
+			return err
+		}
+		if *toFlag != "" {
+			alabel, blabel = "from/", "to/"
+			if to, err = gs.difftree(*toFlag); err != nil {
+				return err
+			}
+		}
+	case *tFlag != "":
+		if from, err = gs.treeat(*tFlag); err != nil {
+			return err
+		}
+	default:
+		from = map[string]fileinfo{}
+		for relpath, fi := range gs.files {
+			if !fi.Trashed {
+				from[relpath] = fi
+			}
+		}
+	}
+
+	paths := map[string]bool{}
+	for relpath := range from {
+		paths[relpath] = true
+	}
+	var local map[string]fs.FileInfo
+	if to == nil {
+		if local, err = gs.localfiles(); err != nil {
+			return err
+		}
+		for relpath := range local {
+			paths[relpath] = true
+		}
+	} else {
+		for relpath := range to {
+			paths[relpath] = true
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, relpath := range filterfiles(paths, args) {
+		afi, aok := from[relpath]
+		var bfi fileinfo
+		var bok bool
+		var finfo fs.FileInfo
+		if to != nil {
+			bfi, bok = to[relpath]
+			if aok && bok && afi.ID == bfi.ID && afi.HeadRevisionID == bfi.HeadRevisionID {
+				continue
+			}
+		} else {
+			finfo, bok = local[relpath]
+			if !bok && aok {
+				// localfiles skips the ignored files and the non-empty directories, check the disk too.
+				if fi, err := os.Lstat(filepath.Join(gs.set.dir, relpath)); err == nil {
+					finfo, bok = fi, true
+				}
+			}
+			if aok && bok && finfo.IsDir() && strings.HasPrefix(afi.MimeType, "gdsnap/dir") {
+				continue
+			}
+			if aok && bok && !finfo.IsDir() && finfo.ModTime().UTC().Format(tLayout) == afi.ModifiedTime {
+				continue
+			}
+		}
+
+		var a, b diffversion
+		if aok {
+			if a, err = gs.archiveversion(afi); err != nil {
+				return fmt.Errorf("gdsnap.DiffFetch relpath=%s: %v", relpath, err)
+			}
+		}
+		if bok && to != nil {
+			if b, err = gs.archiveversion(bfi); err != nil {
+				return fmt.Errorf("gdsnap.DiffFetch relpath=%s: %v", relpath, err)
+			}
+		} else if bok {
+			if !finfo.Mode().IsRegular() && !finfo.IsDir() && finfo.Mode().Type() != fs.ModeSymlink {
+				fmt.Fprintf(out, "skipping %s because it's not a regular file.\n", relpath)
+				continue
+			}
+			if b, err = localversion(filepath.Join(gs.set.dir, relpath), finfo); err != nil {
+				fmt.Fprintf(out, "skipping %s because can't read it: %v.\n", relpath, err)
+				continue
+			}
+		}
+		printdiff(out, relpath, alabel, blabel, a, b)
+	}
+	return nil
+}
+
+// printdiff prints the difference of the two versions of relpath.
+// with -summary it prints only whether the file was added, removed or modified.
+func printdiff(w io.Writer, relpath, alabel, blabel string, a, b diffversion) {
+	if a.kind == b.kind && a.sum == b.sum {
+		return
+	}
+	if *summaryFlag {
+		status := "modified"
+		if a.kind == "" {
+			status = "added"
+		} else if b.kind == "" {
+			status = "removed"
+		}
+		fmt.Fprintf(w, "%s %s\n", status, relpath)
+		return
+	}
+	alabel, blabel = alabel+relpath, blabel+relpath
+	if a.kind == "" {
+		alabel = "/dev/null"
+	} else if b.kind == "" {
+		blabel = "/dev/null"
+	}
+	switch {
+	case a.kind != "" && b.kind != "" && a.kind != b.kind:
+		fmt.Fprintf(w, "%s differs in type: -%s vs +%s.\n", relpath, a.kind, b.kind)
+	case a.kind == "directory":
+		fmt.Fprintf(w, "%s is a removed empty directory.\n", relpath)
+	case b.kind == "directory":
+		fmt.Fprintf(w, "%s is a new empty directory.\n", relpath)
+	case a.kind == "symlink" || b.kind == "symlink":
+		fmt.Fprintf(w, "--- %s\n+++ %s\n", alabel, blabel)
+		if a.kind != "" {
+			fmt.Fprintf(w, "-%s\n", a.content)
+		}
+		if b.kind != "" {
+			fmt.Fprintf(w, "+%s\n", b.content)
+		}
+	case a.content == nil && a.kind != "" || b.content == nil && b.kind != "":
+		fmt.Fprintf(w, "Files %s and %s differ\n", alabel, blabel)
+	default:
+		unifieddiff(w, alabel, blabel, a.content, b.content)
+	}
+}
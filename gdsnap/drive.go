@@ -0,0 +1,791 @@
+package gdsnap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/rand/v2"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the endpoints are variables so that the tests can point them to a fake server.
+var (
+	driveURL  = "https://www.googleapis.com"
+	tokenURL  = "https://oauth2.googleapis.com/token"
+	authURL   = "https://accounts.google.com/o/oauth2/auth"
+	deviceURL = "https://oauth2.googleapis.com/device/code"
+)
+
+// accesstoken caches the oauth2 access token of the -refreshtoken.
+// the backends of the backup sets of a watch share it, see -sets.
+type accesstoken struct {
+	// mu guards the token because the uploads run concurrently.
+	mu    sync.Mutex
+	token string
+	birth time.Time
+}
+
+// driveBackend stores the backup in a google drive directory.
+// gdir is the ID of the directory.
+// each backed up file is a gdrive file with the gdsnap.profile property set.
+// the metadata blobs are gdrive files in the same directory with the gdsnap.meta property set to "[profile]/[name]"
+// and the gdsnap.metaprofile property set to the profile.
+type driveBackend struct {
+	gdir, profile string
+	tok           *accesstoken
+
+	// metaids caches the IDs of the metadata blobs by name.
+	// metamu guards it because the lease is renewed concurrently with the other operations.
+	metamu  sync.Mutex
+	metaids map[string]string
+}
+
+// setmetaid caches the ID of a metadata blob, an empty id drops it.
+func (d *driveBackend) setmetaid(name, id string) {
+	d.metamu.Lock()
+	defer d.metamu.Unlock()
+	if id == "" {
+		delete(d.metaids, name)
+	} else {
+		d.metaids[name] = id
+	}
+}
+
+// token returns the access token and refreshes it first if it's about to expire.
+func (d *driveBackend) token() (string, error) {
+	if len(*refreshtokenFlag) == 0 {
+		return "", fmt.Errorf("gdsnap.MissingRefreshtoken (use the auth subcommand to get one)")
+	}
+
+	d.tok.mu.Lock()
+	defer d.tok.mu.Unlock()
+	now := time.Now()
+	if now.Sub(d.tok.birth) < 50*time.Minute {
+		return d.tok.token, nil
+	}
+
+	q := url.Values{}
+	q.Set("client_id", oaClientID)
+	q.Set("client_secret", oaSecret)
+	q.Set("refresh_token", *refreshtokenFlag)
+	q.Set("grant_type", "refresh_token")
+	response, err := http.Post(tokenURL, "application/x-www-form-urlencoded", strings.NewReader(q.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("gdsnap.RefreshToken: %v", err)
+	}
+	responseBody, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("gdsnap.ReadTokenResponse: %v", err)
+	}
+	var r map[string]interface{}
+	if err = json.Unmarshal(responseBody, &r); err != nil {
+		return "", fmt.Errorf("gdsnap.ParseTokenResponse status=%q: %v", response.Status, err)
+	}
+	accesstoken, ok := r["access_token"].(string)
+	if !ok {
+		return "", fmt.Errorf("gdsnap.MissingAccessToken response=%q (run `gdsnap auth`?)", responseBody)
+	}
+	d.tok.token, d.tok.birth = accesstoken, now
+	return accesstoken, nil
+}
+
+// ratelimitwait is the wait after the first rate limited response, it doubles after each consecutive one.
+var ratelimitwait = time.Second
+
+// do runs an authorized request.
+// the rate limited requests are retried with an exponential backoff.
+func (d *driveBackend) do(req *http.Request) (*http.Response, error) {
+	wait := ratelimitwait
+	for attempt := 1; ; attempt++ {
+		token, err := d.token()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != 403 && resp.StatusCode != 429 {
+			return resp, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		ratelimited := resp.StatusCode == 429 || strings.Contains(strings.ToLower(string(body)), "ratelimitexceeded")
+		if !ratelimited || attempt >= 8 || req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+		log.Printf("gdrive rate limited a request, retrying in %s.", wait)
+		time.Sleep(wait + rand.N(wait/2+1))
+		wait *= 2
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// get runs an authorized GET request and returns the body of the response.
+func (d *driveBackend) get(u string) ([]byte, error) {
+	return d.request("GET", u, nil)
+}
+
+// request runs an authorized request with an optional json body and returns the body of the response.
+func (d *driveBackend) request(method, u string, reqbody []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(reqbody))
+	if err != nil {
+		return nil, err
+	}
+	if reqbody != nil {
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := d.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		return nil, fmt.Errorf("gdsnap.HTTPStatus status=%q body=%q", resp.Status, body)
+	}
+	return body, nil
+}
+
+func (d *driveBackend) list() (map[string]fileinfo, error) {
+	files := map[string]fileinfo{}
+	type listResponseType struct {
+		IncompleteSearch bool
+		NextPageToken    string
+		Files            []fileinfo
+	}
+
+	// list existing files.
+	q := url.Values{}
+	q.Set("fields", "files(name,id,size,mimeType,modifiedTime,trashed,properties,headRevisionId),nextPageToken,incompleteSearch")
+	q.Set("pageSize", "1000")
+	q.Set("q", fmt.Sprintf("'%s' in parents and properties has {key='gdsnap.profile' and value='%s'}", d.gdir, d.profile))
+	for {
+		listbody, err := d.get(driveURL + "/drive/v3/files?" + q.Encode())
+		if err != nil {
+			return nil, fmt.Errorf("gdsnap.ListFiles: %v", err)
+		}
+		var r listResponseType
+		if err = json.Unmarshal(listbody, &r); err != nil {
+			return nil, fmt.Errorf("gdsnap.ParseListResponse body=%q: %v", listbody, err)
+		}
+		if r.IncompleteSearch {
+			return nil, fmt.Errorf("gdsnap.IncompleteListResponse")
+		}
+		for _, f := range r.Files {
+			files[namePart(f.Name)] = f
+		}
+		if len(r.NextPageToken) == 0 {
+			break
+		}
+		q.Set("pageToken", r.NextPageToken)
+	}
+	return files, nil
+}
+
+func (d *driveBackend) changes(token string) ([]fileinfo, string, error) {
+	if token == "" {
+		body, err := d.get(driveURL + "/drive/v3/changes/startPageToken")
+		if err != nil {
+			return nil, "", fmt.Errorf("gdsnap.GetStartPageToken: %v", err)
+		}
+		var r struct{ StartPageToken string }
+		if err := json.Unmarshal(body, &r); err != nil || r.StartPageToken == "" {
+			return nil, "", fmt.Errorf("gdsnap.ParseStartPageToken body=%q: %v", body, err)
+		}
+		return nil, r.StartPageToken, nil
+	}
+
+	type changesResponseType struct {
+		NextPageToken     string
+		NewStartPageToken string
+		Changes           []struct {
+			FileID  string
+			Removed bool
+			File    struct {
+				fileinfo
+				Parents    []string
+				Properties map[string]string
+			}
+		}
+	}
+	var files []fileinfo
+	q := url.Values{}
+	q.Set("fields", "changes(fileId,removed,file(name,id,size,mimeType,modifiedTime,trashed,properties,headRevisionId,parents)),nextPageToken,newStartPageToken")
+	q.Set("pageSize", "1000")
+	q.Set("spaces", "drive")
+	for {
+		q.Set("pageToken", token)
+		body, err := d.get(driveURL + "/drive/v3/changes?" + q.Encode())
+		if err != nil {
+			return nil, "", fmt.Errorf("gdsnap.ListChanges: %v", err)
+		}
+		var r changesResponseType
+		if err := json.Unmarshal(body, &r); err != nil {
+			return nil, "", fmt.Errorf("gdsnap.ParseChangesResponse body=%q: %v", body, err)
+		}
+		for _, c := range r.Changes {
+			// the changes cover the whole drive so the files of other directories and profiles are reported as removed.
+			f := c.File
+			if c.Removed || f.Properties["gdsnap.profile"] != d.profile || !slices.Contains(f.Parents, d.gdir) {
+				files = append(files, fileinfo{ID: c.FileID})
+			} else {
+				files = append(files, f.fileinfo)
+			}
+		}
+		if r.NewStartPageToken != "" {
+			return files, r.NewStartPageToken, nil
+		}
+		if r.NextPageToken == "" {
+			return nil, "", fmt.Errorf("gdsnap.MissingChangesToken body=%q", body)
+		}
+		token = r.NextPageToken
+	}
+}
+
+type gfileProperties struct {
+	Name         string            `json:"name,omitempty"`
+	Parents      []string          `json:"parents,omitempty"`
+	Properties   map[string]string `json:"properties,omitempty"`
+	ModifiedTime string            `json:"modifiedTime,omitempty"`
+	Trashed      *bool             `json:"trashed,omitempty"`
+}
+
+func (d *driveBackend) upload(fi fileinfo, r io.Reader) (fileinfo, error) {
+	return d.put(fi, map[string]string{"gdsnap.profile": d.profile}, r)
+}
+
+// put is upload with custom properties for the created files.
+func (d *driveBackend) put(fi fileinfo, properties map[string]string, r io.Reader) (fileinfo, error) {
+	relpath := namePart(fi.Name)
+	ct := gfileProperties{}
+	if fi.ID == "" {
+		ct = gfileProperties{
+			Name:       fi.Name,
+			Parents:    []string{d.gdir},
+			Properties: properties,
+		}
+	} else {
+		ct = gfileProperties{
+			Name:    fi.Name,
+			Trashed: &fi.Trashed,
+		}
+	}
+	// the deletions usually have no modifiedTime so that gdrive stamps them with the upload time, see trash.
+	// import sets it to keep the original time of the deletions.
+	ct.ModifiedTime = fi.ModifiedTime
+	createData, err := json.Marshal(ct)
+	if err != nil {
+		return fi, fmt.Errorf("gdsnap.MarshalProperties name=%s: %v", relpath, err)
+	}
+	size := int64(-1)
+	if fi.Size != "" {
+		if size, err = strconv.ParseInt(fi.Size, 10, 64); err != nil {
+			return fi, fmt.Errorf("gdsnap.ParseSize name=%s size=%q: %v", relpath, fi.Size, err)
+		}
+	}
+
+	var resp *http.Response
+	if size < 0 || size > 5e6 {
+		// large files must be uploaded through a resumable upload session.
+		var startReq *http.Request
+		if fi.ID != "" {
+			startReq, err = http.NewRequest("PATCH", driveURL+"/upload/drive/v3/files/"+fi.ID+"?uploadType=resumable&fields=id,headRevisionId", bytes.NewReader(createData))
+		} else {
+			startReq, err = http.NewRequest("POST", driveURL+"/upload/drive/v3/files?uploadType=resumable&fields=id,headRevisionId", bytes.NewReader(createData))
+		}
+		if err != nil {
+			return fi, fmt.Errorf("gdsnap.CreateLargeUploadRequest name=%s: %v", relpath, err)
+		}
+		startReq.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		startReq.Header.Set("X-Upload-Content-Type", fi.MimeType)
+		if size >= 0 {
+			startReq.Header.Set("X-Upload-Content-Length", fi.Size)
+		}
+		startResp, err := d.do(startReq)
+		if err != nil {
+			return fi, fmt.Errorf("gdsnap.StartLargeUpload name=%s: %v", relpath, err)
+		}
+		body, _ := io.ReadAll(startResp.Body)
+		startResp.Body.Close()
+		if startResp.StatusCode/100 != 2 {
+			return fi, fmt.Errorf("gdsnap.StartLargeUpload name=%s status=%q body=%q", relpath, startResp.Status, body)
+		}
+		loc := startResp.Header.Get("Location")
+		if len(loc) == 0 {
+			return fi, fmt.Errorf("gdsnap.MissingUploadLocation name=%s", relpath)
+		}
+
+		var n int64
+		if resp, n, err = d.uploadpieces(loc, r); err != nil {
+			return fi, fmt.Errorf("gdsnap.LargeUpload name=%s: %v", relpath, err)
+		}
+		fi.Size = strconv.FormatInt(n, 10)
+	} else {
+		contents, err := io.ReadAll(r)
+		if err != nil {
+			return fi, fmt.Errorf("gdsnap.ReadContent name=%s: %v", relpath, err)
+		}
+		reqBuf := &bytes.Buffer{}
+		w := multipart.NewWriter(reqBuf)
+		mimeHeader := textproto.MIMEHeader{}
+		mimeHeader.Set("Content-Type", "application/json; charset=UTF-8")
+		metadataWriter, err := w.CreatePart(mimeHeader)
+		if err != nil {
+			return fi, fmt.Errorf("gdsnap.CreateMetadataPart name=%s: %v", relpath, err)
+		}
+		metadataWriter.Write(createData)
+		mimeHeader.Set("Content-Type", fi.MimeType)
+		contentWriter, err := w.CreatePart(mimeHeader)
+		if err != nil {
+			return fi, fmt.Errorf("gdsnap.CreateContentPart name=%s: %v", relpath, err)
+		}
+		contentWriter.Write(contents)
+		w.Close()
+
+		var createReq *http.Request
+		if fi.ID != "" {
+			createReq, err = http.NewRequest("PATCH", driveURL+"/upload/drive/v3/files/"+fi.ID+"?uploadType=multipart&fields=id,headRevisionId", bytes.NewReader(reqBuf.Bytes()))
+		} else {
+			createReq, err = http.NewRequest("POST", driveURL+"/upload/drive/v3/files?uploadType=multipart&fields=id,headRevisionId", bytes.NewReader(reqBuf.Bytes()))
+		}
+		if err != nil {
+			return fi, fmt.Errorf("gdsnap.CreateUploadRequest name=%s: %v", relpath, err)
+		}
+		createReq.Header.Set("Accept", "application/json")
+		createReq.Header.Set("Content-Type", "multipart/related; boundary="+w.Boundary())
+		if resp, err = d.do(createReq); err != nil {
+			return fi, fmt.Errorf("gdsnap.Upload name=%s: %v", relpath, err)
+		}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fi, fmt.Errorf("gdsnap.ReadUploadResponse name=%s: %v", relpath, err)
+	}
+	// the resumable uploads of the new files end with 201 Created.
+	if resp.StatusCode/100 != 2 {
+		return fi, fmt.Errorf("gdsnap.Upload name=%s status=%q body=%q", relpath, resp.Status, body)
+	}
+	var created struct{ ID, HeadRevisionID string }
+	if err := json.Unmarshal(body, &created); err != nil || created.ID == "" {
+		return fi, fmt.Errorf("gdsnap.ParseUploadResponse name=%s body=%q: %v", relpath, body, err)
+	}
+	fi.ID, fi.HeadRevisionID = created.ID, created.HeadRevisionID
+	return fi, nil
+}
+
+// uploadPieceSize is the size of the pieces of the resumable uploads.
+// it must be a multiple of 256 KiB.
+var uploadPieceSize = 8 << 20
+
+// uploadpieces uploads the content into a resumable upload session piece by piece to keep the memory usage bounded.
+// the total size is only sent with the last piece so r can be a stream of unknown length.
+// it returns the response to the last piece and the total size.
+func (d *driveBackend) uploadpieces(loc string, r io.Reader) (*http.Response, int64, error) {
+	buf := make([]byte, uploadPieceSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return nil, offset, fmt.Errorf("gdsnap.ReadUploadPiece offset=%d: %v", offset, err)
+		}
+		total := "*"
+		if last {
+			total = strconv.FormatInt(offset+int64(n), 10)
+		}
+		resp, err := d.uploadpiece(loc, buf[:n], offset, total)
+		if err != nil {
+			return nil, offset, err
+		}
+		offset += int64(n)
+		if last {
+			return resp, offset, nil
+		}
+	}
+}
+
+// uploadattempts is the number of times a piece of a resumable upload is tried before giving up.
+const uploadattempts = 8
+
+// uploadpiece uploads the piece of a resumable upload that starts at offset.
+// the failures are retried with a backoff from where the session's status says the upload stopped.
+// it returns the response if the piece is the last one, i.e. total is not "*".
+func (d *driveBackend) uploadpiece(loc string, piece []byte, offset int64, total string) (*http.Response, error) {
+	end := offset + int64(len(piece))
+	sent, wait := offset, ratelimitwait
+	var failure error
+	for attempt := 1; attempt <= uploadattempts; attempt++ {
+		if attempt > 1 {
+			log.Printf("[warning] uploading a piece failed, resuming in %s: %v", wait, failure)
+			time.Sleep(wait + rand.N(wait/2+1))
+			wait *= 2
+			resp, received, err := d.uploadstatus(loc, total)
+			if err != nil {
+				failure = err
+				continue
+			}
+			if resp != nil {
+				return resp, nil
+			}
+			if received < offset || received > end {
+				return nil, fmt.Errorf("gdsnap.UploadRangeMismatch offset=%d end=%d received=%d", offset, end, received)
+			}
+			sent = received
+		}
+		contentRange := fmt.Sprintf("bytes %d-%d/%s", sent, end-1, total)
+		if sent == end {
+			contentRange = "bytes */" + total
+		}
+		req, err := http.NewRequest("PUT", loc, bytes.NewReader(piece[sent-offset:]))
+		if err != nil {
+			return nil, fmt.Errorf("gdsnap.CreateUploadPieceRequest offset=%d: %v", sent, err)
+		}
+		req.Header.Set("Content-Range", contentRange)
+		resp, err := d.do(req)
+		if err != nil {
+			failure = fmt.Errorf("gdsnap.UploadPiece offset=%d: %v", sent, err)
+			continue
+		}
+		if total != "*" && resp.StatusCode/100 == 2 {
+			return resp, nil
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		// 308 is the "resume incomplete" status, the range header tells how much was received so far.
+		if total == "*" && resp.StatusCode == 308 && resp.Header.Get("Range") == fmt.Sprintf("bytes=0-%d", end-1) {
+			return nil, nil
+		}
+		failure = fmt.Errorf("gdsnap.UploadPiece offset=%d status=%q range=%q body=%q", sent, resp.Status, resp.Header.Get("Range"), body)
+		// the client errors such as an expired session are not worth retrying.
+		if resp.StatusCode/100 == 4 && resp.StatusCode != 408 && resp.StatusCode != 429 {
+			return nil, failure
+		}
+	}
+	return nil, failure
+}
+
+// uploadstatus asks the resumable upload session how many bytes it has received.
+// total is the total size if known or "*".
+// the response is returned instead if the upload is already complete.
+func (d *driveBackend) uploadstatus(loc, total string) (*http.Response, int64, error) {
+	req, err := http.NewRequest("PUT", loc, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("gdsnap.CreateUploadStatusRequest: %v", err)
+	}
+	req.Header.Set("Content-Range", "bytes */"+total)
+	resp, err := d.do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("gdsnap.UploadStatus: %v", err)
+	}
+	if total != "*" && resp.StatusCode/100 == 2 {
+		return resp, 0, nil
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 308 {
+		return nil, 0, fmt.Errorf("gdsnap.UploadStatus status=%q body=%q", resp.Status, body)
+	}
+	// the range is missing if nothing was received yet.
+	rng := resp.Header.Get("Range")
+	if rng == "" {
+		return nil, 0, nil
+	}
+	var last int64
+	if _, err := fmt.Sscanf(rng, "bytes=0-%d", &last); err != nil {
+		return nil, 0, fmt.Errorf("gdsnap.ParseUploadRange range=%q: %v", rng, err)
+	}
+	return nil, last + 1, nil
+}
+
+func (d *driveBackend) trash(fi fileinfo) (fileinfo, error) {
+	// an empty modifiedTime makes gdrive stamp the deletion with the upload time.
+	fi.Trashed, fi.MimeType, fi.Size, fi.ModifiedTime = true, "gdsnap/deleted", "0", ""
+	return d.upload(fi, strings.NewReader(""))
+}
+
+func (d *driveBackend) revisions(fi *fileinfo) ([]revinfo, error) {
+	q := url.Values{}
+	q.Set("fields", "revisions(originalFilename,id,size,modifiedTime,mimeType,keepForever)")
+	q.Set("pageSize", "1000")
+	body, err := d.get(driveURL + "/drive/v3/files/" + fi.ID + "/revisions?" + q.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.ListRevisions name=%s: %v", namePart(fi.Name), err)
+	}
+	var revisionsResponse struct {
+		Revisions []revinfo
+	}
+	if err = json.Unmarshal(body, &revisionsResponse); err != nil {
+		return nil, fmt.Errorf("gdsnap.ParseRevisions name=%s body=%q: %v", namePart(fi.Name), body, err)
+	}
+	return revisionsResponse.Revisions, nil
+}
+
+func (d *driveBackend) fetch(fi *fileinfo, revid string) (io.ReadCloser, error) {
+	u := driveURL + "/drive/v3/files/" + fi.ID + "?alt=media"
+	if revid != "" {
+		u = driveURL + "/drive/v3/files/" + fi.ID + "/revisions/" + revid + "?alt=media"
+	}
+	getreq, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	getresp, err := d.do(getreq)
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.FetchContent name=%s: %v", namePart(fi.Name), err)
+	}
+	if getresp.StatusCode != 200 {
+		body, _ := io.ReadAll(getresp.Body)
+		getresp.Body.Close()
+		return nil, fmt.Errorf("gdsnap.FetchContent name=%s status=%q body=%q", namePart(fi.Name), getresp.Status, body)
+	}
+	return getresp.Body, nil
+}
+
+func (d *driveBackend) keep(fi *fileinfo, revid string) error {
+	u := driveURL + "/drive/v3/files/" + fi.ID + "/revisions/" + revid
+	if _, err := d.request("PATCH", u, []byte(`{"keepForever":true}`)); err != nil {
+		return fmt.Errorf("gdsnap.KeepRevision name=%s rev=%s: %v", namePart(fi.Name), revid, err)
+	}
+	return nil
+}
+
+func (d *driveBackend) deleterev(fi *fileinfo, revid string) error {
+	u := driveURL + "/drive/v3/files/" + fi.ID + "/revisions/" + revid
+	if _, err := d.request("DELETE", u, nil); err != nil {
+		return fmt.Errorf("gdsnap.DeleteRevision name=%s rev=%s: %v", namePart(fi.Name), revid, err)
+	}
+	return nil
+}
+
+// findmeta returns the ID of a metadata blob or an empty string if it doesn't exist.
+func (d *driveBackend) findmeta(name string) (string, error) {
+	d.metamu.Lock()
+	id, ok := d.metaids[name]
+	d.metamu.Unlock()
+	if ok {
+		return id, nil
+	}
+	q := url.Values{}
+	q.Set("fields", "files(id,trashed)")
+	q.Set("q", fmt.Sprintf("'%s' in parents and properties has {key='gdsnap.meta' and value='%s/%s'}", d.gdir, d.profile, name))
+	body, err := d.get(driveURL + "/drive/v3/files?" + q.Encode())
+	if err != nil {
+		return "", fmt.Errorf("gdsnap.FindMeta name=%s: %v", name, err)
+	}
+	var r struct{ Files []fileinfo }
+	if err = json.Unmarshal(body, &r); err != nil {
+		return "", fmt.Errorf("gdsnap.ParseFindMetaResponse name=%s body=%q: %v", name, body, err)
+	}
+	for _, f := range r.Files {
+		if !f.Trashed {
+			d.setmetaid(name, f.ID)
+			return f.ID, nil
+		}
+	}
+	return "", nil
+}
+
+func (d *driveBackend) getmeta(name string) ([]byte, error) {
+	id, err := d.findmeta(name)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, fmt.Errorf("gdsnap.MetaNotFound name=%s: %w", name, fs.ErrNotExist)
+	}
+	rc, err := d.fetch(&fileinfo{ID: id, Name: "gdsnap.meta." + name + "/"}, "")
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.ReadMeta name=%s: %v", name, err)
+	}
+	return data, nil
+}
+
+func (d *driveBackend) putmeta(name string, data []byte) error {
+	id, err := d.findmeta(name)
+	if err != nil {
+		return err
+	}
+	fi := fileinfo{ID: id, Name: "gdsnap.meta." + name + "/", MimeType: "application/octet-stream", Size: strconv.Itoa(len(data))}
+	props := map[string]string{"gdsnap.meta": d.profile + "/" + name, "gdsnap.metaprofile": d.profile}
+	if fi, err = d.put(fi, props, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	d.setmetaid(name, fi.ID)
+	return nil
+}
+
+func (d *driveBackend) deletemeta(name string) error {
+	id, err := d.findmeta(name)
+	if err != nil || id == "" {
+		return err
+	}
+	if _, err := d.request("DELETE", driveURL+"/drive/v3/files/"+id, nil); err != nil {
+		return fmt.Errorf("gdsnap.DeleteMeta name=%s: %v", name, err)
+	}
+	d.setmetaid(name, "")
+	return nil
+}
+
+func (d *driveBackend) metacopies(name string) ([]metacopy, error) {
+	q := url.Values{}
+	q.Set("fields", "files(id,trashed,createdTime)")
+	q.Set("q", fmt.Sprintf("'%s' in parents and properties has {key='gdsnap.meta' and value='%s/%s'}", d.gdir, d.profile, name))
+	body, err := d.get(driveURL + "/drive/v3/files?" + q.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.FindMeta name=%s: %v", name, err)
+	}
+	var r struct {
+		Files []struct {
+			ID, CreatedTime string
+			Trashed         bool
+		}
+	}
+	if err = json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("gdsnap.ParseFindMetaResponse name=%s body=%q: %v", name, body, err)
+	}
+	// the oldest copy comes first, the lowest ID breaks the ties so that all hosts agree on the order.
+	sort.Slice(r.Files, func(i, j int) bool {
+		a, b := r.Files[i], r.Files[j]
+		return a.CreatedTime < b.CreatedTime || a.CreatedTime == b.CreatedTime && a.ID < b.ID
+	})
+	var copies []metacopy
+	for _, f := range r.Files {
+		if f.Trashed {
+			continue
+		}
+		rc, err := d.fetch(&fileinfo{ID: f.ID, Name: "gdsnap.meta." + name + "/"}, "")
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("gdsnap.ReadMeta name=%s: %v", name, err)
+		}
+		copies = append(copies, metacopy{f.ID, data})
+	}
+	if len(copies) > 0 {
+		d.setmetaid(name, copies[0].id)
+	} else {
+		d.setmetaid(name, "")
+	}
+	return copies, nil
+}
+
+func (d *driveBackend) addmetacopy(name string, data []byte) (string, error) {
+	fi := fileinfo{Name: "gdsnap.meta." + name + "/", MimeType: "application/octet-stream", Size: strconv.Itoa(len(data))}
+	props := map[string]string{"gdsnap.meta": d.profile + "/" + name, "gdsnap.metaprofile": d.profile}
+	fi, err := d.put(fi, props, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	return fi.ID, nil
+}
+
+func (d *driveBackend) deletemetacopy(name, id string) error {
+	if _, err := d.request("DELETE", driveURL+"/drive/v3/files/"+id, nil); err != nil {
+		return fmt.Errorf("gdsnap.DeleteMeta name=%s id=%s: %v", name, id, err)
+	}
+	d.metamu.Lock()
+	if d.metaids[name] == id {
+		delete(d.metaids, name)
+	}
+	d.metamu.Unlock()
+	return nil
+}
+
+func (d *driveBackend) listmeta(prefix string) ([]string, error) {
+	q := url.Values{}
+	q.Set("fields", "files(name,id,trashed),nextPageToken")
+	q.Set("pageSize", "1000")
+	q.Set("q", fmt.Sprintf("'%s' in parents and properties has {key='gdsnap.metaprofile' and value='%s'}", d.gdir, d.profile))
+	var names []string
+	for {
+		body, err := d.get(driveURL + "/drive/v3/files?" + q.Encode())
+		if err != nil {
+			return nil, fmt.Errorf("gdsnap.ListMeta: %v", err)
+		}
+		var r struct {
+			NextPageToken string
+			Files         []fileinfo
+		}
+		if err = json.Unmarshal(body, &r); err != nil {
+			return nil, fmt.Errorf("gdsnap.ParseListMetaResponse body=%q: %v", body, err)
+		}
+		for _, f := range r.Files {
+			name := strings.TrimPrefix(namePart(f.Name), "gdsnap.meta.")
+			if f.Trashed || !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			d.setmetaid(name, f.ID)
+			names = append(names, name)
+		}
+		if len(r.NextPageToken) == 0 {
+			break
+		}
+		q.Set("pageToken", r.NextPageToken)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (d *driveBackend) quota() (quota, error) {
+	body, err := d.get(driveURL + "/drive/v3/about?fields=storageQuota")
+	if err != nil {
+		return quota{}, fmt.Errorf("gdsnap.QueryQuota: %v", err)
+	}
+	var about struct {
+		StorageQuota struct {
+			Usage, Limit, UsageInDrive, UsageInDriveTrash string
+		}
+	}
+	if err = json.Unmarshal(body, &about); err != nil {
+		return quota{}, fmt.Errorf("gdsnap.ParseQuota body=%q: %v", body, err)
+	}
+	q := quota{}
+	fmt.Sscan(about.StorageQuota.Usage, &q.UsageMB)
+	fmt.Sscan(about.StorageQuota.Limit, &q.LimitMB)
+	fmt.Sscan(about.StorageQuota.UsageInDrive, &q.DriveMB)
+	fmt.Sscan(about.StorageQuota.UsageInDriveTrash, &q.TrashMB)
+	q.FreeMB = (q.LimitMB - q.UsageMB) / 1e6
+	q.LimitMB += 1e6 - 1
+	q.UsageMB += 1e6 - 1
+	q.DriveMB += 1e6 - 1
+	q.TrashMB += 1e6 - 1
+	q.LimitMB /= 1e6
+	q.UsageMB /= 1e6
+	q.DriveMB /= 1e6
+	q.TrashMB /= 1e6
+	return q, nil
+}
@@ -0,0 +1,573 @@
+package gdsnap
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakedrive is an in-memory fake of the subset of the drive v3 api that gdsnap uses.
+type fakedrive struct {
+	mu       sync.Mutex
+	srv      *httptest.Server
+	files    map[string]*fakefile
+	sessions map[string]*fakesession
+	nextid   int
+
+	// pagesize overrides the client's pageSize when positive to exercise the paging logic.
+	pagesize int
+
+	// fail makes the next n api calls fail with an internal server error.
+	// it's keyed the same way as requests.
+	fail map[string]int
+
+	// ratelimit makes the next n api calls fail with gdrive's rate limit error.
+	// it's keyed the same way as requests.
+	ratelimit map[string]int
+
+	// partial makes the next n pieces of the resumable uploads fail after storing only the first half of them.
+	partial int
+
+	// requests counts the api calls by "method path" with the IDs elided.
+	requests map[string]int
+
+	// changelog has the IDs of the changed files in the order of the changes.
+	// the change tokens are indexes into it.
+	changelog []string
+
+	// devicepending is the number of device flow polls answered with authorization_pending.
+	devicepending int
+}
+
+type fakefile struct {
+	ID           string
+	Name         string
+	Parents      []string
+	Properties   map[string]string
+	MimeType     string
+	ModifiedTime string
+	CreatedTime  string
+	Trashed      bool
+	Revisions    []*fakerevision
+}
+
+type fakerevision struct {
+	ID           string
+	Name         string
+	MimeType     string
+	ModifiedTime string
+	KeepForever  bool
+	Content      []byte
+}
+
+// fakesession is a pending resumable upload.
+type fakesession struct {
+	method  string
+	id      string
+	meta    gfileProperties
+	mime    string
+	content []byte
+}
+
+const fakeAccessToken = "fakeaccesstoken"
+
+func newfakedrive() *fakedrive {
+	fd := &fakedrive{
+		files:     map[string]*fakefile{},
+		sessions:  map[string]*fakesession{},
+		requests:  map[string]int{},
+		fail:      map[string]int{},
+		ratelimit: map[string]int{},
+	}
+	fd.srv = httptest.NewServer(http.HandlerFunc(fd.serve))
+	return fd
+}
+
+func (fd *fakedrive) close() { fd.srv.Close() }
+
+func (fd *fakedrive) newid(prefix string) string {
+	fd.nextid++
+	return fmt.Sprintf("%s%04d", prefix, fd.nextid)
+}
+
+var fakeidRE = regexp.MustCompile(`/(file|session)\d+`)
+
+func (fd *fakedrive) serve(w http.ResponseWriter, r *http.Request) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	key := r.Method + " " + fakeidRE.ReplaceAllString(r.URL.Path, "/$1")
+	fd.requests[key]++
+
+	switch r.URL.Path {
+	case "/token":
+		fd.serveToken(w, r)
+		return
+	case "/auth":
+		fd.serveAuth(w, r)
+		return
+	case "/device/code":
+		json.NewEncoder(w).Encode(map[string]any{
+			"device_code":      "fakedevicecode",
+			"user_code":        "FAKE-CODE",
+			"verification_url": "https://www.google.com/device",
+			"expires_in":       60,
+			"interval":         1,
+		})
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/upload/session") && r.Header.Get("Authorization") != "Bearer "+fakeAccessToken {
+		http.Error(w, `{"error":"unauthenticated"}`, http.StatusUnauthorized)
+		return
+	}
+
+	if fd.fail[key] > 0 {
+		fd.fail[key]--
+		http.Error(w, `{"error":"backend error"}`, http.StatusInternalServerError)
+		return
+	}
+	if fd.ratelimit[key] > 0 {
+		fd.ratelimit[key]--
+		http.Error(w, `{"error":{"errors":[{"domain":"usageLimits","reason":"userRateLimitExceeded"}],"code":403}}`, http.StatusForbidden)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/drive/v3/about":
+		fd.serveAbout(w)
+	case r.Method == "GET" && r.URL.Path == "/drive/v3/files":
+		fd.serveList(w, r)
+	case r.Method == "GET" && r.URL.Path == "/drive/v3/changes/startPageToken":
+		json.NewEncoder(w).Encode(map[string]any{"startPageToken": strconv.Itoa(len(fd.changelog))})
+	case r.Method == "GET" && r.URL.Path == "/drive/v3/changes":
+		fd.serveChanges(w, r)
+	case r.Method == "GET" && len(parts) == 4 && parts[2] == "files":
+		f := fd.files[parts[3]]
+		if f == nil || r.URL.Query().Get("alt") != "media" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Write(f.Revisions[len(f.Revisions)-1].Content)
+	case r.Method == "GET" && len(parts) == 5 && parts[2] == "files" && parts[4] == "revisions":
+		fd.serveRevisions(w, r, parts[3])
+	case r.Method == "PATCH" && len(parts) == 6 && parts[2] == "files" && parts[4] == "revisions":
+		fd.serveRevisionUpdate(w, r, parts[3], parts[5])
+	case r.Method == "DELETE" && len(parts) == 6 && parts[2] == "files" && parts[4] == "revisions":
+		fd.serveRevisionDelete(w, parts[3], parts[5])
+	case r.Method == "DELETE" && len(parts) == 4 && parts[2] == "files":
+		if fd.files[parts[3]] == nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		delete(fd.files, parts[3])
+		fd.changelog = append(fd.changelog, parts[3])
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" && len(parts) == 6 && parts[2] == "files" && parts[4] == "revisions":
+		f := fd.files[parts[3]]
+		if f == nil || r.URL.Query().Get("alt") != "media" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		for _, rev := range f.Revisions {
+			if rev.ID == parts[5] {
+				w.Write(rev.Content)
+				return
+			}
+		}
+		http.Error(w, "revision not found", http.StatusNotFound)
+	case (r.Method == "POST" || r.Method == "PATCH") && strings.HasPrefix(r.URL.Path, "/upload/drive/v3/files"):
+		id := ""
+		if len(parts) == 5 {
+			id = parts[4]
+		}
+		switch r.URL.Query().Get("uploadType") {
+		case "multipart":
+			fd.serveMultipart(w, r, id)
+		case "resumable":
+			fd.serveResumableStart(w, r, id)
+		default:
+			http.Error(w, "unsupported upload type", http.StatusBadRequest)
+		}
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/upload/session"):
+		fd.serveResumableUpload(w, r, parts[1])
+	default:
+		http.Error(w, "unimplemented fake endpoint", http.StatusNotImplemented)
+	}
+}
+
+func (fd *fakedrive) serveToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("client_id") != oaClientID {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusBadRequest)
+		return
+	}
+	switch r.PostForm.Get("grant_type") {
+	case "refresh_token":
+		if r.PostForm.Get("refresh_token") == "" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+	case "authorization_code":
+		// the code is derived from the pkce challenge, see serveAuth.
+		challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "fakecode."+base64.RawURLEncoding.EncodeToString(challenge[:]) {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+	case "urn:ietf:params:oauth:grant-type:device_code":
+		if r.PostForm.Get("device_code") != "fakedevicecode" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		if fd.devicepending > 0 {
+			fd.devicepending--
+			http.Error(w, `{"error":"authorization_pending"}`, http.StatusPreconditionRequired)
+			return
+		}
+	default:
+		http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token":  fakeAccessToken,
+		"refresh_token": "fakerefreshtoken",
+		"expires_in":    3599,
+		"token_type":    "Bearer",
+	})
+}
+
+// serveAuth plays the consent page: it redirects back with a code right away.
+func (fd *fakedrive) serveAuth(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != oaClientID || q.Get("code_challenge_method") != "S256" || !strings.HasPrefix(q.Get("redirect_uri"), "http://127.0.0.1:") {
+		http.Error(w, "invalid auth request", http.StatusBadRequest)
+		return
+	}
+	back := url.Values{}
+	back.Set("code", "fakecode."+q.Get("code_challenge"))
+	back.Set("state", q.Get("state"))
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+}
+
+func (fd *fakedrive) serveAbout(w http.ResponseWriter) {
+	var usage int
+	for _, f := range fd.files {
+		for _, rev := range f.Revisions {
+			usage += len(rev.Content)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"storageQuota": map[string]string{
+			"limit":             "16106127360",
+			"usage":             strconv.Itoa(usage),
+			"usageInDrive":      strconv.Itoa(usage),
+			"usageInDriveTrash": "0",
+		},
+	})
+}
+
+var fakequeryRE = regexp.MustCompile(`^'([^']*)' in parents and properties has \{key='([^']*)' and value='([^']*)'\}$`)
+
+func (fd *fakedrive) serveList(w http.ResponseWriter, r *http.Request) {
+	m := fakequeryRE.FindStringSubmatch(r.URL.Query().Get("q"))
+	if m == nil {
+		http.Error(w, "unsupported query", http.StatusBadRequest)
+		return
+	}
+	parent, key, value := m[1], m[2], m[3]
+	ids := []string{}
+	for id, f := range fd.files {
+		if f.Properties[key] == value && len(f.Parents) == 1 && f.Parents[0] == parent {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	pagesize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	if pagesize <= 0 {
+		// gdrive's default page size.
+		pagesize = 100
+	}
+	if fd.pagesize > 0 {
+		pagesize = fd.pagesize
+	}
+	start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	end := min(start+pagesize, len(ids))
+	resp := map[string]any{}
+	files := []map[string]any{}
+	for _, id := range ids[start:end] {
+		files = append(files, fd.files[id].json())
+	}
+	resp["files"] = files
+	if end < len(ids) {
+		resp["nextPageToken"] = strconv.Itoa(end)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (fd *fakedrive) serveChanges(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	if err != nil || start < 0 || start > len(fd.changelog) {
+		http.Error(w, "invalid page token", http.StatusBadRequest)
+		return
+	}
+	pagesize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	if pagesize <= 0 {
+		pagesize = 100
+	}
+	if fd.pagesize > 0 {
+		pagesize = fd.pagesize
+	}
+	end := min(start+pagesize, len(fd.changelog))
+	changes := []map[string]any{}
+	for _, id := range fd.changelog[start:end] {
+		change := map[string]any{"kind": "drive#change", "fileId": id, "removed": fd.files[id] == nil}
+		if f := fd.files[id]; f != nil {
+			js := f.json()
+			js["parents"] = f.Parents
+			change["file"] = js
+		}
+		changes = append(changes, change)
+	}
+	resp := map[string]any{"changes": changes}
+	if end < len(fd.changelog) {
+		resp["nextPageToken"] = strconv.Itoa(end)
+	} else {
+		resp["newStartPageToken"] = strconv.Itoa(end)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakefile) json() map[string]any {
+	head := f.Revisions[len(f.Revisions)-1]
+	return map[string]any{
+		"kind":           "drive#file",
+		"id":             f.ID,
+		"name":           f.Name,
+		"mimeType":       f.MimeType,
+		"size":           strconv.Itoa(len(head.Content)),
+		"modifiedTime":   f.ModifiedTime,
+		"createdTime":    f.CreatedTime,
+		"trashed":        f.Trashed,
+		"properties":     f.Properties,
+		"headRevisionId": head.ID,
+	}
+}
+
+func (fd *fakedrive) serveRevisions(w http.ResponseWriter, r *http.Request, id string) {
+	f := fd.files[id]
+	if f == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	revs := []map[string]any{}
+	for _, rev := range f.Revisions {
+		revs = append(revs, map[string]any{
+			"kind":             "drive#revision",
+			"id":               rev.ID,
+			"mimeType":         rev.MimeType,
+			"modifiedTime":     rev.ModifiedTime,
+			"originalFilename": rev.Name,
+			"keepForever":      rev.KeepForever,
+			"size":             strconv.Itoa(len(rev.Content)),
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]any{"revisions": revs})
+}
+
+func (fd *fakedrive) serveRevisionUpdate(w http.ResponseWriter, r *http.Request, id, revid string) {
+	var update struct{ KeepForever *bool }
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "bad revision update", http.StatusBadRequest)
+		return
+	}
+	f := fd.files[id]
+	if f == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	for _, rev := range f.Revisions {
+		if rev.ID == revid {
+			if update.KeepForever != nil {
+				rev.KeepForever = *update.KeepForever
+			}
+			json.NewEncoder(w).Encode(map[string]any{"kind": "drive#revision", "id": rev.ID, "keepForever": rev.KeepForever})
+			return
+		}
+	}
+	http.Error(w, "revision not found", http.StatusNotFound)
+}
+
+// serveRevisionDelete deletes a revision, gdrive refuses to delete the head revision.
+func (fd *fakedrive) serveRevisionDelete(w http.ResponseWriter, id, revid string) {
+	f := fd.files[id]
+	if f == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	for i, rev := range f.Revisions {
+		if rev.ID != revid {
+			continue
+		}
+		if i == len(f.Revisions)-1 {
+			http.Error(w, "can't delete the head revision", http.StatusBadRequest)
+			return
+		}
+		f.Revisions = append(f.Revisions[:i], f.Revisions[i+1:]...)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, "revision not found", http.StatusNotFound)
+}
+
+// commit creates or updates a file with a new head revision.
+func (fd *fakedrive) commit(method, id string, meta gfileProperties, mimetype string, content []byte) (*fakefile, error) {
+	var f *fakefile
+	if method == "POST" {
+		if id != "" || len(meta.Parents) != 1 {
+			return nil, fmt.Errorf("bad create request")
+		}
+		f = &fakefile{ID: fd.newid("file"), Parents: meta.Parents, Properties: meta.Properties, CreatedTime: time.Now().UTC().Format(tLayout)}
+		fd.files[f.ID] = f
+	} else {
+		if f = fd.files[id]; f == nil {
+			return nil, fmt.Errorf("file %s not found", id)
+		}
+	}
+	if meta.Name != "" {
+		f.Name = meta.Name
+	}
+	if meta.Trashed != nil {
+		f.Trashed = *meta.Trashed
+	}
+	f.MimeType = mimetype
+	f.ModifiedTime = meta.ModifiedTime
+	if f.ModifiedTime == "" {
+		f.ModifiedTime = time.Now().UTC().Format(tLayout)
+	}
+	rev := &fakerevision{ID: fd.newid("rev"), Name: f.Name, MimeType: mimetype, ModifiedTime: f.ModifiedTime, Content: content}
+	f.Revisions = append(f.Revisions, rev)
+	fd.changelog = append(fd.changelog, f.ID)
+	// gdrive only keeps the last 100 revisions unless they are marked to be kept forever.
+	for i := 0; len(f.Revisions) > 100 && i < len(f.Revisions)-1; {
+		if f.Revisions[i].KeepForever {
+			i++
+			continue
+		}
+		f.Revisions = append(f.Revisions[:i], f.Revisions[i+1:]...)
+	}
+	return f, nil
+}
+
+func (fd *fakedrive) serveMultipart(w http.ResponseWriter, r *http.Request, id string) {
+	mediatype, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediatype != "multipart/related" {
+		http.Error(w, "bad content type", http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	metapart, err := mr.NextPart()
+	if err != nil {
+		http.Error(w, "missing metadata part", http.StatusBadRequest)
+		return
+	}
+	var meta gfileProperties
+	if err := json.NewDecoder(metapart).Decode(&meta); err != nil {
+		http.Error(w, "bad metadata", http.StatusBadRequest)
+		return
+	}
+	contentpart, err := mr.NextPart()
+	if err != nil {
+		http.Error(w, "missing content part", http.StatusBadRequest)
+		return
+	}
+	content, err := io.ReadAll(contentpart)
+	if err != nil {
+		http.Error(w, "bad content", http.StatusBadRequest)
+		return
+	}
+	f, err := fd.commit(r.Method, id, meta, contentpart.Header.Get("Content-Type"), content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(f.json())
+}
+
+func (fd *fakedrive) serveResumableStart(w http.ResponseWriter, r *http.Request, id string) {
+	var meta gfileProperties
+	if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+		http.Error(w, "bad metadata", http.StatusBadRequest)
+		return
+	}
+	sid := fd.newid("session")
+	fd.sessions[sid] = &fakesession{method: r.Method, id: id, meta: meta, mime: r.Header.Get("X-Upload-Content-Type")}
+	w.Header().Set("Location", fd.srv.URL+"/upload/"+sid)
+}
+
+func (fd *fakedrive) serveResumableUpload(w http.ResponseWriter, r *http.Request, sid string) {
+	s := fd.sessions[sid]
+	if s == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "bad content", http.StatusBadRequest)
+		return
+	}
+	var start, end int
+	var total string
+	if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes */%s", &total); err == nil && len(content) == 0 {
+		start, end = len(s.content), len(s.content)-1
+	} else if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%s", &start, &end, &total); err != nil {
+		http.Error(w, "bad content range", http.StatusBadRequest)
+		return
+	}
+	if start != len(s.content) || end != start+len(content)-1 {
+		http.Error(w, "mismatching content range", http.StatusBadRequest)
+		return
+	}
+	if fd.partial > 0 && len(content) >= 2 {
+		fd.partial--
+		s.content = append(s.content, content[:len(content)/2]...)
+		http.Error(w, `{"error":"backend error"}`, http.StatusServiceUnavailable)
+		return
+	}
+	s.content = append(s.content, content...)
+	if total == "*" {
+		// gdrive omits the range until it receives something.
+		if len(s.content) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.content)-1))
+		}
+		w.WriteHeader(308)
+		return
+	}
+	if total != strconv.Itoa(len(s.content)) {
+		http.Error(w, "mismatching total size", http.StatusBadRequest)
+		return
+	}
+	delete(fd.sessions, sid)
+	f, err := fd.commit(s.method, s.id, s.meta, s.mime, s.content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// gdrive answers the resumable uploads of the new files with 201.
+	if s.method == "POST" {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(f.json())
+}
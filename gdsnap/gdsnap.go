@@ -5,35 +5,36 @@ import (
 	"bytes"
 	"compress/flate"
 	"context"
-	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
-	"mime/multipart"
-	"net/http"
-	"net/textproto"
-	"net/url"
+	"maps"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
-	"unsafe"
+	"unicode/utf8"
 
-	"golang.org/x/crypto/argon2"
-	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/term"
 )
 
 func usage() {
@@ -50,14 +51,87 @@ you can alter the -dir flag for restore in case you want to restore files somewh
 
 subcommands:
   auth: authorize a gdrive account for gdsnap.
+    it opens the authorization page and captures the result on a local loopback listener,
+    then saves the refresh token for -profile into ~/.cache/gdsnap with 0600 permissions.
+    on a machine without a browser use -headless to authorize via a code entered on another device.
   cat: prints a file from the archive.
+  ctl: send a command to a watch daemon over its -controlsock and wait for it to complete:
+    flush: run a backup cycle now, like a sigint. it fails if some files fail to back up.
+    pause: skip the periodic backup cycles but keep tracking the changes. flush still works.
+    resume: resume the periodic backup cycles.
+    save [path]: back up a file or directory now.
+    reload-config: reread the config files and apply -ignore, -retention, -cycledur and the like.
+      the flags set on the command line keep their values, so do the ones removed from the config.
+      changing -dir, -gdir, -password and the like needs a restart.
+    quit: stop the daemon.
+    e.g. a lock screen hook can run "gdsnap ctl flush" to back up before suspend.
   diff: diff the whole tree or specific files. the diff is between gdrive and the files on disk.
+    use -from and -to to diff two points of the backup's history instead,
+    each is either a time in the -t format or snapshot:[id] (or snapshot:[time]) for the tree of a snapshot.
+    -summary lists only the added, removed and modified paths.
+    the files larger than -sizelimitmb are only compared, not diffed.
+  export: write the whole backup into the given encrypted archive file, - writes to stdout.
+    it has all the revisions with their mimetypes and metadata, the snapshots and the key header,
+    e.g. for an offline cold copy or for moving the backup to another account or backend with import.
+    it's encrypted with the backup's current key so only the backup's password opens it.
+    stop or pause watch for its duration to get a consistent archive.
   help: print help about a subcommand.
+  import: load the given export archive into an empty backup, - reads from stdin.
+    the backup is the one of -backend, -gdir and -profile, e.g. a new gdir on another account.
+    -password and -encryptnames must match the ones of the exported backup.
+    the files and the revisions get new IDs but their history, references and snapshots stay intact.
   list: list gdrive metadata.
+  log: list the revisions of the files chronologically, one line per revision:
+    the time, created/modified/deleted/symlink/dir, the stored size and the path.
+    use -since and -until to limit the time range and -json to print json objects instead.
+    a file's first revision counts as created, so does the first one after a deletion.
+    the time of a revision is its file's modification time, and the time of a deletion is when it was backed up.
+  mount: mount the backup as a read-only fuse filesystem at the given mountpoint, interrupt to unmount.
+    head/ has the latest files, snapshots/[id]/ the tree of each snapshot
+    and by-time/[t]/ the tree at any time in the -t format, e.g. by-time/2024-05-01 or by-time/36h.
+    by-time/ looks empty, its trees appear when accessed.
+    the contents are fetched and decrypted when a file is opened.
+    the size of a file is its stored size until it's read because only the content tells the real size.
+    it needs /dev/fuse and either root or the fusermount tool.
+  prune: delete the revisions and snapshots that the -retention policy doesn't keep. use -dryrun to preview.
   quota: print gdrive quota usage and limit.
-  restore: restores files from the backup (destructive operation!).
+  rekey: re-encrypt the backup under a new password read from stdin.
+  restore: restores files from the backup.
+    it refuses to overwrite the local files whose content is not in any revision of the backup, use -force to overwrite them anyway.
+    a file is replaced only after its content is fully downloaded and decrypted.
+    use -n to only print what it would do and -stagedir to restore into another directory.
   save: snapshot a specific file.
+  snapshots: list the IDs of the whole-tree snapshots recorded by watch.
+  status: print the status of a watch daemon queried from its -statusaddr endpoint, -json prints the raw json.
+  verify: check that the backup decrypts, matches its checksums and matches the files on disk.
+    it reports the corrupt, missing, extra and changed files and fails if there's any so it can run from cron.
+    use -samplepct to only download a random sample of the files.
   watch: watch target directory for changes and back them up.
+    with -statusaddr it serves its json status on /status and prometheus metrics on /metrics:
+    the uploads, the uploaded bytes, the deletions, the failures, the cycle durations, the pending files and the quota.
+
+locking:
+  import, prune, rekey, restore, save and watch lock the backup so that they don't race each other and create duplicate files.
+  on the same host it's a lock file under ~/.cache/gdsnapstate per -profile and -gdir.
+  across hosts it's a lease in the backup that the holder renews every few minutes.
+  a conflicting operation fails with the host, the pid and the subcommand of the holder.
+  the lease of a crashed holder expires after 10 minutes, on the holder's host it's taken over right away.
+  the dryrun of prune and restore and the read-only subcommands don't lock.
+
+backup sets:
+  watch -sets=work,personal backs up several directories in one process, each into its own backup.
+  each set is a profile of the config files with its own dir, gdir and optionally ignore, password, retention,
+  encryptnames and backend; the sets don't inherit these from the flags, only from the * lines.
+  the sets share the refreshtoken, the access token, -jobs, -statusaddr and -controlsock.
+  ctl save routes the path to the set containing it, the other ctl commands apply to all sets.
+  the dirs of the sets must not overlap. example:
+    * sets "work,personal"
+    work dir "/home/myuser/work"
+    work gdir "5678"
+    work ignore "**/build/**"
+    personal dir "/home/myuser/personal"
+    personal gdir "1234"
+    personal password "secret"
 
 config files:
   gdsnap reads in ~/.gdsnap, ~/.config/gdsnap and finally ~/.cache/gdsnap config files.
@@ -74,14 +148,62 @@ config files:
   the refreshtoken is sensitive piece of data, you might want to put that into the separate .cache/gdsnap file.
 
 globs:
-  the globs can contain "*" or "**", other wildcards like "?" are not supported.
-  "**" matches / (the directory separator) too.
+  "*" matches anything except / (the directory separator), "**" matches / too.
+  "?" matches a single character except /, "[abc]" and "[a-z]" one from a set, "[!abc]" or "[^abc]" one not in it.
+  "\" escapes the next character.
   e.g. ".cache/**", say, for the -ignore means to ignore all files under the .cache directory.
-  cat/diff/list/restore accept globs as arguments.
+  cat/diff/list/log/restore accept globs as arguments.
+  an argument starting with ! excludes the files it matches, the last matching argument decides.
+  e.g. "gdsnap cat '**' '!**.log'" prints everything except the logs.
   globs starting with / are absolute globs and the root is relative to -dir.
   the current relative path from dir is prepended for relative globs.
   e.g. .gitignore will be translated to $(dir)/path/to/currentwd/.gitignore.
-  thanks to this cat/diff/list/restore are easy to use with files in the current directory.
+  thanks to this cat/diff/list/log/restore are easy to use with files in the current directory.
+
+ignoring:
+  save and watch skip the paths matching the -ignore globs and the rules of the .gdsnapignore files.
+  a .gdsnapignore file can be in any directory and its rules apply under that directory.
+  the syntax is the same as of .gitignore:
+  one glob per line, the empty lines and the lines starting with # are skipped,
+  ! negates a rule, a trailing / matches only directories,
+  a rule containing a / (other than the trailing one) is anchored to the file's directory,
+  the others match the basename at any depth,
+  and "**/" at the start or "/**/" in the middle match zero or more directories.
+  the last matching rule decides and the rules of the deeper files take precedence.
+  a path in an ignored directory is ignored even if a negated rule matches it.
+  the ignored directories are not walked nor watched.
+  an already backed up file is deleted from the backup when it becomes ignored and it changes or at the next initial scan.
+
+backends:
+  -backend=drive (the default) stores the backup in the gdrive directory whose ID is -gdir.
+  -backend=local stores the backup in a plain local directory at path -gdir, e.g. on a mounted NAS.
+  the local backend keeps each profile in a separate subdirectory and needs no auth.
+  it keeps all revisions of the files, not just the last 100.
+  for the drive backend gdsnap caches the listing of the backup in ~/.cache/gdsnapstate
+  and fetches only the changes since the last listing from gdrive's change feed.
+  use -rebuildcache to list the whole backup again if the cache seems out of sync.
+
+watchers:
+  -watcher=inotify (the default) adds an inotify watch to each directory under -dir.
+  if it runs out of watches (see the fs.inotify.max_user_watches sysctl) it falls back to the scan watcher.
+  -watcher=fanotify marks the whole filesystem of -dir with a single fanotify mark so it needs no per-directory watches.
+  it needs root (CAP_SYS_ADMIN) and linux 5.9+, it falls back to the inotify watcher otherwise.
+  -watcher=scan walks -dir every -scandur and compares the modification times and sizes to the previous walk.
+  it needs no kernel resources but it notices the changes only with a delay.
+
+retention:
+  gdrive keeps only the last 100 revisions of each file
+  so a frequently edited file loses its history quickly while a rarely edited one keeps years of it.
+  -retention sets a policy that gdsnap enforces itself instead.
+  it's a comma separated list of age:interval entries with increasing ages.
+  among the revisions younger than age the latest one is kept from each interval, "all" keeps all of them.
+  the revisions older than the last age are deleted, use "forever" as the last age to avoid that.
+  the ages and the intervals are durations like 12h, the d (day), w (week) and y (365 days) units work too.
+  e.g. "1d:all,7d:1h,1y:1d" keeps everything for a day, hourly revisions for a week and daily ones for a year.
+  the time of a revision is its file's modification time, the snapshots are pruned by their IDs.
+  the head revisions and the revisions referenced by a gdsnap/ref or a kept snapshot are never deleted.
+  watch marks the kept revisions to be kept forever after each save so that gdrive doesn't prune them,
+  and it runs prune once a day. note that gdrive allows at most 200 kept revisions per file.
 
 signals:
   during the watch command sigint (ctrl+c) triggers an early backup cycle.
@@ -91,6 +213,12 @@ signals:
 implementation details:
   all the files are backed up to gdrive.
   the contents are encrypted but the filenames are not to keep the system easy to debug.
+  use -encryptnames to encrypt the filenames and the mimetypes too.
+  in that mode the gdrive name is the encrypted relpath padded to 32 bytes
+  followed by an hmac of the sha256sum rather than the sha256sum itself,
+  the mimetype is gdsnap/enc followed by the encrypted mimetype,
+  and the symlink targets are encrypted too.
+  the setting must not change for an existing backup, start a new -gdir in order to toggle it.
   gdrive tracks the last 100 revisions of each file so those can restored too.
   use the -t flag to specify a revision other than the head revision.
   some file metadata is stored in the mimetype of the revision:
@@ -98,9 +226,50 @@ implementation details:
       if this is the head version, the file is also moved to the trash
       which is then deleted after 30 days.
     - gdsnap/symlink: the file is a symlink and the contents is the target file.
-      the contents of this is not encrypted.
+      the contents of this is not encrypted unless -encryptnames is set or it has the -m flag.
     - gdsnap/data???: ordinary file. ??? is an octal number of the permissions
       that restore will use when restoring a file.
+    - gdsnap/stream???: ordinary file larger than -sizelimitmb.
+      it's compressed and encrypted in 1 MiB chunks so that it's uploaded and restored with bounded memory.
+      ??? is the same as for gdsnap/data???.
+    - gdsnap/ref???: ordinary file whose content is already backed up in another revision.
+      the contents is the "fileID/revisionID" of that revision, it's not encrypted.
+      "/stream" is appended if that revision is a gdsnap/stream one
+      and "/meta" if that revision has the -m flag.
+      ??? is the same as for gdsnap/data???.
+    - gdsnap/dir???: an empty directory, the non-empty ones are recreated by their files.
+      ??? is the same as for gdsnap/data???.
+  the rest of the metadata is in a record in front of the contents, the mimetypes of such revisions end with -m.
+  the record is a json object of the mtime in nanoseconds, the owner's user and group names and IDs and the xattrs,
+  prefixed with its length as an uvarint.
+  it's compressed and encrypted along with the contents.
+  a gdsnap/ref revision has its own record in the second line of its contents, it's encrypted on its own.
+  restore applies the record: the owner only if it runs as root, the mtime in full precision.
+  the older revisions without the -m flag have no record, restore sets only their permissions.
+  note that the metadata only changes (e.g. touch, chown or setfattr) are not backed up until the next content change.
+  the mimetypes with an encrypted part end with -k[id], the ID of the key that encrypted them.
+  the key header is the gdsnap.meta.keys file in -gdir (meta.keys in the profile's directory for the local backend).
+  it holds the random keys that encrypt the contents,
+  wrapped by a key derived from -password and a random per-profile salt with argon2.
+  the first modifying subcommand (e.g. save or watch) creates it while holding the lock,
+  the other subcommands fail on a backup without a key header.
+  rekey adds a new key, rewraps all keys under the new password and re-encrypts the head revisions with the new key.
+  the old revisions stay readable because the old keys remain in the header.
+  backups started before the key header existed keep their legacy key too,
+  it's derived from the password and a fixed salt and it has no -k suffix.
+  watch records a snapshot of the whole tree after each backup cycle that changed something.
+  a snapshot is the list of the files that existed at that time along with their revision IDs.
+  it's stored encrypted as the gdsnap.meta.snapshot.[id] file where the ID is the time of the snapshot.
+  the revisions it lists are marked to be kept forever so that gdrive's automatic pruning doesn't delete them.
+  use -snapshot with cat/diff/list/restore to operate on exactly that tree,
+  including the files that have been deleted since.
+  note that -t picks the latest revision of each file independently and doesn't know which files existed at that time.
+  gdsnap deduplicates the contents by their sha256sum which is part of the gdrive filename.
+  so moves, copies and reverts to an earlier content are saved as references rather than full uploads.
+  the referenced revisions are marked to be kept forever.
+  a deleted file is kept out of the trash while any revision of another file references its content.
+  save and watch back up up to -jobs files concurrently.
+  when gdrive rate limits the requests, gdsnap backs off exponentially and retries them.
 
 cleanup:
   if you want to purge your data from gdrive
@@ -112,28 +281,73 @@ global flags:`)
 }
 
 var (
+	backendFlag      *string
 	cycledurFlag     *time.Duration
 	dirFlag          *string
+	dryrunFlag       *bool
+	encryptnamesFlag *bool
+	forceFlag        *bool
+	fromFlag         *string
 	gdirFlag         *string
+	headlessFlag     *bool
 	ignoreFlag       *string
+	jobsFlag         *int
+	jsonFlag         *bool
 	sizelimitmbFlag  *int
 	passwordFlag     *string
 	profileFlag      *string
+	rebuildcacheFlag *bool
 	refreshtokenFlag *string
+	retentionFlag    *string
+	samplepctFlag    *int
+	scandurFlag      *time.Duration
+	sinceFlag        *string
+	snapshotFlag     *string
+	controlsockFlag  *string
+	setsFlag         *string
+	stagedirFlag     *string
+	statusaddrFlag   *string
+	summaryFlag      *bool
 	tFlag            *string
+	toFlag           *string
+	untilFlag        *string
 	warncmdFlag      *string
+	watcherFlag      *string
 )
 
 func initflags() {
+	backendFlag = flag.String("backend", "drive", "the storage to back up into: drive or local. for local the -gdir is the path of the backup directory, e.g. a mounted NAS.")
+	controlsockFlag = flag.String("controlsock", "", "make watch accept commands on this unix socket and the ctl subcommand send them. see the ctl subcommand.")
 	cycledurFlag = flag.Duration("cycledur", 20*time.Minute, "the time to wait between backup cycles. relevant only for the watch subcommand.")
 	dirFlag = flag.String("dir", os.Getenv("PWD"), "the root directory under which to operate recursively.")
-	gdirFlag = flag.String("gdir", "", "the gdrive directory under which to to save the files.")
-	ignoreFlag = flag.String("ignore", "", "comma separated list of globs that save/watch ignores to upload.")
-	sizelimitmbFlag = flag.Int("sizelimitmb", 20, "size limit of the maximum file in megabytes. make sure to pick a limit that comfortably fits into memory.")
+	dryrunFlag = flag.Bool("dryrun", false, "make prune and restore only print what they would do.")
+	flag.BoolVar(dryrunFlag, "n", false, "shorthand for -dryrun.")
+	encryptnamesFlag = flag.Bool("encryptnames", false, "encrypt the filenames and the mimetypes in the backup too. can't be toggled for an existing backup.")
+	forceFlag = flag.Bool("force", false, "make restore overwrite the local files even if their content is not backed up.")
+	fromFlag = flag.String("from", "", "make diff compare this point in time rather than the -t one: a time in the -t format or snapshot:[id] for a snapshot's tree. see -to.")
+	gdirFlag = flag.String("gdir", "", "the gdrive directory under which to to save the files. for the local backend this is an absolute path.")
+	headlessFlag = flag.Bool("headless", false, "make auth use the device flow: enter a code on another device instead of a redirect to a local listener.")
+	ignoreFlag = flag.String("ignore", "", "comma separated list of globs that save/watch ignores to upload. see the ignoring section of the help for the .gdsnapignore files.")
+	jobsFlag = flag.Int("jobs", 4, "the number of files save/watch backs up concurrently.")
+	jsonFlag = flag.Bool("json", false, "make log print one json object per revision and line, and status print the raw json status.")
+	stagedirFlag = flag.String("stagedir", "", "make restore write the files into this directory instead of -dir, e.g. to inspect them before moving them into place.")
+	statusaddrFlag = flag.String("statusaddr", "", "make watch serve its json status on /status and prometheus metrics on /metrics at this tcp address, or at this unix socket if it's an absolute path. the status subcommand queries it.")
+	summaryFlag = flag.Bool("summary", false, "make diff only list the added, removed and modified paths.")
+	sizelimitmbFlag = flag.Int("sizelimitmb", 20, "files larger than this many megabytes are streamed in chunks rather than read into memory at once. make sure to pick a limit that comfortably fits into memory.")
 	passwordFlag = flag.String("password", "", "the password to encrypt the files with. if empty, the files are encrypted with an empty password.")
 	profileFlag = flag.String("profile", hostname(), "flag defaults selector for the gdsnap config files.")
+	rebuildcacheFlag = flag.Bool("rebuildcache", false, "ignore the local state cache and list all files of the backup to rebuild it.")
 	refreshtokenFlag = flag.String("refreshtoken", "", "the oauth2 refresh token needed for accessing gdrive. generate one with the auth subcommand.")
+	retentionFlag = flag.String("retention", "", "the retention policy of the revisions and snapshots, see the retention section of the help. prune and watch enforce it if set.")
+	samplepctFlag = flag.Int("samplepct", 100, "the percentage of the files whose content verify downloads and checks, picked randomly.")
+	scandurFlag = flag.Duration("scandur", 10*time.Minute, "the time between the walks of -dir with -watcher=scan.")
+	setsFlag = flag.String("sets", "", "comma separated list of profiles that watch backs up in one process. see the backup sets section of the help.")
+	sinceFlag = flag.String("since", "", "make log list only the revisions from this time on, in the -t format. default is the oldest revision.")
+	snapshotFlag = flag.String("snapshot", "", "the snapshot for cat/diff/list/restore to operate on. either a snapshot ID or a time in the -t format to pick the latest snapshot before it. default is the latest files.")
 	tFlag = flag.String("t", "", "time offset for cat/diff/restore operations. either a duration from now or an absolute utc time value. default is the head revision for each file.")
+	toFlag = flag.String("to", "", "make diff compare -from to this point in time rather than to the files on disk. same format as -from.")
+	untilFlag = flag.String("until", "", "make log list only the revisions up to this time, in the -t format. default is now.")
+	watcherFlag = flag.String("watcher", "inotify", "how watch notices the changes: inotify, fanotify or scan. see the watchers section of the help.")
 	warncmdFlag = flag.String("warncmd", "", "run command on warning-level events. the command should notify you about the event. static flags can be specified, separate them with space.")
 }
 
@@ -149,211 +363,325 @@ type fileinfo struct {
 	Trashed      bool
 	MimeType     string
 	ModifiedTime string
+
+	// HeadRevisionID is the ID of the latest revision.
+	HeadRevisionID string
+}
+
+// contentref identifies a data or stream revision.
+// its string form is the first line of the content of the gdsnap/ref revisions.
+type contentref struct {
+	fileID, revID string
+	stream        bool
+
+	// meta is whether the revision has a metadata record, see hasmeta.
+	meta bool
+}
+
+func (r contentref) String() string {
+	s := r.fileID + "/" + r.revID
+	if r.stream {
+		s += "/stream"
+	}
+	if r.meta {
+		s += "/meta"
+	}
+	return s
+}
+
+// parsecontentref parses the string form of a contentref.
+func parsecontentref(s string) (contentref, bool) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return contentref{}, false
+	}
+	r := contentref{fileID: parts[0], revID: parts[1]}
+	parts = parts[2:]
+	if len(parts) > 0 && parts[0] == "stream" {
+		r.stream, parts = true, parts[1:]
+	}
+	if len(parts) > 0 && parts[0] == "meta" {
+		r.meta, parts = true, parts[1:]
+	}
+	return r, len(parts) == 0
+}
+
+// contentmime returns the mimetype of the content a reference with the given mimetype resolves to.
+func (r contentref) contentmime(refmime string) string {
+	kind := "gdsnap/data"
+	if r.stream {
+		kind = "gdsnap/stream"
+	}
+	refmime, _ = mimekey(refmime)
+	refmime, _ = mimemeta(refmime)
+	mime := kind + strings.TrimPrefix(refmime, "gdsnap/ref")
+	if r.meta {
+		mime += "-m"
+	}
+	return mime
+}
+
+// hascontent reports whether the revision with the given mimetype holds a file's content.
+// the second result is whether it's a gdsnap/stream one.
+func hascontent(mime string) (ok, stream bool) {
+	if strings.HasPrefix(mime, "gdsnap/stream") {
+		return true, true
+	}
+	return strings.HasPrefix(mime, "gdsnap/data"), false
+}
+
+// encrypted reports whether the revisions with the given mimetype have encrypted content.
+// the mimetype must be without the key suffix.
+// the gdsnap/ref revisions have only their metadata record encrypted.
+func encrypted(mime string, encryptnames bool) bool {
+	mime, meta := mimemeta(mime)
+	ok, _ := hascontent(mime)
+	return ok || meta || mime == "gdsnap/symlink" && encryptnames
 }
 
 type gdsnap struct {
-	accesstoken string
-	tokenbirth  time.Time
-	files       map[string]fileinfo
-	ignore      []string
-	aead        cipher.AEAD
+	// set is the backed up directory and its backup, see backupset.
+	set     *backupset
+	backend backend
+
+	// tok is the access token of the drive backend, the sets of a watch share it.
+	tok *accesstoken
+
+	// mu guards files, content and refs because savepath runs concurrently, see saveall.
+	mu sync.Mutex
+
+	// inflight has the relpaths and the contentsums being saved, see lock.
+	inflight map[string]chan struct{}
+
+	// slots bounds the number of files being saved concurrently to -jobs.
+	slots chan struct{}
+
+	files  map[string]fileinfo
+	ignore *ignorer
+	keys   *keyring
+
+	// keysmu serializes the loading of the keys in needkeys because mount fetches concurrently.
+	keysmu sync.Mutex
+
+	// sumkey is the hmac key of the checksums in the names in the -encryptnames mode.
+	sumkey []byte
+
+	// content indexes the data revisions by the sha256sum of their plaintext.
+	// savepath uses it to save the already backed up content as a reference.
+	content map[string]contentref
+
+	// refs caches the targets of the gdsnap/ref revisions keyed by their own contentref.
+	refs map[contentref]contentref
+
+	// reftargets has the IDs of the files that a gdsnap/ref revision anywhere in the history points at.
+	// referenced scans the history into it once, reftargetsmu serializes that scan.
+	reftargets        map[string]bool
+	reftargetsscanned bool
+	reftargetsmu      sync.Mutex
+
+	// retries tracks the paths that failed to back up in watch, keyed by the abspath.
+	retries map[string]*retrystate
+
+	// snapshot is the tree of the last snapshot recorded by watch.
+	snapshot map[string]fileinfo
+
+	// retention is the parsed -retention policy.
+	retention []retentiontier
+
+	// opts are the flags that reload-config can change in a running watch.
+	opts options
+
+	// cache is the state cache, see cachedlist.
+	cache *statecache
+
+	// stats are served on -statusaddr by watch, the sets of a watch share it.
+	stats *stats
+
+	// pending is this set's share of stats.pending, see setpending.
+	pending int
 }
 
+// options are -cycledur and -sizelimitmb, the watch loop reads them from here rather than from the flags.
+type options struct {
+	cycledur    time.Duration
+	sizelimitmb int
+}
+
+const tLayout = "2006-01-02T15:04:05.000Z"
+
 func hostname() string {
 	h, err := os.Hostname()
 	if err != nil {
-		log.Fatalf("couldn't look up hostname: %v", err)
+		log.Printf("couldn't look up hostname, using the default profile: %v", err)
+		return "default"
 	}
 	return h
 }
 
-// matchglob matches simple globs.
-// only supports * and **.
+// matchglob matches globs.
 // * matches everything except /, ** matches / too.
+// ? matches a single character except /, [abc], [a-z] and the negated [!abc] or [^abc] match one of a set.
+// \ escapes the next character.
 func matchglob(pattern, name string) bool {
-	laststar, lastdstar := -1, -1
-	p, n := 0, 0
-	for n < len(name) {
-		if p == len(pattern) {
-			if name[n] == '/' {
-				if lastdstar != -1 {
-					laststar = lastdstar
-					p = lastdstar
-					n++
-					continue
+	m := globmatcher{pattern: pattern, name: name}
+	return m.match(0, 0)
+}
+
+// globmatcher matches a glob against a name from the given offsets.
+type globmatcher struct {
+	pattern, name string
+
+	// failed has the pattern and name offsets that are known not to match.
+	// it keeps the backtracking of the stars polynomial.
+	failed map[[2]int]bool
+}
+
+func (m *globmatcher) match(pi, ni int) bool {
+	pattern, name := m.pattern, m.name
+	for pi < len(pattern) {
+		switch pattern[pi] {
+		case '*':
+			dstar := strings.HasPrefix(pattern[pi:], "**")
+			for pi < len(pattern) && pattern[pi] == '*' {
+				pi++
+			}
+			if m.failed == nil {
+				m.failed = map[[2]int]bool{}
+			}
+			for i := ni; i <= len(name); i++ {
+				if key := [2]int{pi, i}; !m.failed[key] {
+					if m.match(pi, i) {
+						return true
+					}
+					m.failed[key] = true
+				}
+				if i < len(name) && name[i] == '/' && !dstar {
+					return false
 				}
+			}
+			return false
+		case '?':
+			r, size := utf8.DecodeRuneInString(name[ni:])
+			if size == 0 || r == '/' {
 				return false
 			}
-			if laststar != -1 {
-				p = laststar
-				n++
+			pi, ni = pi+1, ni+size
+		case '[':
+			r, size := utf8.DecodeRuneInString(name[ni:])
+			match, rest, ok := matchclass(pattern[pi:], r)
+			if !ok {
+				// an unterminated [ is literal.
+				if !strings.HasPrefix(name[ni:], "[") {
+					return false
+				}
+				pi, ni = pi+1, ni+1
 				continue
 			}
-			return false
-		}
-		if pattern[p] == '*' {
-			stars := 0
-			for p < len(pattern) && pattern[p] == '*' {
-				p++
-				stars++
+			if size == 0 || r == '/' || !match {
+				return false
 			}
-			laststar = p
-			if stars >= 2 {
-				lastdstar = p
+			pi, ni = len(pattern)-len(rest), ni+size
+		default:
+			c := pattern[pi]
+			if c == '\\' && pi+1 < len(pattern) {
+				pi++
+				c = pattern[pi]
 			}
-			continue
-		}
-		if name[n] == '/' {
-			laststar = -1
-		}
-		if name[n] == pattern[p] {
-			n++
-			p++
-		} else {
-			if laststar != -1 {
-				p = laststar
-			} else if lastdstar != -1 {
-				laststar = lastdstar
-				p = lastdstar
-			} else {
+			if ni == len(name) || name[ni] != c {
 				return false
 			}
-			n++
+			pi, ni = pi+1, ni+1
 		}
 	}
-	for p < len(pattern) && pattern[p] == '*' {
-		p++
+	return ni == len(name)
+}
+
+// matchclass matches r against the character class at the start of pattern.
+// it returns the rest of the pattern after the class, ok is false if the class is unterminated.
+func matchclass(pattern string, r rune) (match bool, rest string, ok bool) {
+	p := pattern[1:]
+	negate := strings.HasPrefix(p, "!") || strings.HasPrefix(p, "^")
+	if negate {
+		p = p[1:]
+	}
+	for first := true; ; first = false {
+		if len(p) == 0 {
+			return false, "", false
+		}
+		if p[0] == ']' && !first {
+			return match != negate, p[1:], true
+		}
+		if p[0] == '\\' && len(p) > 1 {
+			p = p[1:]
+		}
+		lo, size := utf8.DecodeRuneInString(p)
+		p = p[size:]
+		hi := lo
+		if len(p) > 1 && p[0] == '-' && p[1] != ']' {
+			p = p[1:]
+			if p[0] == '\\' && len(p) > 1 {
+				p = p[1:]
+			}
+			hi, size = utf8.DecodeRuneInString(p)
+			p = p[size:]
+		}
+		if lo <= r && r <= hi {
+			match = true
+		}
 	}
-	return p == len(pattern)
 }
 
 // fullglobs prepends the local directory to the relative globs from the args.
+// the ! prefix of the negated globs is kept.
 func fullglobs(args []string) []string {
-	cwd, err := os.Getwd()
-	if err != nil {
-		log.Fatalf("couldn't determine current working dir: %v", err)
-	}
+	// if the current working dir is unknown then treat it as if it was outside of dir.
+	cwd, cwdErr := os.Getwd()
 	pathprefix, err := filepath.Rel(*dirFlag, cwd)
-	if err != nil || strings.HasPrefix(pathprefix, "..") {
+	if cwdErr != nil || err != nil || strings.HasPrefix(pathprefix, "..") {
 		pathprefix = ""
 	}
 	globs := make([]string, len(args))
 	for i, a := range args {
+		a, negate := strings.CutPrefix(a, "!")
 		if !strings.HasPrefix(a, "/") {
 			a = path.Join(pathprefix, a)
 		}
 		globs[i] = strings.TrimLeft(a, "/")
+		if negate {
+			globs[i] = "!" + globs[i]
+		}
 	}
 	return globs
 }
 
-// filterfiles returns the list of filenames that match at least one of the globs.
+// filterfiles returns the list of filenames that match the globs.
+// like in the ignore files the last matching glob decides, a glob starting with ! excludes the files it matches.
+// all files match if there are no globs or all of them are negated.
 // the current directory will be added to the relative entries in globs.
-func filterfiles(files map[string]fileinfo, globs []string) []string {
+func filterfiles[T any](files map[string]T, globs []string) []string {
 	globs = fullglobs(globs)
+	matchall := true
+	for _, glob := range globs {
+		if !strings.HasPrefix(glob, "!") {
+			matchall = false
+		}
+	}
 	filelist := []string{}
 	for f := range files {
-		if len(globs) > 0 {
-			match := false
-			for _, glob := range globs {
-				if matchglob(glob, f) {
-					match = true
-					break
-				}
-			}
-			if !match {
-				continue
+		match := matchall
+		for _, glob := range globs {
+			if negglob, negate := strings.CutPrefix(glob, "!"); matchglob(negglob, f) {
+				match = !negate
 			}
 		}
-		filelist = append(filelist, f)
+		if match {
+			filelist = append(filelist, f)
+		}
 	}
 	sort.Strings(filelist)
 	return filelist
 }
 
-// watchdir streams the changed filenames on filech.
-func watchdir(filech chan<- string) {
-	log.Printf("initializing inotify rooted at %q.", *dirFlag)
-	watches := map[int]string{}
-	ifd, err := syscall.InotifyInit()
-	if err != nil {
-		log.Fatal(err)
-	}
-	var watchpath func(string)
-	watchpath = func(dirpath string) {
-		var mask uint32
-		mask |= syscall.IN_CLOSE_WRITE
-		mask |= syscall.IN_CREATE
-		mask |= syscall.IN_DELETE
-		mask |= syscall.IN_MOVED_FROM
-		mask |= syscall.IN_MOVED_TO
-		mask |= syscall.IN_DONT_FOLLOW
-		mask |= syscall.IN_EXCL_UNLINK
-		mask |= syscall.IN_ONLYDIR
-		var wd int
-		if wd, err = syscall.InotifyAddWatch(ifd, dirpath, mask); err != nil {
-			log.Fatal(err)
-		}
-		watches[wd] = dirpath
-
-		walkfunc := func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				log.Printf("[warning] can't walk %s: %v", path, err)
-				warn()
-				return nil
-			}
-			if !d.IsDir() {
-				filech <- path
-				return nil
-			}
-			if path == dirpath {
-				return nil
-			}
-			watchpath(path)
-			return fs.SkipDir
-		}
-		filepath.WalkDir(dirpath, walkfunc)
-	}
-	watchpath(*dirFlag)
-
-	log.Print("watching inotify events.")
-	for {
-		const bufsize = 16384
-		eventbuf := [bufsize]byte{}
-		n, err := syscall.Read(ifd, eventbuf[:])
-		if n <= 0 || err != nil {
-			log.Fatal(err)
-		}
-		for offset := 0; offset < n; {
-			if n-offset < syscall.SizeofInotifyEvent {
-				log.Fatalf("invalid inotify read: n:%d offset:%d.", n, offset)
-			}
-			event := (*syscall.InotifyEvent)(unsafe.Pointer(&eventbuf[offset]))
-			wd := int(event.Wd)
-			mask := int(event.Mask)
-			namelen := int(event.Len)
-			namebytes := (*[syscall.PathMax]byte)(unsafe.Pointer(&eventbuf[offset+syscall.SizeofInotifyEvent]))
-			name := string(bytes.TrimRight(namebytes[0:namelen], "\000"))
-			dir, ok := watches[wd]
-			if !ok {
-				log.Fatalf("unknown watch descriptor %d.", wd)
-			}
-			name = path.Join(dir, name)
-			if mask&syscall.IN_IGNORED != 0 {
-				delete(watches, wd)
-			}
-			if mask&syscall.IN_CREATE != 0 || mask&syscall.IN_MOVED_TO != 0 {
-				fi, err := os.Stat(name)
-				if err == nil && fi.IsDir() {
-					watchpath(name)
-				}
-			}
-			filech <- name
-			offset += syscall.SizeofInotifyEvent + namelen
-		}
-	}
-}
-
 func warn() {
 	os.Stdout.WriteString("\a")
 	if len(*warncmdFlag) == 0 {
@@ -374,93 +702,331 @@ func shasumPart(s string) string {
 	return path.Base(s)
 }
 
-func (gs *gdsnap) listfiles() {
-	if len(gs.accesstoken) == 0 {
-		gs.gettoken()
+func (gs *gdsnap) listfiles() error {
+	files, err := gs.cachedlist()
+	if err != nil {
+		return err
 	}
-
-	files := map[string]fileinfo{}
-	type listResponseType struct {
-		IncompleteSearch bool
-		NextPageToken    string
-		Files            []fileinfo
+	live := map[string]bool{}
+	for relpath, fi := range files {
+		if !fi.Trashed {
+			live[fi.ID] = true
+		}
+		if fi.MimeType == "gdsnap/deleted" {
+			// savepath keeps a deleted file out of the trash when its content is referenced.
+			fi.Trashed = true
+			files[relpath] = fi
+		}
 	}
-
-	// list existing files.
-	q := url.Values{}
-	q.Set("fields", "files(name,id,size,mimeType,modifiedTime,trashed,properties),nextPageToken,incompleteSearch")
-	q.Set("pageSize", "1000")
-	q.Set("q", fmt.Sprintf("'%s' in parents and properties has {key='gdsnap.profile' and value='%s'}", *gdirFlag, *profileFlag))
-	for {
-		listreq, err := http.NewRequest("GET", "https://www.googleapis.com/drive/v3/files?"+q.Encode(), nil)
-		if err != nil {
-			log.Fatal(err)
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	for _, fi := range files {
+		if ok, stream := hascontent(fi.MimeType); ok && !fi.Trashed && fi.HeadRevisionID != "" {
+			gs.content[shasumPart(fi.Name)] = contentref{fi.ID, fi.HeadRevisionID, stream, hasmeta(fi.MimeType)}
 		}
-		listreq.Header.Set("Accept", "application/json")
-		listreq.Header.Set("Authorization", "Bearer "+gs.accesstoken)
-		listresp, err := http.DefaultClient.Do(listreq)
-		if err != nil {
-			log.Fatalf("error listing files: %v", err)
+	}
+	// the trash is purged after a while so the content of the trashed files is not safe to reference.
+	for shasum, r := range gs.content {
+		if !live[r.fileID] {
+			delete(gs.content, shasum)
 		}
-		listbody, err := io.ReadAll(listresp.Body)
-		if err != nil {
-			log.Fatalf("couldn't list everything: %v", err)
+	}
+	gs.files = files
+	return nil
+}
+
+// findcontent looks up an already backed up revision of the content with the given sha256sum.
+// for an existing file its older revisions are searched too so that reverts are deduplicated even after a restart.
+// the file's own head is never returned.
+func (gs *gdsnap) findcontent(fi *fileinfo, shasum string) (contentref, bool, error) {
+	gs.mu.Lock()
+	r, ok := gs.content[shasum]
+	gs.mu.Unlock()
+	if ok && (r.fileID != fi.ID || r.revID != fi.HeadRevisionID) {
+		return r, true, nil
+	}
+	if fi.ID == "" {
+		return contentref{}, false, nil
+	}
+	revs, err := gs.backend.revisions(fi)
+	if err != nil {
+		return contentref{}, false, err
+	}
+	// the last revision is the head.
+	for i := len(revs) - 2; i >= 0; i-- {
+		rev := revs[i]
+		if rev.OriginalFilename == "" || shasumPart(rev.OriginalFilename) != shasum {
+			continue
 		}
-		var r listResponseType
-		if err = json.Unmarshal(listbody, &r); err != nil {
-			log.Fatalf("couldn't parse list response: %v\nbody:\n%s", err, listbody)
+		var r contentref
+		if ok, stream := hascontent(rev.MimeType); ok {
+			r = contentref{fi.ID, rev.ID, stream, hasmeta(rev.MimeType)}
+		} else if !strings.HasPrefix(rev.MimeType, "gdsnap/ref") {
+			continue
+		} else if r, err = gs.resolveref(fi, rev.ID); err != nil {
+			return contentref{}, false, err
 		}
-		if r.IncompleteSearch {
-			log.Fatal("response was incomplete.")
+		if !fi.Trashed {
+			gs.mu.Lock()
+			gs.content[shasum] = r
+			gs.mu.Unlock()
 		}
-		for _, f := range r.Files {
-			files[namePart(f.Name)] = f
+		return r, true, nil
+	}
+	return contentref{}, false, nil
+}
+
+// resolveref returns the target of a gdsnap/ref revision.
+// an empty revid means the head revision.
+func (gs *gdsnap) resolveref(fi *fileinfo, revid string) (contentref, error) {
+	if revid == "" {
+		revid = fi.HeadRevisionID
+	}
+	self := contentref{fileID: fi.ID, revID: revid}
+	gs.mu.Lock()
+	target, ok := gs.refs[self]
+	gs.mu.Unlock()
+	if ok && revid != "" {
+		return target, nil
+	}
+	target, _, err := gs.readref(fi, revid)
+	if err != nil {
+		return contentref{}, err
+	}
+	if revid != "" {
+		gs.mu.Lock()
+		gs.refs[self] = target
+		gs.mu.Unlock()
+	}
+	return target, nil
+}
+
+// readref fetches a gdsnap/ref revision and returns its target and its encrypted metadata record.
+// the record is empty for the references without the "-m" mimetype flag.
+func (gs *gdsnap) readref(fi *fileinfo, revid string) (contentref, []byte, error) {
+	rc, err := gs.backend.fetch(fi, revid)
+	if err != nil {
+		return contentref{}, nil, err
+	}
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	if err != nil {
+		return contentref{}, nil, fmt.Errorf("gdsnap.ReadReference name=%s: %v", namePart(fi.Name), err)
+	}
+	line, record, _ := bytes.Cut(content, []byte("\n"))
+	target, ok := parsecontentref(string(line))
+	if !ok {
+		return contentref{}, nil, fmt.Errorf("gdsnap.InvalidReference name=%s content=%q", namePart(fi.Name), line)
+	}
+	return target, record, nil
+}
+
+// referenced reports whether a gdsnap/ref revision of another file references the content of the file with the given ID.
+// all revisions count, not just the heads, so that restoring the older revisions of the references keeps working.
+func (gs *gdsnap) referenced(id string) (bool, error) {
+	if err := gs.scanreftargets(); err != nil {
+		return false, err
+	}
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	return gs.reftargets[id], nil
+}
+
+// scanreftargets collects the targets of all gdsnap/ref revisions into reftargets on the first call.
+// savepath adds the targets of the new references afterwards.
+func (gs *gdsnap) scanreftargets() error {
+	gs.reftargetsmu.Lock()
+	defer gs.reftargetsmu.Unlock()
+	if gs.reftargetsscanned {
+		return nil
+	}
+	var files []fileinfo
+	gs.mu.Lock()
+	for _, fi := range gs.files {
+		if fi.ID != "" {
+			files = append(files, fi)
 		}
-		if len(r.NextPageToken) == 0 {
-			break
+	}
+	gs.mu.Unlock()
+	for _, fi := range files {
+		revs, err := gs.backend.revisions(&fi)
+		if err != nil {
+			return err
+		}
+		for _, r := range revs {
+			if !strings.HasPrefix(r.MimeType, "gdsnap/ref") {
+				continue
+			}
+			target, err := gs.resolveref(&fi, r.ID)
+			if err != nil {
+				return err
+			}
+			if target.fileID != fi.ID {
+				gs.mu.Lock()
+				gs.reftargets[target.fileID] = true
+				gs.mu.Unlock()
+			}
 		}
-		q.Set("pageToken", r.NextPageToken)
 	}
-	gs.files = files
+	gs.reftargetsscanned = true
+	return nil
 }
 
-func (gs *gdsnap) init() {
-	if len(*ignoreFlag) > 0 {
-		gs.ignore = strings.Split(*ignoreFlag, ",")
+// init sets up gs for its set, the flags' set if it has none.
+// the key header must exist already, see initkeys.
+func (gs *gdsnap) init() error {
+	if err := gs.initbackend(); err != nil {
+		return err
 	}
+	return gs.initkeys(false)
+}
 
-	key := argon2.IDKey([]byte("tmc4~tyőDKßVWaSa"), []byte(*passwordFlag), 1, 64<<10, 4, chacha20poly1305.KeySize)
+// initbackend sets up gs for its set without the keys so that the lock can be taken before creating them.
+// the sets of a watch share the slots, the token and the stats, initbackend creates the missing ones.
+func (gs *gdsnap) initbackend() error {
+	if gs.set == nil {
+		gs.set = flagset()
+	}
+	if gs.slots == nil {
+		gs.slots = make(chan struct{}, max(*jobsFlag, 1))
+	}
+	if gs.tok == nil {
+		gs.tok = &accesstoken{}
+	}
+	if gs.stats == nil {
+		gs.stats = &stats{}
+	}
+	gs.opts = options{cycledur: *cycledurFlag, sizelimitmb: *sizelimitmbFlag}
+	gs.inflight = map[string]chan struct{}{}
+	gs.retries = map[string]*retrystate{}
+	gs.content = map[string]contentref{}
+	gs.refs = map[contentref]contentref{}
+	gs.reftargets = map[string]bool{}
+	gs.ignore = newignorer(gs.set.dir, gs.set.ignore)
 	var err error
-	gs.aead, err = chacha20poly1305.NewX(key)
-	if err != nil {
-		log.Fatalf("gdsnap.CreateChachaCipher: %v", err)
+	if gs.retention, err = parseretention(gs.set.retention); err != nil {
+		return err
 	}
+
+	gs.backend, err = newbackend(gs.set, gs.tok)
+	return err
 }
 
-type gfileProperties struct {
-	Name         string            `json:"name,omitempty"`
-	Parents      []string          `json:"parents,omitempty"`
-	Properties   map[string]string `json:"properties,omitempty"`
-	ModifiedTime string            `json:"modifiedTime,omitempty"`
-	Trashed      *bool             `json:"trashed,omitempty"`
+// initkeys loads the key header and sets up the keyed parts of gs.
+// create makes a new header for a new backup, only the modifying subcommands do that while holding the lock.
+func (gs *gdsnap) initkeys(create bool) error {
+	if err := gs.loadkeys(create); err != nil {
+		return err
+	}
+	if gs.set.encryptnames {
+		// the checksums must stay the same across rekeys so derive the key from the oldest key.
+		mac := hmac.New(sha256.New, gs.keys.keys[gs.keys.oldest()])
+		mac.Write([]byte("gdsnap.sumkey"))
+		gs.sumkey = mac.Sum(nil)
+		gs.backend = &nameBackend{backend: gs.backend, keys: gs.keys}
+	}
+	return nil
 }
 
-func (gs *gdsnap) savepath(abspath string, verbose bool) {
-	if !strings.HasPrefix(abspath, *dirFlag) {
-		log.Printf("skipping %s because it's not under %s.", abspath, *dirFlag)
-		return
+// lazykeysubcommands load the keys only when they decrypt something so that they work on backups without a key header.
+// the -encryptnames mode needs the keys for the names so they load them upfront then.
+var lazykeysubcommands = map[string]bool{"list": true, "log": true, "mount": true, "snapshots": true}
+
+// needkeys loads the keys if they aren't loaded yet, see lazykeysubcommands.
+func (gs *gdsnap) needkeys() error {
+	gs.keysmu.Lock()
+	defer gs.keysmu.Unlock()
+	if gs.keys != nil {
+		return nil
 	}
-	relpath, ignore := abspath[len(*dirFlag):], false
-	for _, ign := range gs.ignore {
-		if matchglob(ign, relpath) {
-			ignore = true
-			break
+	return gs.loadkeys(false)
+}
+
+// contentsum returns the checksum of a content for the name of a file from its sha256sum.
+// it's keyed in the -encryptnames mode so that the names don't reveal the content.
+func (gs *gdsnap) contentsum(sha256sum []byte) string {
+	if gs.sumkey == nil {
+		return hex.EncodeToString(sha256sum)
+	}
+	mac := hmac.New(sha256.New, gs.sumkey)
+	mac.Write(sha256sum)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// saveall backs up the paths concurrently and returns the errors keyed by the path.
+func (gs *gdsnap) saveall(abspaths []string, verbose bool) map[string]error {
+	var mu sync.Mutex
+	errs := map[string]error{}
+	var g errgroup.Group
+	g.SetLimit(cap(gs.slots))
+	for _, abspath := range abspaths {
+		g.Go(func() error {
+			if err := gs.savepath(abspath, verbose); err != nil {
+				mu.Lock()
+				errs[abspath] = err
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	g.Wait()
+	return errs
+}
+
+// acquireslot waits until fewer than -jobs files are being saved.
+// the returned function releases the slot.
+func (gs *gdsnap) acquireslot() func() {
+	gs.slots <- struct{}{}
+	return func() { <-gs.slots }
+}
+
+// joinerrs joins the errors of saveall.
+func joinerrs(errs map[string]error) error {
+	return errors.Join(slices.Collect(maps.Values(errs))...)
+}
+
+// lock waits until no other goroutine saves key and then marks it as being saved.
+// the key is either a relpath or a contentsum.
+// the returned function releases it.
+func (gs *gdsnap) lock(key string) func() {
+	for {
+		gs.mu.Lock()
+		ch, busy := gs.inflight[key]
+		if !busy {
+			ch = make(chan struct{})
+			gs.inflight[key] = ch
+			gs.mu.Unlock()
+			return func() {
+				gs.mu.Lock()
+				delete(gs.inflight, key)
+				gs.mu.Unlock()
+				close(ch)
+			}
 		}
+		gs.mu.Unlock()
+		<-ch
+	}
+}
+
+// savepath backs up abspath.
+// if abspath is a directory then all files under it are backed up concurrently and the errors are joined.
+// it's safe to call concurrently.
+func (gs *gdsnap) savepath(abspath string, verbose bool) error {
+	if !strings.HasPrefix(abspath, gs.set.dir) {
+		log.Printf("skipping %s because it's not under %s.", abspath, gs.set.dir)
+		return nil
 	}
+	relpath := abspath[len(gs.set.dir):]
+	gs.ignore.changed(relpath)
+	lfinfo, lerr := os.Lstat(abspath)
+	ignore := gs.ignore.ignored(relpath, lerr == nil && lfinfo.IsDir())
 
+	defer gs.lock(relpath)()
+	gs.mu.Lock()
 	fi, exist := gs.files[relpath]
+	gs.mu.Unlock()
 	if ignore && (!exist || fi.Trashed) {
-		return
+		return nil
 	}
 
 	if exist && fi.ID == "" {
@@ -471,260 +1037,515 @@ func (gs *gdsnap) savepath(abspath string, verbose bool) {
 		// In rare cases the file's content might have changed between now and its creation in the current cycle.
 		// No need to do anything in that case either because the next main cycle will deal with that change.
 		// In my next life I should avoid inotify and these ugly recursions and just do a full cycle each iteration.
-		return
+		return nil
 	}
 
 	finfo, err := os.Lstat(abspath)
-	if err != nil && (!exist || fi.Trashed) {
+	isdir := exist && strings.HasPrefix(fi.MimeType, "gdsnap/dir")
+	if err != nil && (!exist || fi.Trashed || isdir) {
 		// a path that cannot be statted and is not on gdrive either?
-		// this might be a deleted or moved directory since those are not uploaded.
+		// this might be a deleted or moved directory since only the empty ones are uploaded.
 		// check any files rooted under this name just in case.
 		// note: this might be slow when deleting many directories.
 		// consider optimizing in that case in some way.
 		// e.g. listfiles could precompute a dir->[file] map.
 		this := relpath + "/"
+		var children []string
+		gs.mu.Lock()
 		for p := range gs.files {
 			if strings.HasPrefix(p, this) {
-				gs.savepath(path.Join(*dirFlag, p), verbose)
+				children = append(children, path.Join(gs.set.dir, p))
 			}
 		}
-		return
+		gs.mu.Unlock()
+		if err := joinerrs(gs.saveall(children, verbose)); err != nil || !isdir || fi.Trashed {
+			return err
+		}
 	}
 
 	var contents []byte
 	var needTrashing bool
 	var modtime string
 	var shasumstr string
+	var target contentref
+	var stream bool
+	var header []byte
 	newfi := fi
 	if err != nil || ignore {
+		defer gs.acquireslot()()
 		needTrashing = true
 		newfi.Trashed = true
 		newfi.MimeType = "gdsnap/deleted"
 	} else {
 		newfi.Trashed = false
-		newfi.MimeType = fmt.Sprintf("gdsnap/data%03o", finfo.Mode().Perm())
+		newfi.MimeType = fmt.Sprintf("gdsnap/data%03o-m", finfo.Mode().Perm())
 
-		// save all files under a directory if abspath is a directory.
+		// save all files and empty directories under a directory if abspath is a non-empty directory.
+		// the non-empty directories are not saved, their files recreate them on restore.
+		var empty bool
 		if finfo.IsDir() {
+			var errs []error
+			var paths []string
 			walk := func(path string, d fs.DirEntry, err error) error {
 				if err != nil {
-					log.Printf("filepath.WalkDir(%s) error: %v", path, err)
+					errs = append(errs, fmt.Errorf("gdsnap.WalkDir path=%s: %v", path, err))
+					return nil
+				}
+				if gs.ignore.ignoredabs(path, d.IsDir()) {
+					if d.IsDir() {
+						return fs.SkipDir
+					}
+					return nil
 				}
 				if !d.IsDir() {
-					gs.savepath(path, verbose)
+					paths = append(paths, path)
+				} else if entries, err := os.ReadDir(path); err == nil && len(entries) == 0 && path != gs.set.dir {
+					paths = append(paths, path)
 				}
 				return nil
 			}
-			if err := filepath.WalkDir(abspath, walk); err != nil {
-				log.Printf("couldn't fully walk %s: %v", relpath, err)
+			if entries, err := os.ReadDir(abspath); err != nil || len(entries) > 0 || relpath == "" {
+				filepath.WalkDir(abspath, walk)
+				return errors.Join(append(errs, joinerrs(gs.saveall(paths, verbose)))...)
 			}
-			return
+			empty = true
 		}
 
-		modtime = finfo.ModTime().UTC().Format("2006-01-02T15:04:05.000Z")
+		defer gs.acquireslot()()
+		modtime = finfo.ModTime().UTC().Format(tLayout)
 		newfi.ModifiedTime = modtime
 		if !fi.Trashed && modtime == fi.ModifiedTime {
-			return
+			return nil
 		}
-		if finfo.Mode().Type() == fs.ModeSymlink {
+		meta, err := collectmetadata(abspath)
+		if err != nil {
+			return fmt.Errorf("gdsnap.CollectMetadata relpath=%s: %v", relpath, err)
+		}
+		if header, err = meta.header(); err != nil {
+			return fmt.Errorf("gdsnap.CollectMetadata relpath=%s: %v", relpath, err)
+		}
+		if empty {
+			newfi.MimeType = fmt.Sprintf("gdsnap/dir%03o-m", finfo.Mode().Perm())
+			if contents, err = gs.encrypt(header); err != nil {
+				return fmt.Errorf("gdsnap.EncryptDir relpath=%s: %v", relpath, err)
+			}
+		} else if finfo.Mode().Type() == fs.ModeSymlink {
 			symlink, err := os.Readlink(abspath)
 			if err != nil {
-				log.Printf("skipping %s because couldn't read the symlink: %v", relpath, err)
+				return fmt.Errorf("gdsnap.ReadSymlink relpath=%s: %v", relpath, err)
+			}
+			// the symlinks with a metadata record are always encrypted since the record is private.
+			newfi.MimeType = "gdsnap/symlink-m"
+			if contents, err = gs.encrypt(append(header, symlink...)); err != nil {
+				return fmt.Errorf("gdsnap.EncryptSymlink relpath=%s: %v", relpath, err)
 			}
-			newfi.MimeType = "gdsnap/symlink"
-			contents = []byte(symlink)
 		} else if !finfo.Mode().IsRegular() {
 			log.Printf("skipping %s because it's not a regular file.", relpath)
-			return
+			return nil
 		} else {
-			if finfo.Size() > int64(*sizelimitmbFlag)*1e6 {
-				log.Printf("[warning] skipping %s because it's too big (%d MB); bump --sizelimit or ignore.", relpath, finfo.Size()/1e6)
-				warn()
-				return
-			}
-			rawcontents, err := os.ReadFile(abspath)
-			if err != nil {
-				log.Printf("[warning] couldn't load %s: %v", relpath, err)
-				warn()
-				return
+			// the large files are streamed to keep the memory usage bounded.
+			var rawcontents []byte
+			stream = finfo.Size() > int64(gs.opts.sizelimitmb)*1e6
+			if stream {
+				if shasumstr, err = gs.hashfile(abspath); err != nil {
+					return fmt.Errorf("gdsnap.HashFile relpath=%s: %v", relpath, err)
+				}
+			} else {
+				if rawcontents, err = os.ReadFile(abspath); err != nil {
+					return fmt.Errorf("gdsnap.ReadFile relpath=%s: %v", relpath, err)
+				}
+				shasum := sha256.Sum256(rawcontents)
+				shasumstr = gs.contentsum(shasum[:])
 			}
 
-			// compress and encrypt the file.
-			compressed := &bytes.Buffer{}
-			compressor, err := flate.NewWriter(compressed, 9)
-			if err != nil {
-				log.Fatalf("couldn't create compressor %s: %v", relpath, err)
-			}
-			if n, err := compressor.Write(rawcontents); n != len(rawcontents) || err != nil {
-				log.Fatalf("couldn't compress %s: %v", relpath, err)
+			// Skip if sha256sum already matches.
+			if !fi.Trashed && shasumstr == shasumPart(fi.Name) {
+				return nil
 			}
-			if err := compressor.Close(); err != nil {
-				log.Fatalf("couldn't close compressor for %s: %v", relpath, err)
+
+			// save a reference if the content is already backed up.
+			// otherwise compress and encrypt the file.
+			// the same content is saved one at a time so that the copies become references to the first one.
+			defer gs.lock(shasumstr)()
+			var found bool
+			if target, found, err = gs.findcontent(&fi, shasumstr); err != nil {
+				return fmt.Errorf("gdsnap.FindContent relpath=%s: %v", relpath, err)
 			}
-			nonce := make([]byte, gs.aead.NonceSize())
-			if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-				log.Fatalf("gdsnap.ReadNewNonce: %v", err)
+			if found {
+				if err := gs.backend.keep(&fileinfo{ID: target.fileID, Name: fi.Name}, target.revID); err != nil {
+					log.Printf("couldn't keep the referenced revision, uploading %s in full: %v", relpath, err)
+					found = false
+				}
 			}
-			contents = gs.aead.Seal(nonce, nonce, compressed.Bytes(), nil)
-
-			// Skip if sha256sum already matches.
-			shasum := sha256.Sum256(rawcontents)
-			shasumstr = hex.EncodeToString(shasum[:])
-			newfi.Size = strconv.Itoa(len(contents))
-			if !fi.Trashed && newfi.Size == fi.Size && shasumstr == shasumPart(fi.Name) {
-				return
+			if found {
+				// the reference's own metadata record follows the target on a new line.
+				newfi.MimeType = fmt.Sprintf("gdsnap/ref%03o-m", finfo.Mode().Perm())
+				var record []byte
+				if record, err = gs.encrypt(header); err != nil {
+					return fmt.Errorf("gdsnap.Encrypt relpath=%s: %v", relpath, err)
+				}
+				contents, stream = append([]byte(target.String()+"\n"), record...), false
+			} else if stream {
+				newfi.MimeType = fmt.Sprintf("gdsnap/stream%03o-m", finfo.Mode().Perm())
+			} else if contents, err = gs.encrypt(append(header, rawcontents...)); err != nil {
+				return fmt.Errorf("gdsnap.Encrypt relpath=%s: %v", relpath, err)
 			}
 		}
 	}
 
-	gs.gettoken()
-	ct := gfileProperties{}
-	if !exist {
-		ct = gfileProperties{
-			Name:       relpath + "/" + shasumstr,
-			Parents:    []string{*gdirFlag},
-			Properties: map[string]string{"gdsnap.profile": *profileFlag},
-		}
-	} else {
-		ct = gfileProperties{
-			Name:    relpath + "/" + shasumstr,
-			Trashed: &needTrashing,
+	if hasmeta(newfi.MimeType) {
+		newfi.MimeType += gs.keys.keysuffix()
+	}
+	newfi.Name = relpath + "/" + shasumstr
+	keepout, uploaded := false, int64(0)
+	if needTrashing && exist {
+		if keepout, err = gs.referenced(fi.ID); err != nil {
+			return fmt.Errorf("gdsnap.CheckReferenced relpath=%s: %v", relpath, err)
 		}
 	}
-	if !needTrashing {
-		ct.ModifiedTime = modtime
+	if keepout {
+		// the trash gets purged so keep the referenced content out of it.
+		newfi.Trashed, newfi.ModifiedTime, newfi.Size = false, "", "0"
+		newfi, err = gs.backend.upload(newfi, strings.NewReader(""))
+		newfi.Trashed = true
+	} else if needTrashing {
+		newfi, err = gs.backend.trash(newfi)
+	} else if stream {
+		var f *os.File
+		if f, err = os.Open(abspath); err == nil {
+			content := gs.encryptstream(f, header, shasumstr)
+			cr := &countreader{r: content}
+			newfi.Size = ""
+			newfi, err = gs.backend.upload(newfi, cr)
+			content.Close()
+			uploaded = cr.n
+		}
+	} else {
+		newfi.Size = strconv.Itoa(len(contents))
+		newfi, err = gs.backend.upload(newfi, bytes.NewReader(contents))
+		uploaded = int64(len(contents))
 	}
-	createData, err := json.Marshal(ct)
 	if err != nil {
-		log.Fatalf("couldn't create properties for %s: %v", relpath, err)
+		return fmt.Errorf("gdsnap.Save relpath=%s: %v", relpath, err)
 	}
-
-	if len(contents) > 5e6 {
-		// large files must be uploaded using 2 separate requests.
-		var startReq *http.Request
-		if exist {
-			startReq, err = http.NewRequest("PATCH", "https://www.googleapis.com/upload/drive/v3/files/"+fi.ID+"?uploadType=resumable", bytes.NewReader(createData))
-		} else {
-			startReq, err = http.NewRequest("POST", "https://www.googleapis.com/upload/drive/v3/files?uploadType=resumable", bytes.NewReader(createData))
-		}
-		if err != nil {
-			log.Fatalf("couldn't create largefile upload request for %s: %v", relpath, err)
-		}
-		startReq.Header.Set("Authorization", "Bearer "+gs.accesstoken)
-		startReq.Header.Set("Content-Type", "application/json; charset=UTF-8")
-		startReq.Header.Set("X-Upload-Content-Type", newfi.MimeType)
-		startReq.Header.Set("X-Upload-Content-Length", strconv.Itoa(len(contents)))
-		startResp, err := http.DefaultClient.Do(startReq)
-		if err != nil {
-			log.Fatalf("largefile upload start for %s failed: %v", relpath, err)
-		}
-		if startResp.StatusCode != 200 {
-			body, _ := io.ReadAll(startResp.Body)
-			log.Fatalf("largefile upload start for %s returned error: %s\n%s", relpath, startResp.Status, body)
-		}
-		loc := startResp.Header.Get("Location")
-		if len(loc) == 0 {
-			log.Fatalf("missing upload location when uploading %s", relpath)
-		}
-
-		uploadReq, err := http.NewRequest("PUT", loc, bytes.NewReader(contents))
-		if err != nil {
-			log.Fatalf("couldn't create largefile upload start request for %s: %v.", relpath, err)
+	if needTrashing {
+		gs.stats.deletions.Add(1)
+	} else {
+		gs.stats.uploads.Add(1)
+		gs.stats.uploadedbytes.Add(uploaded)
+	}
+	if exist && len(gs.retention) > 0 {
+		if err := gs.retain(&newfi); err != nil {
+			log.Printf("[warning] couldn't apply the retention policy to %s: %v", relpath, err)
 		}
-		uploadResp, err := http.DefaultClient.Do(uploadReq)
-		if err != nil {
-			log.Fatalf("largefile upload for %s failed: %v.", relpath, err)
+	}
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.files[relpath] = newfi
+	if needTrashing && !keepout {
+		for shasum, r := range gs.content {
+			if r.fileID == newfi.ID {
+				delete(gs.content, shasum)
+			}
 		}
-		if startResp.StatusCode != 200 {
-			body, _ := io.ReadAll(startResp.Body)
-			log.Fatalf("largefile upload for %s returned error: %s\n%s", relpath, uploadResp.Status, body)
+	} else if newfi.HeadRevisionID == "" {
+		// can't index without the revision ID.
+	} else if strings.HasPrefix(newfi.MimeType, "gdsnap/ref") {
+		gs.refs[contentref{fileID: newfi.ID, revID: newfi.HeadRevisionID}] = target
+		if target.fileID != newfi.ID {
+			gs.reftargets[target.fileID] = true
 		}
-		log.Printf("%s uploaded (was a large file).", relpath)
-		return
+	} else if ok, stream := hascontent(newfi.MimeType); ok {
+		gs.content[shasumstr] = contentref{newfi.ID, newfi.HeadRevisionID, stream, true}
 	}
+	if exist {
+		log.Printf("%s updated.", relpath)
+	} else {
+		log.Printf("%s created.", relpath)
+	}
+	return nil
+}
 
-	reqBuf := &bytes.Buffer{}
-	w := multipart.NewWriter(reqBuf)
-	mimeHeader := textproto.MIMEHeader{}
-	mimeHeader.Set("Content-Type", "application/json; charset=UTF-8")
-	metadataWriter, err := w.CreatePart(mimeHeader)
+// encrypt compresses and then encrypts the plaintext.
+func (gs *gdsnap) encrypt(plaintext []byte) ([]byte, error) {
+	compressed := &bytes.Buffer{}
+	compressor, err := flate.NewWriter(compressed, 9)
 	if err != nil {
-		log.Fatalf("failed %s because couldn't create metadata part: %v", relpath, err)
+		return nil, fmt.Errorf("gdsnap.CreateCompressor: %v", err)
+	}
+	if n, err := compressor.Write(plaintext); n != len(plaintext) || err != nil {
+		return nil, fmt.Errorf("gdsnap.Compress: %v", err)
 	}
-	metadataWriter.Write(createData)
-	mimeHeader.Set("Content-Type", newfi.MimeType)
-	contentWriter, err := w.CreatePart(mimeHeader)
+	if err := compressor.Close(); err != nil {
+		return nil, fmt.Errorf("gdsnap.CloseCompressor: %v", err)
+	}
+	aead := gs.keys.currentaead()
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("gdsnap.ReadNewNonce: %v", err)
+	}
+	return aead.Seal(nonce, nonce, compressed.Bytes(), nil), nil
+}
+
+// hashfile returns the contentsum of a file without reading it into memory.
+func (gs *gdsnap) hashfile(abspath string) (string, error) {
+	f, err := os.Open(abspath)
 	if err != nil {
-		log.Fatalf("failed %s because couldn't create content part: %v", relpath, err)
+		return "", err
 	}
-	contentWriter.Write(contents)
-	w.Close()
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return gs.contentsum(h.Sum(nil)), nil
+}
 
-	var createReq *http.Request
-	var kind string
-	if exist {
-		createReq, err = http.NewRequest("PATCH", "https://www.googleapis.com/upload/drive/v3/files/"+fi.ID+"?uploadType=multipart", bytes.NewReader(reqBuf.Bytes()))
-		kind = "existing"
-	} else {
-		createReq, err = http.NewRequest("POST", "https://www.googleapis.com/upload/drive/v3/files?uploadType=multipart", bytes.NewReader(reqBuf.Bytes()))
-		kind = "new"
+// encryptstream streams the compressed and encrypted content of r in the gdsnap/stream format and closes r at the end.
+// the stream fails if the content's contentsum doesn't match shasum so that a changed file is not saved under the wrong name.
+// the metadata header goes in front of the content, shasum covers only the content.
+// the caller must close the stream.
+func (gs *gdsnap) encryptstream(r io.ReadCloser, header []byte, shasum string) io.ReadCloser {
+	aead := gs.keys.currentaead()
+	pr, pw := io.Pipe()
+	go func() {
+		defer r.Close()
+		pw.CloseWithError(func() error {
+			sw, err := newstreamwriter(aead, pw)
+			if err != nil {
+				return err
+			}
+			compressor, err := flate.NewWriter(sw, 9)
+			if err != nil {
+				return fmt.Errorf("gdsnap.CreateCompressor: %v", err)
+			}
+			if _, err := compressor.Write(header); err != nil {
+				return fmt.Errorf("gdsnap.Compress: %v", err)
+			}
+			h := sha256.New()
+			if _, err := io.Copy(compressor, io.TeeReader(r, h)); err != nil {
+				return fmt.Errorf("gdsnap.Compress: %v", err)
+			}
+			if err := compressor.Close(); err != nil {
+				return fmt.Errorf("gdsnap.CloseCompressor: %v", err)
+			}
+			if got := gs.contentsum(h.Sum(nil)); got != shasum {
+				return fmt.Errorf("gdsnap.FileChangedWhileSaving got=%s want=%s", got, shasum)
+			}
+			return sw.Close()
+		}())
+	}()
+	return pr
+}
+
+// retrystate tracks a path whose backup failed.
+type retrystate struct {
+	failures int
+	next     time.Time
+}
+
+// backoff returns how long to wait before retrying after the nth consecutive failure.
+func backoff(failures int) time.Duration {
+	const maxwait = 24 * time.Hour
+	wait := 30 * time.Second
+	for i := 1; i < failures && wait < maxwait; i++ {
+		wait *= 2
+	}
+	return min(wait, maxwait)
+}
+
+// markfailure records a failed backup of abspath and schedules its retry.
+func (gs *gdsnap) markfailure(abspath string, err error) {
+	r := gs.retries[abspath]
+	if r == nil {
+		r = &retrystate{}
+		gs.retries[abspath] = r
+	}
+	r.failures++
+	gs.stats.failures.Add(1)
+	wait := backoff(r.failures)
+	r.next = time.Now().Add(wait)
+	log.Printf("[warning] backup of %s failed %d times, retrying in %s: %v", abspath, r.failures, wait, err)
+	if r.failures >= 3 {
+		warn()
+	}
+}
+
+// initialscan syncs the backup with the disk before the watching starts.
+// the paths that failed to back up are added to touched.
+func (gs *gdsnap) initialscan(touched map[string]bool) error {
+	gs.checkQuota()
+
+	if err := gs.listfiles(); err != nil {
+		return err
+	}
+	// the files on disk go first so that a moved file is saved as a reference before its old path is deleted.
+	log.Print("initial scan: creating/updating files seen on disk.")
+	if err := gs.savepath(gs.set.dir, true); err != nil {
+		gs.markfailure(gs.set.dir, err)
+		touched[gs.set.dir] = true
+	}
+	log.Print("initial scan: deleting files seen only on gdrive.")
+	var abspaths []string
+	for relpath, f := range gs.files {
+		if !f.Trashed {
+			abspaths = append(abspaths, path.Join(gs.set.dir, relpath))
+		}
+	}
+	for abspath, err := range gs.saveall(abspaths, true) {
+		gs.markfailure(abspath, err)
+		touched[abspath] = true
+	}
+	return gs.savesnapshot()
+}
+
+// cycle backs up the touched files.
+// the successfully backed up files are removed from touched.
+// the failed ones remain there and are retried in a later cycle after a backoff.
+func (gs *gdsnap) cycle(touched map[string]bool) (err error) {
+	start := time.Now()
+	defer func() {
+		gs.stats.cycled(start, err)
+		gs.setpending(len(touched))
+	}()
+	gs.checkQuota()
+	if err := gs.listfiles(); err != nil {
+		return err
+	}
+	// the existing paths go first so that a moved file is saved as a reference before its old path is deleted.
+	var existing, missing []string
+	for fn := range touched {
+		// the other files of the cycle must see the new ignore rules.
+		gs.ignore.changed(strings.TrimPrefix(fn, gs.set.dir))
+		if _, err := os.Lstat(fn); err == nil {
+			existing = append(existing, fn)
+		} else {
+			missing = append(missing, fn)
+		}
+	}
+	now := time.Now()
+	for _, fns := range [][]string{existing, missing} {
+		fns = slices.DeleteFunc(fns, func(fn string) bool {
+			r := gs.retries[fn]
+			return r != nil && now.Before(r.next)
+		})
+		errs := gs.saveall(fns, false)
+		for _, fn := range fns {
+			if err, failed := errs[fn]; failed {
+				gs.markfailure(fn, err)
+				continue
+			}
+			delete(touched, fn)
+			delete(gs.retries, fn)
+		}
 	}
-	if err != nil {
-		log.Fatalf("couldn't create upload/create request for %s: %v", relpath, err)
+	return gs.savesnapshot()
+}
+
+// nextcycle returns the time to wait until the next cycle.
+// it's shorter than -cycledur if a failed path is due for a retry sooner.
+func (gs *gdsnap) nextcycle(touched map[string]bool) time.Duration {
+	wait := gs.opts.cycledur
+	for fn := range touched {
+		if r := gs.retries[fn]; r != nil {
+			wait = min(wait, max(time.Until(r.next), time.Second))
+		}
 	}
-	createReq.Header.Set("Authorization", "Bearer "+gs.accesstoken)
-	createReq.Header.Set("Accept", "application/json")
-	createReq.Header.Set("Content-Type", "multipart/related; boundary="+w.Boundary())
-	createResp, err := http.DefaultClient.Do(createReq)
-	if err != nil {
-		log.Fatalf("upload of %s failed: %v.", relpath, err)
+	return wait
+}
+
+func (gs *gdsnap) subcommandWatch(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("gdsnap.UnexpectedArgs")
 	}
-	createBody, err := io.ReadAll(createResp.Body)
-	if err != nil {
-		log.Fatalf("couldn't read create response for %s: %v", relpath, err)
+	return watchsets([]*gdsnap{gs})
+}
+
+// servedaemon starts the -statusaddr and the -controlsock listeners of watch.
+// the control requests arrive on ctlch, stop closes the listeners.
+func servedaemon(st *stats) (ctlch chan ctlrequest, stop func(), err error) {
+	st.started.Store(time.Now().UnixNano())
+	var lns []net.Listener
+	stop = func() {
+		for _, ln := range lns {
+			ln.Close()
+		}
 	}
-	if createResp.StatusCode != 200 {
-		log.Fatalf("upload of %s %s failed with %q:\n%s", kind, relpath, createResp.Status, createBody)
+	if *statusaddrFlag != "" {
+		ln, err := statuslisten(*statusaddrFlag)
+		if err != nil {
+			return nil, nil, err
+		}
+		lns = append(lns, ln)
+		st.serve(ln)
+		log.Printf("serving the status on %s.", *statusaddrFlag)
 	}
-	gs.files[relpath] = newfi
-	if exist {
-		log.Printf("%s updated.", relpath)
-	} else {
-		log.Printf("%s created.", relpath)
+	// the requests wait until the main loop starts.
+	ctlch = make(chan ctlrequest)
+	if *controlsockFlag != "" {
+		ln, err := controllisten(*controlsockFlag)
+		if err != nil {
+			stop()
+			return nil, nil, err
+		}
+		lns = append(lns, ln)
+		go servecontrol(ln, ctlch)
 	}
+	return ctlch, stop, nil
 }
 
-func (gs *gdsnap) subcommandWatch(args []string) {
-	if len(args) != 0 {
-		log.Fatalf("error: unexpected cmdline arguments.")
+// watch backs up the set's changes until it fails, gets a quit request on ctlch or ctx is done.
+func (gs *gdsnap) watch(ctx context.Context, ctlch <-chan ctlrequest) error {
+	w, err := newwatcher(gs.ignore)
+	if err != nil {
+		return err
 	}
-	gs.gettoken()
-	gs.checkQuota()
-
-	log.Print("initial scan: updating/deleting files seen on gdrive.")
-	gs.listfiles()
-	for _, f := range gs.files {
-		if !f.Trashed {
-			gs.savepath(path.Join(*dirFlag, f.Name), true)
+	touched := map[string]bool{}
+	for failures := 1; ; failures++ {
+		err := gs.initialscan(touched)
+		if err == nil {
+			break
+		}
+		wait := backoff(failures)
+		log.Printf("[warning] initial scan failed, retrying in %s: %v", wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
 		}
 	}
-	log.Print("initial scan: creating new files seen on disk.")
-	gs.savepath(*dirFlag, true)
 
 	filech := make(chan string, 1000)
-	go watchdir(filech)
+	watcherr := make(chan error, 1)
+	watchctx, stopwatcher := context.WithCancel(ctx)
+	defer stopwatcher()
+	go func() { watcherr <- w.watch(watchctx, filech) }()
 
 	// handle the initial scan from the inotify watch.
 	log.Print("waiting for the changes to subside for a moment.")
+	save := func(fn string) {
+		if err := gs.savepath(fn, true); err != nil {
+			gs.markfailure(fn, err)
+			touched[fn] = true
+		}
+	}
 initloop:
 	for {
 		select {
 		case fn := <-filech:
-			gs.savepath(fn, true)
+			save(fn)
+		case err := <-watcherr:
+			return fmt.Errorf("gdsnap.WatchDir: %v", err)
+		case <-ctx.Done():
+			return ctx.Err()
 		default:
 			select {
 			case fn := <-filech:
-				gs.savepath(fn, true)
+				save(fn)
+			case err := <-watcherr:
+				return fmt.Errorf("gdsnap.WatchDir: %v", err)
+			case <-ctx.Done():
+				return ctx.Err()
 			case <-time.After(3 * time.Second):
 				break initloop
 			}
@@ -736,487 +1557,504 @@ initloop:
 	runtime.GC()
 
 	log.Print("main loop started: will track changed files and periodically upload them.")
-	timer := time.NewTimer(*cycledurFlag)
-	touched := map[string]bool{}
+	timer := time.NewTimer(gs.nextcycle(touched))
+	cyclefailures := 0
+	var lastprune time.Time
 	for {
-		wasSIGINT := false
+		// forced is set for the cycles requested by a sigint or a flush, they run even when paused.
+		forced := false
+		var reply chan error
 		select {
 		case fn := <-filech:
 			touched[fn] = true
+			gs.setpending(len(touched))
 			continue
+		case err := <-watcherr:
+			return fmt.Errorf("gdsnap.WatchDir: %v", err)
+		case <-ctx.Done():
+			return ctx.Err()
 		case <-timer.C:
 		case <-sigintch:
-			wasSIGINT = true
+			forced = true
 			if len(touched) == 0 {
 				log.Printf("got a sigint but skipping backup cycle since nothing changed (use sigquit to quit).")
 			} else {
 				log.Printf("got a sigint, running a backup cycle for %d files (use sigquit to quit).", len(touched))
 			}
+		case req := <-ctlch:
+			switch req.cmd {
+			case "flush":
+				forced, reply = true, req.reply
+				log.Printf("got a flush request, running a backup cycle for %d files.", len(touched))
+			case "quit":
+				log.Print("got a quit request, quitting.")
+				req.reply <- nil
+				return nil
+			default:
+				req.reply <- gs.control(req, touched)
+				gs.setpending(len(touched))
+				continue
+			}
 		}
 
-		if len(touched) > 0 {
-			gs.gettoken()
-			gs.checkQuota()
-			gs.listfiles()
-			for fn := range touched {
-				delete(touched, fn)
-				gs.savepath(fn, false)
+		wait := time.Duration(0)
+		var cycleerr error
+		if len(touched) > 0 && (forced || !gs.stats.paused.Load()) {
+			if cycleerr = gs.cycle(touched); cycleerr != nil {
+				cyclefailures++
+				wait = min(backoff(cyclefailures), gs.opts.cycledur)
+				log.Printf("[warning] backup cycle failed, retrying in %s: %v", wait, cycleerr)
+				if cyclefailures >= 3 {
+					warn()
+				}
+			} else {
+				cyclefailures = 0
+				if forced {
+					log.Printf("backup cycle done.")
+				}
 			}
-			if wasSIGINT {
-				log.Printf("backup cycle done.")
+			if len(gs.retention) > 0 && time.Since(lastprune) >= 24*time.Hour {
+				if err := gs.prune(false); err != nil {
+					log.Printf("[warning] prune failed: %v", err)
+				}
+				lastprune = time.Now()
 			}
 			// it's the perfect time to collect the garbage from this cycle.
 			runtime.GC()
 		}
+		if reply != nil {
+			if cycleerr == nil && len(touched) > 0 {
+				cycleerr = fmt.Errorf("gdsnap.FilesPending count=%d (they are retried after a backoff, see the log)", len(touched))
+			}
+			reply <- cycleerr
+		}
+		if wait == 0 {
+			wait = gs.nextcycle(touched)
+		}
 		timer.Stop()
-		timer.Reset(*cycledurFlag)
+		timer.Reset(wait)
 	}
 }
 
-func (gs *gdsnap) subcommandAuth(args []string) {
-	if len(args) != 0 {
-		log.Fatalf("error: unexpected cmdline arguments.")
-	}
-	if len(*refreshtokenFlag) > 0 {
-		log.Fatal(`-refreshtoken already defined. use "gdsnap -refreshtoken= auth" to force auth regardless.`)
-	}
-
-	q := url.Values{}
-	q.Set("client_id", oaClientID)
-	q.Set("scope", "https://www.googleapis.com/auth/drive.file")
-	q.Set("response_type", "code")
-	q.Set("redirect_uri", "http://127.0.0.1:1")
-	u := "https://accounts.google.com/o/oauth2/auth?" + q.Encode()
-	fmt.Println("visit and authorize gdsnap:")
-	fmt.Println(u)
-	fmt.Println("after the authorization it'll redirect to an invalid address.")
-	fmt.Println("but from the url copy the code component's value here (starts with 4/):")
-
-	var authcode string
-	if _, err := fmt.Scan(&authcode); err != nil {
-		log.Fatalf("authcode parse error: %v", err)
-	}
-
-	q = url.Values{}
-	q.Set("code", authcode)
-	q.Set("client_id", oaClientID)
-	q.Set("client_secret", oaSecret)
-	q.Set("redirect_uri", "http://127.0.0.1:1")
-	q.Set("grant_type", "authorization_code")
-	response, err := http.Post("https://oauth2.googleapis.com/token", "application/x-www-form-urlencoded", strings.NewReader(q.Encode()))
-	if err != nil {
-		log.Fatal(err)
-	}
-	responseBody, err := io.ReadAll(response.Body)
-	if err != nil {
-		log.Fatal(err)
-	}
-	response.Body.Close()
-
-	var r map[string]interface{}
-	if err = json.Unmarshal(responseBody, &r); err != nil {
-		log.Fatal(err)
-	}
-	rt, ok := r["refresh_token"].(string)
-	if !ok {
-		log.Fatalf("couldn't parse refresh_token from response. full response:\n%s", string(responseBody))
+func (gs *gdsnap) subcommandList(args []string) error {
+	if err := gs.listtree(); err != nil {
+		return err
 	}
-	fmt.Println("add the following to ~/.gdsnap, ~/.config/gdsnap, or ~/.cache/gdsnap (this is a sensitive token, don't share this!):")
-	fmt.Printf("* refreshtoken %q\n", rt)
-}
-
-func (gs *gdsnap) subcommandList(args []string) {
-	gs.listfiles()
 	out := bufio.NewWriter(os.Stdout)
 	defer out.Flush()
-	q := url.Values{}
-	q.Set("fields", "revisions(originalFilename,id,size,modifiedTime,mimeType)")
-	q.Set("pageSize", "1000")
 	for _, f := range filterfiles(gs.files, args) {
 		fi := gs.files[f]
 		fmt.Fprintf(out, "%+v\n", fi)
-		req, err := http.NewRequest("GET", "https://www.googleapis.com/drive/v3/files/"+fi.ID+"/revisions?"+q.Encode(), nil)
-		if err != nil {
-			log.Fatalf("couldn't create request for %s: %v", f, err)
-		}
-		req.Header.Set("Accept", "application/json")
-		req.Header.Set("Authorization", "Bearer "+gs.accesstoken)
-		resp, err := http.DefaultClient.Do(req)
+		revs, err := gs.backend.revisions(&fi)
 		if err != nil {
-			log.Fatalf("error listing revisions for %s: %v", f, err)
+			return err
 		}
-		body, err := io.ReadAll(resp.Body)
+		body, err := json.MarshalIndent(map[string][]revinfo{"revisions": revs}, "", " ")
 		if err != nil {
-			log.Fatalf("error reading revisions for %s: %v", f, err)
+			return fmt.Errorf("gdsnap.MarshalRevisions relpath=%s: %v", f, err)
 		}
 		fmt.Fprintln(out, string(body))
 		fmt.Fprintln(out)
 	}
+	return nil
 }
 
-func (gs *gdsnap) subcommandSave(args []string) {
+func (gs *gdsnap) subcommandSave(args []string) error {
 	if len(args) == 0 {
 		fmt.Println("usage: gdsnap [flags...] save [file...]")
-		return
+		return nil
+	}
+	if err := gs.listfiles(); err != nil {
+		return err
 	}
-	gs.listfiles()
 
+	var fullpaths []string
 	for _, f := range args {
 		fullpath, err := filepath.Abs(f)
 		if err != nil {
-			log.Fatalf("couldn't create absolute path for %s: %s", f, err)
+			return fmt.Errorf("gdsnap.AbsPath path=%s: %v", f, err)
 		}
-		if fullpath == (*dirFlag)[:len(*dirFlag)-1] {
+		if fullpath == gs.set.dir[:len(gs.set.dir)-1] {
 			fullpath += "/"
 		}
-		gs.savepath(fullpath, true)
+		fullpaths = append(fullpaths, fullpath)
 	}
+	return joinerrs(gs.saveall(fullpaths, true))
 }
 
-func (gs *gdsnap) decrypt(fi *fileinfo, mime string, content []byte) (string, []byte) {
-	if !strings.HasPrefix(mime, "gdsnap/data") {
-		return mime, content
-	}
-	if len(content) < gs.aead.NonceSize() {
-		log.Printf("gdsnap.ContentTooShortToDecrypt name=%s got=%d want=%d", namePart(fi.Name), len(content), gs.aead.NonceSize())
-		return mime, content
+// decrypt decrypts a fetched content and returns its mimetype without the key suffix.
+func (gs *gdsnap) decrypt(fi *fileinfo, mime string, content []byte) (string, []byte, error) {
+	mime, keyid := mimekey(mime)
+	if !encrypted(mime, gs.set.encryptnames) {
+		return mime, content, nil
 	}
 	// Decrypt and decompress the file.
-	compressed, err := gs.aead.Open(nil, content[:gs.aead.NonceSize()], content[gs.aead.NonceSize():], nil)
+	compressed, err := gs.keys.open(keyid, content)
 	if err != nil {
-		log.Printf("gdsnap.OpenEncryptedContent name=%s: %s", namePart(fi.Name), err)
-		return mime, content
+		return mime, nil, fmt.Errorf("gdsnap.OpenEncryptedContent name=%s: %v", namePart(fi.Name), err)
 	}
 	decompressor := flate.NewReader(bytes.NewBuffer(compressed))
 	if content, err = io.ReadAll(decompressor); err != nil {
-		log.Printf("gdsnap.Decompress name=%s: %s", namePart(fi.Name), err)
-		return mime, content
+		return mime, nil, fmt.Errorf("gdsnap.Decompress name=%s: %v", namePart(fi.Name), err)
 	}
 	if err = decompressor.Close(); err != nil {
-		log.Printf("gdsnap.CloseDecompressor name=%s: %s", namePart(fi.Name), err)
+		return mime, nil, fmt.Errorf("gdsnap.CloseDecompressor name=%s: %v", namePart(fi.Name), err)
 	}
-	return mime, content
+	return mime, content, nil
 }
 
-// revfetch fetches the content at a specific version.
-// the content fetching is skipped if the revision's last modified time equals to skipDate.
-func (gs *gdsnap) revfetch(fi *fileinfo, skipDate string) (mime string, content []byte) {
-	if len(*tFlag) == 0 || fi.ModifiedTime <= *tFlag {
+// revfetch opens the content at a specific version.
+// the content is nil if the file is deleted at that version
+// or if the revision's last modified time equals to skipDate in which case the fetching is skipped.
+// otherwise the caller must close the content.
+// the metadata is nil if the revision has no metadata record.
+func (gs *gdsnap) revfetch(fi *fileinfo, skipDate string) (mime string, meta *metadata, content io.ReadCloser, err error) {
+	if len(*snapshotFlag) > 0 {
+		// the files are from the snapshot's manifest, the HeadRevisionID is the revision at the snapshot.
 		if fi.ModifiedTime == skipDate {
-			return fi.MimeType, nil
-		}
-		getreq, err := http.NewRequest("GET", "https://www.googleapis.com/drive/v3/files/"+fi.ID+"?alt=media", nil)
-		if err != nil {
-			log.Fatal(err)
+			return fi.MimeType, nil, nil, nil
 		}
-		getreq.Header.Set("Authorization", "Bearer "+gs.accesstoken)
-		getresp, err := http.DefaultClient.Do(getreq)
-		if err != nil {
-			log.Fatalf("error fetching contents for %s: %v", namePart(fi.Name), err)
-		}
-		contents, err := io.ReadAll(getresp.Body)
-		if err != nil {
-			log.Fatalf("error reading contents for %s: %v", namePart(fi.Name), err)
-		}
-		return gs.decrypt(fi, fi.MimeType, contents)
+		return gs.fetchrev(fi, fi.HeadRevisionID, fi.MimeType)
 	}
-
-	type revinfo struct {
-		ID           string
-		MimeType     string
-		ModifiedTime string
+	if len(*tFlag) == 0 || fi.ModifiedTime <= *tFlag {
+		if fi.ModifiedTime == skipDate || fi.MimeType == "gdsnap/deleted" {
+			return fi.MimeType, nil, nil, nil
+		}
+		return gs.fetchrev(fi, "", fi.MimeType)
 	}
 
-	q := url.Values{}
-	q.Set("fields", "revisions(originalFilename,id,size,modifiedTime,mimeType)")
-	q.Set("pageSize", "1000")
-	req, err := http.NewRequest("GET", "https://www.googleapis.com/drive/v3/files/"+fi.ID+"/revisions?"+q.Encode(), nil)
-	if err != nil {
-		log.Fatalf("couldn't create request for %s: %v", namePart(fi.Name), err)
-	}
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Authorization", "Bearer "+gs.accesstoken)
-	resp, err := http.DefaultClient.Do(req)
+	at, err := gs.revat(*fi, *tFlag)
 	if err != nil {
-		log.Fatalf("error listing revisions for %s: %v", namePart(fi.Name), err)
+		return "", nil, nil, err
 	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("error reading revisions for %s: %v", namePart(fi.Name), err)
+	if at.ModifiedTime == skipDate || at.MimeType == "gdsnap/deleted" {
+		return at.MimeType, nil, nil, nil
 	}
-	var revisionsResponse struct {
-		Revisions []revinfo
+	return gs.fetchrev(fi, at.HeadRevisionID, at.MimeType)
+}
+
+// revat returns the file as of time t: fi with the ID, mimetype, modification time and size of the revision at t.
+// the mimetype is gdsnap/deleted if the file didn't exist at t.
+func (gs *gdsnap) revat(fi fileinfo, t string) (fileinfo, error) {
+	if fi.ModifiedTime <= t {
+		return fi, nil
 	}
-	if err = json.Unmarshal(body, &revisionsResponse); err != nil {
-		log.Fatalf("couldn't parse revisions response: %v\nbody:\n%s", err, body)
+	revs, err := gs.backend.revisions(&fi)
+	if err != nil {
+		return fileinfo{}, err
 	}
-
 	var ri *revinfo
-	for i, r := range revisionsResponse.Revisions {
-		if r.ModifiedTime > *tFlag {
+	for i, r := range revs {
+		if r.ModifiedTime > t {
 			continue
 		}
 		if ri == nil || r.ModifiedTime > ri.ModifiedTime {
-			ri = &revisionsResponse.Revisions[i]
+			ri = &revs[i]
 		}
 	}
 	if ri == nil {
-		return "gdsnap/deleted", nil
-	}
-	if ri.ModifiedTime == skipDate {
-		return ri.MimeType, nil
-	}
-	getreq, err := http.NewRequest("GET", "https://www.googleapis.com/drive/v3/files/"+fi.ID+"/revisions/"+ri.ID+"?alt=media", nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	getreq.Header.Set("Authorization", "Bearer "+gs.accesstoken)
-	getresp, err := http.DefaultClient.Do(getreq)
-	if err != nil {
-		log.Fatalf("error fetching contents for %s: %v", namePart(fi.Name), err)
-	}
-	contents, err := io.ReadAll(getresp.Body)
-	if err != nil {
-		log.Fatalf("error reading contents for %s: %v", namePart(fi.Name), err)
+		fi.MimeType, fi.HeadRevisionID = "gdsnap/deleted", ""
+		return fi, nil
 	}
-	return gs.decrypt(fi, ri.MimeType, contents)
+	fi.HeadRevisionID, fi.MimeType, fi.ModifiedTime, fi.Size = ri.ID, ri.MimeType, ri.ModifiedTime, ri.Size
+	return fi, nil
 }
 
-func (gs *gdsnap) subcommandCat(args []string) {
-	gs.listfiles()
-	for _, relpath := range filterfiles(gs.files, args) {
-		fi := gs.files[relpath]
-		mime, contents := gs.revfetch(&fi, "")
-		switch mime {
-		case "gdsnap/deleted":
-			fmt.Printf("%s is deleted.", relpath)
-		case "gdsnap/symlink":
-			fmt.Printf("%s is a symlink to %s.", relpath, contents)
-		default:
-			os.Stdout.Write(contents)
-		}
-	}
+// readcloser is a reader that closes the underlying stream it reads from.
+type readcloser struct {
+	io.Reader
+	io.Closer
 }
 
-func (gs *gdsnap) subcommandDiff(args []string) {
-	gs.listfiles()
-	for _, relpath := range filterfiles(gs.files, args) {
-		fi, ok := gs.files[relpath]
-		if !ok {
-			log.Fatalf("%s is not backed up.", relpath)
+// fetchrev downloads and opens a specific revision for reading.
+// the gdsnap/ref revisions are resolved to their target but the metadata is the reference's own.
+// the content of the gdsnap/stream revisions is decrypted as it's read.
+// the returned mimetype is without the key suffix and the "-m" flag,
+// the metadata is nil if the revision has no metadata record.
+func (gs *gdsnap) fetchrev(fi *fileinfo, revid, mime string) (string, *metadata, io.ReadCloser, error) {
+	if err := gs.needkeys(); err != nil {
+		return "", nil, nil, err
+	}
+	if strings.HasPrefix(mime, "gdsnap/ref") {
+		var target contentref
+		var meta *metadata
+		var err error
+		if hasmeta(mime) {
+			target, meta, err = gs.readrefmeta(fi, revid, mime)
+		} else {
+			target, err = gs.resolveref(fi, revid)
 		}
-
-		fullpath, err := filepath.Abs(filepath.Join(*dirFlag, relpath))
-		finfo, err := os.Lstat(fullpath)
 		if err != nil {
-			mime, _ := gs.revfetch(&fi, fi.ModifiedTime)
-			if mime != "gdsnap/deleted" {
-				fmt.Printf("skipping %s because can't stat it: %v.\n", relpath, err)
-			}
-			continue
+			return "", nil, nil, err
 		}
-		const tLayout = "2006-01-02T15:04:05.000Z"
-		fileDate := finfo.ModTime().UTC().Format(tLayout)
-		mime, contents := gs.revfetch(&fi, fileDate)
-		if mime == "gdsnap/deleted" {
-			fmt.Printf("skipping %s because because it's trashed in the archive.\n", relpath)
-			continue
-		}
-		if contents == nil {
-			// revfetch returns nil if the revision's mod time is fileDate.
-			// it means there wasn't any diff so let's further diffing.
-			continue
+		mime, _, rc, err := gs.fetchrev(&fileinfo{ID: target.fileID, Name: fi.Name}, target.revID, target.contentmime(mime))
+		return mime, meta, rc, err
+	}
+	rc, err := gs.backend.fetch(fi, revid)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var content io.Reader
+	var closer io.Closer = rc
+	if strings.HasPrefix(mime, "gdsnap/stream") {
+		var keyid int
+		mime, keyid = mimekey(mime)
+		sr, err := newstreamreader(gs.keys.candidates(keyid), rc)
+		if err != nil {
+			rc.Close()
+			return "", nil, nil, fmt.Errorf("gdsnap.OpenStream name=%s: %v", namePart(fi.Name), err)
 		}
-		filetype := "regular file"
-		if finfo.Mode().Type() == fs.ModeSymlink {
-			filetype = "symlink"
-		} else if !finfo.Mode().IsRegular() {
-			fmt.Printf("skipping %s because it's not a regular file.\n", relpath)
-			continue
+		content = flate.NewReader(sr)
+	} else {
+		contents, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("gdsnap.ReadContents name=%s: %v", namePart(fi.Name), err)
 		}
-
-		backuptype := "regular file"
-		if mime == "gdsnap/symlink" {
-			backuptype = "symlink"
+		if mime, contents, err = gs.decrypt(fi, mime, contents); err != nil {
+			return "", nil, nil, err
 		}
+		content, closer = bytes.NewReader(contents), io.NopCloser(nil)
+	}
+	mime, ok := mimemeta(mime)
+	if !ok {
+		return mime, nil, readcloser{content, closer}, nil
+	}
+	meta, content, err := readmetadata(content)
+	if err != nil {
+		closer.Close()
+		return "", nil, nil, fmt.Errorf("gdsnap.ReadMetadata name=%s: %v", namePart(fi.Name), err)
+	}
+	return mime, meta, readcloser{content, closer}, nil
+}
 
-		if filetype != backuptype {
-			fmt.Printf("%s differs in type: -%s vs +%s.\n", relpath, backuptype, filetype)
-			continue
-		}
+// readrefmeta reads the target and the metadata record of a gdsnap/ref revision with the "-m" flag.
+func (gs *gdsnap) readrefmeta(fi *fileinfo, revid, mime string) (contentref, *metadata, error) {
+	target, record, err := gs.readref(fi, revid)
+	if err != nil {
+		return contentref{}, nil, err
+	}
+	_, keyid := mimekey(mime)
+	compressed, err := gs.keys.open(keyid, record)
+	if err != nil {
+		return contentref{}, nil, fmt.Errorf("gdsnap.OpenReferenceMetadata name=%s: %v", namePart(fi.Name), err)
+	}
+	meta, _, err := readmetadata(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		return contentref{}, nil, fmt.Errorf("gdsnap.ReadMetadata name=%s: %v", namePart(fi.Name), err)
+	}
+	return target, meta, nil
+}
 
-		if backuptype == "symlink" {
-			symlink, err := os.Readlink(fullpath)
-			if err != nil {
-				log.Printf("can't read symlink for %s: %v", relpath, err)
-				continue
-			}
-			strcontents := string(contents)
-			if strcontents != symlink {
-				fmt.Printf("--- archive/%s\n+++ archive/%s\n-%s\n+%s\n", relpath, relpath, strcontents, symlink)
-			}
-			continue
+// fileperm returns the permissions stored in a gdsnap/data, gdsnap/stream, gdsnap/ref or gdsnap/dir mimetype.
+func fileperm(mime string) fs.FileMode {
+	var perm fs.FileMode = 0600
+	for _, format := range []string{"gdsnap/data%o", "gdsnap/stream%o", "gdsnap/ref%o", "gdsnap/dir%o"} {
+		if _, err := fmt.Sscanf(mime, format, &perm); err == nil {
+			break
 		}
-
-		cmd := exec.Command("diff", "-u", "--label=archive/"+relpath, "--label=current/"+relpath, "-", fullpath)
-		cmd.Stdin = bytes.NewReader(contents)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Run()
 	}
+	return perm
 }
 
-func (gs *gdsnap) subcommandRestore(args []string) {
-	if len(args) == 0 {
-		fmt.Println("usage: gdsnap [flags] restore [globs...]")
-		return
+func (gs *gdsnap) subcommandCat(args []string) error {
+	if err := gs.listtree(); err != nil {
+		return err
 	}
-	gs.listfiles()
 	for _, relpath := range filterfiles(gs.files, args) {
-		fullpath, err := filepath.Abs(filepath.Join(*dirFlag, relpath))
-		os.Remove(fullpath)
-		os.MkdirAll(filepath.Dir(fullpath), 0755)
-		fi, ok := gs.files[relpath]
-		if !ok {
-			fmt.Printf("skipping %s because it's not backed up.", relpath)
-			continue
-		}
-		mime, contents := gs.revfetch(&fi, "")
-		if mime == "gdsnap/deleted" {
-			continue
+		fi := gs.files[relpath]
+		mime, _, content, err := gs.revfetch(&fi, "")
+		if err != nil {
+			return err
 		}
-
-		if mime == "gdsnap/symlink" {
-			if err = os.Symlink(string(contents), fullpath); err != nil {
-				log.Printf("couldn't symlink %s: %v", relpath, err)
-				continue
+		switch {
+		case mime == "gdsnap/deleted":
+			fmt.Printf("%s is deleted.", relpath)
+		case strings.HasPrefix(mime, "gdsnap/dir"):
+			content.Close()
+			fmt.Printf("%s is an empty directory.", relpath)
+		case mime == "gdsnap/symlink":
+			symlink, err := io.ReadAll(content)
+			content.Close()
+			if err != nil {
+				return fmt.Errorf("gdsnap.ReadSymlink relpath=%s: %v", relpath, err)
 			}
-		} else {
-			var perm fs.FileMode = 0600
-			fmt.Sscanf(mime, "gdsnap/data%o", &perm)
-			if err = os.WriteFile(fullpath, contents, perm); err != nil {
-				log.Printf("couldn't write %s: %v", relpath, err)
-				continue
+			fmt.Printf("%s is a symlink to %s.", relpath, symlink)
+		default:
+			_, err := io.Copy(os.Stdout, content)
+			content.Close()
+			if err != nil {
+				return fmt.Errorf("gdsnap.Cat relpath=%s: %v", relpath, err)
 			}
 		}
-		log.Printf("successfully restored %s", relpath)
 	}
+	return nil
 }
 
 type quota struct {
 	UsageMB, LimitMB, FreeMB, DriveMB, TrashMB int64
 }
 
-func (gs *gdsnap) getquota() quota {
-	req, err := http.NewRequest("GET", "https://www.googleapis.com/drive/v3/about?fields=storageQuota", nil)
-	if err != nil {
-		log.Fatalf("error creating quota request: %v", err)
-	}
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Authorization", "Bearer "+gs.accesstoken)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Fatalf("failed querying quota data: %v", err)
-	}
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		log.Fatalf("quota request returned error: %s\n%s", resp.Status, body)
-	}
-	body, err := io.ReadAll(resp.Body)
+// checkQuota warns if the quota is running out.
+// the failure to query the quota is just logged, the uploads will fail anyway if there's a real problem.
+func (gs *gdsnap) checkQuota() {
+	q, err := gs.backend.quota()
 	if err != nil {
-		log.Fatalf("failed reading quota data: %v", err)
-	}
-	var about struct {
-		StorageQuota struct {
-			Usage, Limit, UsageInDrive, UsageInDriveTrash string
-		}
-	}
-	if err = json.Unmarshal(body, &about); err != nil {
-		log.Fatalf("couldn't parse quota response: %v, body:\n%s", err, body)
+		log.Printf("couldn't check the quota: %v", err)
+		return
 	}
-	q := quota{}
-	fmt.Sscan(about.StorageQuota.Usage, &q.UsageMB)
-	fmt.Sscan(about.StorageQuota.Limit, &q.LimitMB)
-	fmt.Sscan(about.StorageQuota.UsageInDrive, &q.DriveMB)
-	fmt.Sscan(about.StorageQuota.UsageInDriveTrash, &q.TrashMB)
-	q.FreeMB = (q.LimitMB - q.UsageMB) / 1e6
-	q.LimitMB += 1e6 - 1
-	q.UsageMB += 1e6 - 1
-	q.DriveMB += 1e6 - 1
-	q.TrashMB += 1e6 - 1
-	q.LimitMB /= 1e6
-	q.UsageMB /= 1e6
-	q.DriveMB /= 1e6
-	q.TrashMB /= 1e6
-	return q
-}
-
-func (gs *gdsnap) checkQuota() {
-	q := gs.getquota()
+	gs.stats.setquota(q)
 	if q.FreeMB < 4000 {
 		log.Printf("[warning] remaining quota too low: %d MB.", q.FreeMB)
 		warn()
 	}
 }
 
-func (gs *gdsnap) subcommandQuota(args []string) {
+func (gs *gdsnap) subcommandQuota(args []string) error {
 	if len(args) != 0 {
 		fmt.Println("usage: gdsnap [flags] quota")
 		fmt.Println("no arguments allowed.")
 	}
-	gs.gettoken()
-	q := gs.getquota()
+	q, err := gs.backend.quota()
+	if err != nil {
+		return err
+	}
 	fmt.Printf("limit: %5d MB\nusage: %5d MB\ndrive: %5d MB\ntrash: %5d MB\nfree:  %5d MB\n", q.LimitMB, q.UsageMB, q.DriveMB, q.TrashMB, q.FreeMB)
+	return nil
 }
 
-func (gs *gdsnap) gettoken() {
-	if len(*refreshtokenFlag) == 0 {
-		fmt.Println("missing -refreshtoken flag.")
-		os.Exit(2)
-		return
+// readpassword prompts for a password on stderr and reads it without echo from the terminal.
+// a non-terminal stdin, e.g. a pipe, is read up to the first newline.
+func readpassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
 	}
-
-	now := time.Now()
-	if now.Sub(gs.tokenbirth) < 50*time.Minute {
-		return
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return "", err
 	}
-	gs.tokenbirth = now
+	return strings.TrimSuffix(password, "\n"), nil
+}
 
-	q := url.Values{}
-	q.Set("client_id", oaClientID)
-	q.Set("client_secret", oaSecret)
-	q.Set("refresh_token", *refreshtokenFlag)
-	q.Set("grant_type", "refresh_token")
-	response, err := http.Post("https://oauth2.googleapis.com/token", "application/x-www-form-urlencoded", strings.NewReader(q.Encode()))
+// subcommandRekey switches to a new key and password.
+// it can be rerun to finish the re-encryption in case it fails midway.
+func (gs *gdsnap) subcommandRekey(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("gdsnap.UnexpectedArgs")
+	}
+	password, err := readpassword("enter the new password: ")
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("gdsnap.ReadNewPassword: %v", err)
 	}
-	responseBody, err := io.ReadAll(response.Body)
+	if password == "" {
+		return fmt.Errorf("gdsnap.EmptyPassword")
+	}
+
+	keys, newid := maps.Clone(gs.keys.keys), 0
+	for id := range keys {
+		newid = max(newid, id+1)
+	}
+	if keys[newid], err = newkey(); err != nil {
+		return err
+	}
+	kr, err := newkeyring(keys, newid)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	var r map[string]interface{}
-	if err = json.Unmarshal(responseBody, &r); err != nil {
-		log.Fatal("couldn't acquire access token: ", err)
+	if err := gs.savekeys(keys, newid, password); err != nil {
+		return err
 	}
-	accesstoken, ok := r["access_token"].(string)
-	if !ok {
-		log.Fatalf("couldn't parse access_token from response. run `gdsnap auth`? full response:\n%s", string(responseBody))
+	*gs.keys = *kr
+	log.Printf("switched to key %d, re-encrypting the files.", newid)
+
+	if err := gs.listfiles(); err != nil {
+		return err
+	}
+	var errs []error
+	for _, relpath := range filterfiles(gs.files, nil) {
+		fi := gs.files[relpath]
+		mime, keyid := mimekey(fi.MimeType)
+		_, stream := hascontent(mime)
+		if fi.Trashed || keyid == newid || !encrypted(mime, gs.set.encryptnames) {
+			continue
+		}
+		if err := gs.reencrypt(fi, mime, stream); err != nil {
+			errs = append(errs, fmt.Errorf("gdsnap.Reencrypt relpath=%s: %v", relpath, err))
+			continue
+		}
+		log.Printf("%s re-encrypted.", relpath)
 	}
-	gs.accesstoken = accesstoken
+	return errors.Join(errs...)
 }
 
-func readconfig() {
-	overridden := map[string]bool{}
-	flag.Visit(func(f *flag.Flag) { overridden[f.Name] = true })
+// reencrypt uploads the head revision of a file again encrypted with the current key.
+func (gs *gdsnap) reencrypt(fi fileinfo, mime string, stream bool) error {
+	newfi := fi
+	newfi.MimeType = mime + gs.keys.keysuffix()
+	if strings.HasPrefix(mime, "gdsnap/ref") {
+		// only the metadata record of a reference is encrypted.
+		target, meta, err := gs.readrefmeta(&fi, "", fi.MimeType)
+		if err != nil {
+			return err
+		}
+		header, err := meta.header()
+		if err != nil {
+			return err
+		}
+		record, err := gs.encrypt(header)
+		if err != nil {
+			return err
+		}
+		content := append([]byte(target.String()+"\n"), record...)
+		newfi.Size = strconv.Itoa(len(content))
+		_, err = gs.backend.upload(newfi, bytes.NewReader(content))
+		return err
+	}
+
+	_, meta, content, err := gs.fetchrev(&fi, "", fi.MimeType)
+	if err != nil {
+		return err
+	}
+	var header []byte
+	if meta != nil {
+		if header, err = meta.header(); err != nil {
+			content.Close()
+			return err
+		}
+	}
+	if stream {
+		encrypted := gs.encryptstream(content, header, shasumPart(fi.Name))
+		newfi.Size = ""
+		_, err = gs.backend.upload(newfi, encrypted)
+		encrypted.Close()
+		return err
+	}
+	plaintext, err := io.ReadAll(content)
+	content.Close()
+	if err != nil {
+		return err
+	}
+	encrypted, err := gs.encrypt(append(header, plaintext...))
+	if err != nil {
+		return err
+	}
+	newfi.Size = strconv.Itoa(len(encrypted))
+	_, err = gs.backend.upload(newfi, bytes.NewReader(encrypted))
+	return err
+}
 
+// configlines calls fn for the config lines applying to a profile.
+func configlines(profile string, fn func(cfgfile, flagname, value string) error) error {
 	for _, cfgfile := range []string{".gdsnap", ".config/gdsnap", ".cache/gdsnap"} {
 		contents, err := os.ReadFile(path.Join(os.Getenv("HOME"), cfgfile))
 		if os.IsNotExist(err) {
 			continue
 		}
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("gdsnap.ReadConfig file=%s: %v", cfgfile, err)
 		}
 		for _, line := range strings.Split(string(contents), "\n") {
 			line = strings.TrimSpace(line)
@@ -1225,21 +2063,34 @@ func readconfig() {
 			}
 			var matcher, flagname, value string
 			if _, err := fmt.Sscanf(line, "%s %s %q", &matcher, &flagname, &value); err != nil {
-				log.Fatalf("%s: invalid config line %q", cfgfile, line)
-				continue
+				return fmt.Errorf("gdsnap.InvalidConfigLine file=%s line=%q", cfgfile, line)
 			}
-			if matcher != "*" && matcher != *profileFlag || overridden[flagname] {
+			if matcher != "*" && matcher != profile {
 				continue
 			}
-			f := flag.Lookup(flagname)
-			if f == nil {
-				log.Fatalf("%s: unknown flag %s", cfgfile, flagname)
+			if flag.Lookup(flagname) == nil {
+				return fmt.Errorf("gdsnap.UnknownConfigFlag file=%s flag=%s", cfgfile, flagname)
 			}
-			if err := f.Value.Set(value); err != nil {
-				log.Fatalf("%s: can't set flag %s: %v", cfgfile, flagname, err)
+			if err := fn(cfgfile, flagname, value); err != nil {
+				return err
 			}
 		}
 	}
+	return nil
+}
+
+func readconfig() error {
+	overridden := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { overridden[f.Name] = true })
+	return configlines(*profileFlag, func(cfgfile, flagname, value string) error {
+		if overridden[flagname] {
+			return nil
+		}
+		if err := flag.Lookup(flagname).Value.Set(value); err != nil {
+			return fmt.Errorf("gdsnap.SetConfigFlag file=%s flag=%s: %v", cfgfile, flagname, err)
+		}
+		return nil
+	})
 }
 
 func Run(ctx context.Context) error {
@@ -1256,7 +2107,9 @@ func Run(ctx context.Context) error {
 
 	flag.Usage = usage
 	flag.Parse()
-	readconfig()
+	if err := readconfig(); err != nil {
+		return err
+	}
 
 	subcommand := flag.Arg(0)
 	if len(subcommand) == 0 {
@@ -1270,72 +2123,138 @@ func Run(ctx context.Context) error {
 		}
 	}
 
+	return runsubcommand(subcommand, args)
+}
+
+// parsetime normalizes the -t flag's value to the gdrive timestamp format.
+// it's either a duration relative to now or a prefix of an utc timestamp.
+func parsetime(s string, now time.Time) (string, error) {
+	dur, durErr := time.ParseDuration(s)
+	if durErr == nil {
+		return now.Add(-dur).UTC().Format(tLayout), nil
+	}
+	if len(s) == 4 { // 2022
+		s += "-01"
+	}
+	if len(s) == 7 { // 2022-01
+		s += "-01"
+	}
+	if len(s) == 10 { // 2022-01-01
+		s += "T00"
+	}
+	if len(s) == 13 { // 2022-01-01T00
+		s += ":00"
+	}
+	if len(s) == 16 { // 2022-01-01T00:00
+		s += ":00"
+	}
+	if len(s) == 19 { // 2022-01-01T00:00:00
+		s += ".000"
+	}
+	if len(s) == 23 { // 2022-01-01T00:00:00.000
+		s += "Z"
+	}
+	t, absErr := time.Parse(tLayout, s)
+	if absErr != nil {
+		return "", fmt.Errorf("gdsnap.ParseTime value=%q: can't parse as duration (%v) nor as absolute time (%v)", s, durErr, absErr)
+	}
+	return t.Format(tLayout), nil
+}
+
+// runsubcommand runs a subcommand once the flags are all set up.
+func runsubcommand(subcommand string, args []string) error {
 	if !strings.HasSuffix(*dirFlag, "/") {
 		*dirFlag += "/"
 	}
 
 	if len(*tFlag) > 0 {
-		const tLayout = "2006-01-02T15:04:05.000Z"
-		var t time.Time
-		var absErr error
-		dur, durErr := time.ParseDuration(*tFlag)
-		if durErr == nil {
-			t = time.Now().Add(-dur).UTC()
-		} else {
-			if len(*tFlag) == 4 { // 2022
-				*tFlag += "-01"
-			}
-			if len(*tFlag) == 7 { // 2022-01
-				*tFlag += "-01"
-			}
-			if len(*tFlag) == 10 { // 2022-01-01
-				*tFlag += "T00"
-			}
-			if len(*tFlag) == 13 { // 2022-01-01T00
-				*tFlag += ":00"
-			}
-			if len(*tFlag) == 16 { // 2022-01-01T00:00
-				*tFlag += ":00"
-			}
-			if len(*tFlag) == 19 { // 2022-01-01T00:00:00
-				*tFlag += ".000"
-			}
-			if len(*tFlag) == 23 { // 2022-01-01T00:00:00.000
-				*tFlag += "Z"
-			}
-			t, absErr = time.Parse(tLayout, *tFlag)
+		t, err := parsetime(*tFlag, time.Now())
+		if err != nil {
+			return err
+		}
+		*tFlag = t
+	}
+
+	if len(*snapshotFlag) > 0 {
+		if len(*tFlag) > 0 {
+			return fmt.Errorf("gdsnap.SnapshotWithT (-snapshot and -t are mutually exclusive)")
 		}
-		if durErr != nil && absErr != nil {
-			log.Fatalf("can't parse %q as duration (%v) nor as absolute time (%v)", *tFlag, durErr, absErr)
+		if subcommand != "cat" && subcommand != "diff" && subcommand != "list" && subcommand != "restore" {
+			return fmt.Errorf("gdsnap.SnapshotUnsupported subcommand=%s", subcommand)
 		}
-		*tFlag = t.Format(tLayout)
 	}
 
 	gs := gdsnap{}
-	gs.init()
-
 	switch subcommand {
 	case "auth":
-		gs.subcommandAuth(args)
-	case "cat":
-		gs.subcommandCat(args)
-	case "diff":
-		gs.subcommandDiff(args)
+		return gs.subcommandAuth(args)
 	case "help":
 		usage()
+		return nil
+	case "ctl":
+		return subcommandCtl(args)
+	case "status":
+		return subcommandStatus(args)
+	case "watch":
+		// the sets have their own init.
+		if *setsFlag != "" {
+			return subcommandWatchSets(args)
+		}
+	}
+	if err := gs.initbackend(); err != nil {
+		return err
+	}
+	locked := lockingsubcommands[subcommand] && !(*dryrunFlag && (subcommand == "prune" || subcommand == "restore"))
+	if locked {
+		release, err := gs.acquirelock(subcommand)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	switch {
+	case subcommand == "import" || subcommand == "quota":
+		// import brings its own keys, quota doesn't decrypt.
+	case lazykeysubcommands[subcommand] && !gs.set.encryptnames:
+		// the keys are loaded on the first decryption, see needkeys.
+	default:
+		if err := gs.initkeys(locked); err != nil {
+			return err
+		}
+	}
+
+	switch subcommand {
+	case "cat":
+		return gs.subcommandCat(args)
+	case "diff":
+		return gs.subcommandDiff(args)
+	case "export":
+		return gs.subcommandExport(args)
+	case "import":
+		return gs.subcommandImport(args)
 	case "list":
-		gs.subcommandList(args)
+		return gs.subcommandList(args)
+	case "log":
+		return gs.subcommandLog(args)
+	case "mount":
+		return gs.subcommandMount(args)
+	case "prune":
+		return gs.subcommandPrune(args)
 	case "quota":
-		gs.subcommandQuota(args)
+		return gs.subcommandQuota(args)
+	case "rekey":
+		return gs.subcommandRekey(args)
 	case "restore":
-		gs.subcommandRestore(args)
+		return gs.subcommandRestore(args)
 	case "save":
-		gs.subcommandSave(args)
+		return gs.subcommandSave(args)
+	case "snapshots":
+		return gs.subcommandSnapshots(args)
+	case "verify":
+		return gs.subcommandVerify(args)
 	case "watch":
-		gs.subcommandWatch(args)
+		return gs.subcommandWatch(args)
 	default:
-		log.Fatalf("error: unrecognized subcommand %q.", subcommand)
+		return fmt.Errorf("gdsnap.UnrecognizedSubcommand subcommand=%s", subcommand)
 	}
-
-	return nil
 }
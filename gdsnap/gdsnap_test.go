@@ -0,0 +1,1889 @@
+package gdsnap
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	mrand "math/rand/v2"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ypsu/efftesting"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/unix"
+)
+
+func TestMatchglob(t *testing.T) {
+	et := efftesting.New(t)
+	f := func(pattern string, names ...string) string {
+		var matches []string
+		for _, name := range names {
+			if matchglob(pattern, name) {
+				matches = append(matches, name)
+			}
+		}
+		return strings.Join(matches, " ")
+	}
+	names := []string{"a", "a.txt", "b.txt", "dir/a.txt", "dir/sub/a.txt", ".cache/x", ".cache/y/z"}
+	et.Expect("", f("a.txt", names...), "a.txt")
+	et.Expect("", f("*.txt", names...), "a.txt b.txt")
+	et.Expect("", f("*", names...), "a a.txt b.txt")
+	et.Expect("", f("**", names...), "a a.txt b.txt dir/a.txt dir/sub/a.txt .cache/x .cache/y/z")
+	et.Expect("", f("**.txt", names...), "a.txt b.txt dir/a.txt dir/sub/a.txt")
+	et.Expect("", f("dir/*", names...), "dir/a.txt")
+	et.Expect("", f("dir/**", names...), "dir/a.txt dir/sub/a.txt")
+	et.Expect("", f("dir/**/a.txt", names...), "dir/sub/a.txt")
+	et.Expect("", f(".cache/**", names...), ".cache/x .cache/y/z")
+	et.Expect("", f("a*", names...), "a a.txt")
+	et.Expect("", f("?.txt", names...), "a.txt b.txt")
+	et.Expect("", f("dir?a.txt", names...), "")
+	et.Expect("", f("[ab].txt", names...), "a.txt b.txt")
+	et.Expect("", f("[a-a].txt", names...), "a.txt")
+	et.Expect("", f("[!a].txt", names...), "b.txt")
+	et.Expect("", f("[^a]*", names...), "b.txt")
+	et.Expect("", f("**/[b-z].txt", names...), "")
+	et.Expect("", f("\\a*", names...), "a a.txt")
+	// the backtracking of the stars stays polynomial.
+	et.Expect("", f(strings.Repeat("*a", 30)+"b", strings.Repeat("a", 100)), "")
+	et.Expect("", matchglob(strings.Repeat("**a", 30), strings.Repeat("a/", 50)+"a"), "true")
+	et.Expect("", matchglob(strings.Repeat("**/a*", 30)+"b", strings.Repeat("a/", 50)+"a"), "false")
+	et.Expect("", f("[a", "[a", "a"), "[a")
+	et.Expect("", f("[]a]", "]", "a", "b"), "] a")
+	et.Expect("", f("\\*", "*", "a"), "*")
+}
+
+func TestParsetime(t *testing.T) {
+	et := efftesting.New(t)
+	now := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	f := func(s string) string { return efftesting.Stringify(parsetime(s, now)) }
+	et.Expect("", f("1h"), "2022-03-04T04:06:07.000Z")
+	et.Expect("", f("36h30m"), "2022-03-02T16:36:07.000Z")
+	et.Expect("", f("2021"), "2021-01-01T00:00:00.000Z")
+	et.Expect("", f("2021-05"), "2021-05-01T00:00:00.000Z")
+	et.Expect("", f("2021-05-06"), "2021-05-06T00:00:00.000Z")
+	et.Expect("", f("2021-05-06T07"), "2021-05-06T07:00:00.000Z")
+	et.Expect("", f("2021-05-06T07:08"), "2021-05-06T07:08:00.000Z")
+	et.Expect("", f("2021-05-06T07:08:09"), "2021-05-06T07:08:09.000Z")
+	et.Expect("", f("2021-05-06T07:08:09.123"), "2021-05-06T07:08:09.123Z")
+	et.Expect("", f("yesterday"), "gdsnap.ParseTime value=\"yesterday\": can't parse as duration (time: invalid duration \"yesterday\") nor as absolute time (parsing time \"yesterday\" as \"2006-01-02T15:04:05.000Z\": cannot parse \"yesterday\" as \"2006\")")
+}
+
+func TestRetention(t *testing.T) {
+	et := efftesting.New(t)
+	f := func(s string) string {
+		tiers, err := parseretention(s)
+		if err != nil {
+			return err.Error()
+		}
+		var entries []string
+		for _, tier := range tiers {
+			entries = append(entries, fmt.Sprintf("%v:%v", tier.age, tier.interval))
+		}
+		return strings.Join(entries, ",")
+	}
+	et.Expect("", f("1d:all,7d:1h,1y:1d"), "24h0m0s:0s,168h0m0s:1h0m0s,8760h0m0s:24h0m0s")
+	et.Expect("", f("12h:all,forever:1w"), "12h0m0s:0s,2562047h47m16.854775807s:168h0m0s")
+	et.Expect("", f("1d"), "gdsnap.ParseRetention entry=\"1d\": missing the :")
+	et.Expect("", f("1d:all,1h:all"), "gdsnap.RetentionAgesNotIncreasing entry=\"1h:all\"")
+	et.Expect("", f("1d:0h"), "gdsnap.ParseRetentionInterval entry=\"1d:0h\": <nil>")
+
+	now := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	tiers := efftesting.Must1(parseretention("1h:all,2d:1d"))
+	times := []string{
+		"2022-02-01T00:00:00.000Z", // too old.
+		"2022-03-03T01:00:00.000Z", // same day as the next one.
+		"2022-03-03T02:00:00.000Z",
+		"garbage",
+		"2022-03-04T01:00:00.000Z", // same day as the next one.
+		"2022-03-04T03:00:00.000Z",
+		"2022-03-04T04:30:00.000Z",
+		"2022-03-04T05:00:00.000Z",
+		"2022-01-01T00:00:00.000Z", // the head.
+	}
+	var got []string
+	for i, keep := range retained(times, now, tiers) {
+		if keep {
+			got = append(got, strconv.Itoa(i))
+		}
+	}
+	et.Expect("retained", strings.Join(got, " "), "2 3 5 6 7 8")
+}
+
+func TestUnifieddiff(t *testing.T) {
+	et := efftesting.New(t)
+	f := func(a, b string) string {
+		var out strings.Builder
+		unifieddiff(&out, "a", "b", []byte(a), []byte(b))
+		return out.String()
+	}
+	et.Expect("same", f("x\ny\n", "x\ny\n"), "")
+	et.Expect("two hunks", f("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n", "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n"), `
+		--- a
+		+++ b
+		@@ -1,6 +1,6 @@
+		 1
+		 2
+		-3
+		+three
+		 4
+		 5
+		 6
+		@@ -10,3 +10,4 @@
+		 10
+		 11
+		 12
+		+13
+	`)
+	et.Expect("from empty", f("", "x\n"), `
+		--- a
+		+++ b
+		@@ -0,0 +1 @@
+		+x
+	`)
+	et.Expect("no newline", f("x\ny", "x\ny\n"), `
+		--- a
+		+++ b
+		@@ -1,2 +1,2 @@
+		 x
+		-y
+		\ No newline at end of file
+		+y
+	`)
+	et.Expect("binary", f("\x00", "x"), "Binary files a and b differ\n")
+
+	// the edit scripts of random inputs must turn a into b and be as short as the one from the lcs.
+	rnd := mrand.New(mrand.NewPCG(1, 2))
+	randlines := func() []string {
+		lines := make([]string, rnd.IntN(30))
+		for i := range lines {
+			lines[i] = string(rune('a' + rnd.IntN(4)))
+		}
+		return lines
+	}
+	for range 1000 {
+		a, b := randlines(), randlines()
+		var gota, gotb []string
+		edits := 0
+		for _, op := range linediff(a, b) {
+			if op.op != '+' {
+				gota = append(gota, op.line)
+			}
+			if op.op != '-' {
+				gotb = append(gotb, op.line)
+			}
+			if op.op != ' ' {
+				edits++
+			}
+		}
+		lcs := make([][]int, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		if !slices.Equal(gota, a) || !slices.Equal(gotb, b) || edits != len(a)+len(b)-2*lcs[0][0] {
+			t.Fatalf("bad edit script for a=%q b=%q: got a=%q b=%q with %d edits, want %d edits", a, b, gota, gotb, edits, len(a)+len(b)-2*lcs[0][0])
+		}
+	}
+}
+
+// testenv is a scratch directory that is backed up either into a fake gdrive or into a local directory.
+type testenv struct {
+	t   *testing.T
+	dir string
+	fd  *fakedrive
+}
+
+func newtestenv(t *testing.T, backend string) *testenv {
+	te := &testenv{t: t, dir: t.TempDir(), fd: newfakedrive()}
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Cleanup(te.fd.close)
+	efftesting.Override(&driveURL, te.fd.srv.URL)
+	efftesting.Override(&tokenURL, te.fd.srv.URL+"/token")
+	gdir := "testgdir"
+	if backend == "local" {
+		gdir = t.TempDir()
+	}
+	for _, kv := range [][2]string{{"backend", backend}, {"dir", te.dir + "/"}, {"gdir", gdir}, {"profile", "testprofile"}, {"refreshtoken", "testtoken"}, {"password", "testpassword"}} {
+		setflag(t, kv[0], kv[1])
+	}
+	return te
+}
+
+// setflag sets a flag for the duration of the test.
+func setflag(t *testing.T, name, value string) {
+	f := flag.Lookup(name)
+	old := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatalf("couldn't set -%s: %v", name, err)
+	}
+	t.Cleanup(func() { f.Value.Set(old) })
+}
+
+// write creates a file in the test directory with a specific modification time.
+func (te *testenv) write(relpath, content, mtime string) {
+	te.t.Helper()
+	abspath := filepath.Join(te.dir, relpath)
+	efftesting.Must(os.MkdirAll(filepath.Dir(abspath), 0755))
+	efftesting.Must(os.WriteFile(abspath, []byte(content), 0644))
+	t := efftesting.Must1(time.Parse(tLayout, mtime))
+	efftesting.Must(os.Chtimes(abspath, t, t))
+}
+
+func (te *testenv) read(relpath string) string {
+	content, err := os.ReadFile(filepath.Join(te.dir, relpath))
+	if err != nil {
+		return err.Error()
+	}
+	return string(content)
+}
+
+// run runs a gdsnap command and returns its stdout.
+// the leading args starting with - are flags, they remain set for the rest of the test except -t.
+func (te *testenv) run(args ...string) string {
+	te.t.Helper()
+	stdout, err := te.runerr(args...)
+	efftesting.Must(err)
+	return stdout
+}
+
+// runerr is run for the commands that might fail.
+func (te *testenv) runerr(args ...string) (string, error) {
+	te.t.Helper()
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		name, value, _ := strings.Cut(args[0][1:], "=")
+		setflag(te.t, name, value)
+		args = args[1:]
+	}
+	out, err := te.capture(func() error { return runsubcommand(args[0], args[1:]) })
+	// runsubcommand resolves -t in place, the tests of the daemons rely on not writing the flags otherwise.
+	if *tFlag != "" {
+		setflag(te.t, "t", "")
+	}
+	return out, err
+}
+
+// capture returns the standard output of fn.
+func (te *testenv) capture(fn func() error) (string, error) {
+	te.t.Helper()
+	stdout := efftesting.Must1(os.CreateTemp(te.t.TempDir(), "stdout"))
+	origstdout := os.Stdout
+	os.Stdout = stdout
+	err := fn()
+	os.Stdout = origstdout
+	stdout.Close()
+	return string(efftesting.Must1(os.ReadFile(stdout.Name()))), err
+}
+
+// stdin sets the content of the standard input for the duration of the test.
+func (te *testenv) stdin(content string) {
+	te.t.Helper()
+	f := efftesting.Must1(os.CreateTemp(te.t.TempDir(), "stdin"))
+	efftesting.Must1(f.WriteString(content))
+	efftesting.Must1(f.Seek(0, 0))
+	origstdin := os.Stdin
+	os.Stdin = f
+	te.t.Cleanup(func() {
+		os.Stdin = origstdin
+		f.Close()
+	})
+}
+
+// cycle runs a watch cycle for the given touched files.
+func (te *testenv) cycle(relpaths ...string) {
+	te.t.Helper()
+	gs := gdsnap{}
+	efftesting.Must(gs.initbackend())
+	efftesting.Must(gs.initkeys(true))
+	touched := map[string]bool{}
+	for _, relpath := range relpaths {
+		touched[filepath.Join(te.dir, relpath)] = true
+	}
+	efftesting.Must(gs.cycle(touched))
+	if len(touched) != 0 {
+		te.t.Fatalf("some files failed to back up: %v", touched)
+	}
+}
+
+func TestEndToEnd(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			te.fd.pagesize = 2
+
+			te.write("a.txt", "v1\n", "2020-01-01T00:00:00.000Z")
+			te.write("sub/b.txt", "b\n", "2020-01-01T00:00:00.000Z")
+			te.write("sub/deep/c.txt", "c\n", "2020-01-01T00:00:00.000Z")
+			efftesting.Must(os.Symlink("a.txt", filepath.Join(te.dir, "link")))
+			et.Expect("save", te.run("save", te.dir), "")
+			et.Expect("cat", te.run("cat", "a.txt", "sub/**"), `
+				v1
+				b
+				c
+			`)
+			et.Expect("cat symlink", te.run("cat", "link"), "link is a symlink to a.txt.")
+
+			// modify and delete files, then run a watch cycle.
+			te.write("a.txt", "v2\n", "2021-01-01T00:00:00.000Z")
+			efftesting.Must(os.Remove(filepath.Join(te.dir, "sub/b.txt")))
+			te.cycle("a.txt", "sub/b.txt")
+			et.Expect("cat head", te.run("cat", "a.txt", "sub/b.txt"), "v2\nsub/b.txt is deleted.")
+			et.Expect("cat old", te.run("-t=2020-06", "cat", "a.txt", "sub/b.txt"), "v1\nb\n")
+			et.Expect("cat before creation", te.run("-t=2019", "cat", "a.txt"), "a.txt is deleted.")
+
+			// a deleted directory is noticed through the files under it.
+			efftesting.Must(os.RemoveAll(filepath.Join(te.dir, "sub")))
+			te.cycle("sub")
+			et.Expect("cat deleted dir", te.run("cat", "sub/**"), "sub/b.txt is deleted.sub/deep/c.txt is deleted.")
+
+			// the initial scan of watch notices the changes made while the daemon wasn't running.
+			te.write("a.txt", "v3\n", "2022-01-01T00:00:00.000Z")
+			te.write("new.txt", "new\n", "2022-01-01T00:00:00.000Z")
+			efftesting.Must(os.Remove(filepath.Join(te.dir, "link")))
+			beforescan := time.Now().UTC().Format(tLayout)
+			gs := gdsnap{}
+			efftesting.Must(gs.init())
+			efftesting.Must(gs.initialscan(map[string]bool{}))
+			et.Expect("cat after initial scan", te.run("cat", "a.txt", "link", "new.txt"), "v3\nlink is deleted.new\n")
+
+			te.write("a.txt", "v4\n", "2023-01-01T00:00:00.000Z")
+			et.Expect("diff", te.run("diff"), `
+				--- archive/a.txt
+				+++ current/a.txt
+				@@ -1 +1 @@
+				-v3
+				+v4
+			`)
+			et.Expect("diff old", te.run("-t=2020-06", "diff", "a.txt"), `
+				--- archive/a.txt
+				+++ current/a.txt
+				@@ -1 +1 @@
+				-v1
+				+v4
+			`)
+
+			// a.txt has the unsaved v4 from the diff test.
+			et.Expect("restore old", te.run("-t=2020-06", "-force=true", "restore", "a.txt", "sub/**"), "")
+			et.Expect("restored a.txt", te.read("a.txt"), "v1\n")
+			et.Expect("restored b.txt", te.read("sub/b.txt"), "b\n")
+			et.Expect("restored c.txt", te.read("sub/deep/c.txt"), "c\n")
+			te.run("restore", "link")
+			_, err := os.Lstat(filepath.Join(te.dir, "link"))
+			et.Expect("restored link is gone", os.IsNotExist(err), "true")
+			te.run("-t="+beforescan, "restore", "link")
+			et.Expect("restored link", efftesting.Stringify(os.Readlink(filepath.Join(te.dir, "link"))), "a.txt")
+
+			// an interrupted upload leaves a file directory without info.json in the local backup.
+			if backend == "local" {
+				efftesting.Must(os.MkdirAll(filepath.Join(flag.Lookup("gdir").Value.String(), "testprofile", "interrupted"), 0700))
+				et.Expect("interrupted upload", te.run("cat", "a.txt"), "v3\n")
+			}
+		})
+	}
+}
+
+// mimes returns the head mimetypes of the backed up files.
+func (te *testenv) mimes(relpaths ...string) string {
+	te.t.Helper()
+	gs := gdsnap{}
+	efftesting.Must(gs.init())
+	efftesting.Must(gs.listfiles())
+	var mimes []string
+	for _, relpath := range relpaths {
+		mimes = append(mimes, gs.files[relpath].MimeType)
+	}
+	return strings.Join(mimes, " ")
+}
+
+func TestDedup(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			te.write("a.txt", "hello\n", "2020-01-01T00:00:00.000Z")
+			te.run("save", te.dir)
+
+			// a copy is a reference.
+			te.write("b.txt", "hello\n", "2020-02-01T00:00:00.000Z")
+			efftesting.Must(os.Chmod(filepath.Join(te.dir, "b.txt"), 0600))
+			te.cycle("b.txt")
+			et.Expect("copy", te.mimes("a.txt", "b.txt"), "gdsnap/data644-m-k1 gdsnap/ref600-m-k1")
+
+			// a move is a reference too and the referenced file stays out of the trash.
+			efftesting.Must(os.Rename(filepath.Join(te.dir, "a.txt"), filepath.Join(te.dir, "c.txt")))
+			te.cycle("a.txt", "c.txt")
+			et.Expect("move", te.mimes("a.txt", "c.txt"), "gdsnap/deleted gdsnap/ref644-m-k1")
+			et.Expect("cat", te.run("cat", "a.txt", "b.txt", "c.txt"), "a.txt is deleted.hello\nhello\n")
+			if backend == "drive" {
+				var trashed, kept []string
+				for _, f := range te.fd.files {
+					if f.Trashed {
+						trashed = append(trashed, namePart(f.Name))
+					}
+					for _, rev := range f.Revisions {
+						if rev.KeepForever {
+							kept = append(kept, namePart(rev.Name))
+						}
+					}
+				}
+				// the snapshots keep their revisions too.
+				slices.Sort(kept)
+				et.Expect("trashed", strings.Join(trashed, " "), "")
+				et.Expect("kept", strings.Join(kept, " "), "a.txt b.txt c.txt")
+			}
+
+			// reverts are references to the earlier revisions.
+			te.write("b.txt", "other\n", "2020-03-01T00:00:00.000Z")
+			te.cycle("b.txt")
+			te.write("b.txt", "hello\n", "2020-04-01T00:00:00.000Z")
+			te.cycle("b.txt")
+			te.write("d.txt", "d1\n", "2020-01-01T00:00:00.000Z")
+			te.cycle("d.txt")
+			te.write("d.txt", "d2\n", "2020-02-01T00:00:00.000Z")
+			te.cycle("d.txt")
+			te.write("d.txt", "d1\n", "2020-03-01T00:00:00.000Z")
+			te.cycle("d.txt")
+			et.Expect("revert", te.mimes("b.txt", "d.txt"), "gdsnap/ref600-m-k1 gdsnap/ref644-m-k1")
+			et.Expect("cat revert", te.run("cat", "b.txt", "d.txt"), "hello\nd1\n")
+			et.Expect("cat old", te.run("-t=2020-02-15", "cat", "b.txt", "d.txt"), "hello\nd2\n")
+
+			// restore resolves the references and keeps the permissions.
+			efftesting.Must(os.Remove(filepath.Join(te.dir, "b.txt")))
+			te.run("restore", "b.txt")
+			et.Expect("restored", te.read("b.txt"), "hello\n")
+			st := efftesting.Must1(os.Stat(filepath.Join(te.dir, "b.txt")))
+			et.Expect("restored perm", st.Mode().Perm().String(), "-rw-------")
+
+			// a deleted file stays out of the trash while an older revision of a reference points at it.
+			te.write("e.txt", "e\n", "2020-01-01T00:00:00.000Z")
+			te.cycle("e.txt")
+			te.write("f.txt", "e\n", "2020-02-01T00:00:00.000Z")
+			te.cycle("f.txt")
+			te.write("f.txt", "f\n", "2020-03-01T00:00:00.000Z")
+			te.cycle("f.txt")
+			efftesting.Must(os.Remove(filepath.Join(te.dir, "e.txt")))
+			te.cycle("e.txt")
+			et.Expect("deleted target", te.mimes("e.txt", "f.txt"), "gdsnap/deleted gdsnap/data644-m-k1")
+			if backend == "drive" {
+				var trashed []string
+				for _, f := range te.fd.files {
+					if f.Trashed {
+						trashed = append(trashed, namePart(f.Name))
+					}
+				}
+				et.Expect("deleted target trashed", strings.Join(trashed, " "), "")
+			}
+			te.run("-t=2020-02-15", "restore", "f.txt")
+			et.Expect("restored old reference", te.read("f.txt"), "e\n")
+		})
+	}
+}
+
+func TestEncryptNames(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			setflag(t, "encryptnames", "true")
+			te.write("secret/a.txt", "v1\n", "2020-01-01T00:00:00.000Z")
+			te.write("secret/copy.txt", "v1\n", "2020-01-01T00:00:00.000Z")
+			efftesting.Must(os.Symlink("secret/a.txt", filepath.Join(te.dir, "link")))
+			// the files are saved concurrently so save a.txt first to have its copy saved as the reference.
+			te.run("save", filepath.Join(te.dir, "secret/a.txt"))
+			te.run("save", te.dir)
+			saved := time.Now().UTC().Format(tLayout)
+			te.write("secret/a.txt", "v2\n", "2021-01-01T00:00:00.000Z")
+			efftesting.Must(os.Remove(filepath.Join(te.dir, "link")))
+			te.cycle("secret/a.txt", "link")
+
+			et.Expect("cat", te.run("cat", "secret/*"), "v2\nv1\n")
+			et.Expect("cat old", te.run("-t=2020-06", "cat", "secret/*"), "v1\nv1\n")
+			et.Expect("cat old link", te.run("-t="+saved, "cat", "link"), "link is a symlink to secret/a.txt.")
+			et.Expect("mimes", te.mimes("link", "secret/a.txt", "secret/copy.txt"), "gdsnap/deleted gdsnap/data644-m-k1 gdsnap/ref644-m-k1")
+
+			// neither the names, nor the mimetypes, nor the symlink targets are visible in the backup.
+			var stored []string
+			if backend == "drive" {
+				for _, f := range te.fd.files {
+					stored = append(stored, f.Name)
+					for _, rev := range f.Revisions {
+						stored = append(stored, rev.Name, rev.MimeType, string(rev.Content))
+					}
+				}
+			} else {
+				filepath.WalkDir(*gdirFlag, func(path string, d os.DirEntry, err error) error {
+					if err == nil && !d.IsDir() {
+						stored = append(stored, string(efftesting.Must1(os.ReadFile(path))))
+					}
+					return nil
+				})
+			}
+			// neither are they in the state cache.
+			for _, name := range efftesting.Must1(filepath.Glob(filepath.Join(os.Getenv("XDG_CACHE_HOME"), "gdsnapstate", "*"))) {
+				stored = append(stored, string(efftesting.Must1(os.ReadFile(name))))
+			}
+			all := strings.Join(stored, "\n")
+			et.Expect("leaks", strings.Contains(all, "secret") || strings.Contains(all, "a.txt") || strings.Contains(all, "gdsnap/data"), "false")
+			et.Expect("encrypted mimes", strings.Contains(all, "gdsnap/enc"), "true")
+
+			// the backup is unreadable without -encryptnames.
+			setflag(t, "encryptnames", "false")
+			gs := gdsnap{}
+			efftesting.Must(gs.init())
+			efftesting.Must(gs.listfiles())
+			_, plain := gs.files["secret/a.txt"]
+			et.Expect("plain listing", plain, "false")
+
+			// an export keeps the names encrypted in the imported backup too.
+			setflag(t, "encryptnames", "true")
+			archive := filepath.Join(t.TempDir(), "backup.gdsnap")
+			te.run("export", archive)
+			te.run("-backend=local", "-gdir="+t.TempDir(), "import", archive)
+			et.Expect("imported", te.run("cat", "secret/*"), "v2\nv1\n")
+			et.Expect("imported old link", te.run("-t="+saved, "cat", "link"), "link is a symlink to secret/a.txt.")
+			et.Expect("imported mimes", te.mimes("link", "secret/a.txt", "secret/copy.txt"), "gdsnap/deleted gdsnap/data644-m-k1 gdsnap/ref644-m-k1")
+		})
+	}
+}
+
+func TestRekey(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			setflag(t, "sizelimitmb", "1")
+
+			// a backup from before the key header existed.
+			te.write("a.txt", "v1\n", "2020-01-01T00:00:00.000Z")
+			legacy := gdsnap{files: map[string]fileinfo{}, content: map[string]contentref{}, refs: map[contentref]contentref{}, set: flagset(), ignore: newignorer(te.dir+"/", nil)}
+			legacy.inflight, legacy.slots, legacy.stats = map[string]chan struct{}{}, make(chan struct{}, 1), &stats{}
+			legacy.opts = options{cycledur: *cycledurFlag, sizelimitmb: *sizelimitmbFlag}
+			legacy.backend = efftesting.Must1(newbackend(legacy.set, &accesstoken{}))
+			legacy.keys = efftesting.Must1(newkeyring(map[int][]byte{0: legacykey("testpassword")}, 0))
+			efftesting.Must(legacy.savepath(filepath.Join(te.dir, "a.txt"), false))
+			_, err := te.runerr("cat", "a.txt")
+			et.Expect("legacy cat without header", err, "gdsnap.MissingKeyHeader (the backup has no key header, check -gdir and -profile or run save first)")
+			// the subcommands that don't decrypt work without the header.
+			for _, subcommand := range []string{"list", "log", "quota", "snapshots"} {
+				_, err := te.runerr(subcommand)
+				et.Expect("legacy "+subcommand+" without header", err, "null")
+			}
+			et.Expect("legacy save", te.run("save", te.dir), "")
+			et.Expect("legacy cat", te.run("cat", "a.txt"), "v1\n")
+			et.Expect("legacy mimes", te.mimes("a.txt"), "gdsnap/data644-m")
+
+			big := make([]byte, 1500000)
+			rand.Read(big)
+			te.write("a.txt", "v2\n", "2021-01-01T00:00:00.000Z")
+			te.write("big", string(big), "2021-01-01T00:00:00.000Z")
+			te.write("copy", "v2\n", "2022-01-01T00:00:00.000Z")
+			te.run("save", filepath.Join(te.dir, "a.txt"))
+			te.run("save", te.dir)
+			et.Expect("mimes", te.mimes("a.txt", "big", "copy"), "gdsnap/data644-m-k1 gdsnap/stream644-m-k1 gdsnap/ref644-m-k1")
+
+			te.stdin("newpassword\n")
+			te.run("rekey")
+			setflag(t, "password", "newpassword")
+			et.Expect("rekeyed mimes", te.mimes("a.txt", "big", "copy"), "gdsnap/data644-m-k2 gdsnap/stream644-m-k2 gdsnap/ref644-m-k2")
+			stage := t.TempDir()
+			te.run("-stagedir="+stage, "restore", "copy")
+			et.Expect("rekeyed ref", efftesting.Must1(os.Stat(filepath.Join(stage, "copy"))).ModTime().UTC().Format(tLayout), "2022-01-01T00:00:00.000Z")
+			setflag(t, "stagedir", "")
+			et.Expect("rekeyed cat", te.run("cat", "a.txt"), "v2\n")
+			et.Expect("rekeyed big", bytes.Equal([]byte(te.run("cat", "big")), big), "true")
+			et.Expect("old revision", te.run("-t=2020-06", "cat", "a.txt"), "v1\n")
+
+			setflag(t, "password", "testpassword")
+			et.Expect("old password", runsubcommand("cat", []string{"a.txt"}), "gdsnap.WrongPassword: chacha20poly1305: message authentication failed")
+		})
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			te.write("a.txt", "v1\n", "2020-01-01T00:00:00.000Z")
+			te.write("b.txt", "b\n", "2020-01-01T00:00:00.000Z")
+			te.cycle("a.txt", "b.txt")
+			time.Sleep(2 * time.Millisecond)
+			te.write("a.txt", "v2\n", "2021-01-01T00:00:00.000Z")
+			te.write("c.txt", "c\n", "2021-01-01T00:00:00.000Z")
+			efftesting.Must(os.Remove(filepath.Join(te.dir, "b.txt")))
+			te.cycle("a.txt", "b.txt", "c.txt")
+
+			ids := strings.Fields(te.run("snapshots"))
+			et.Expect("snapshots", len(ids), "2")
+			et.Expect("first", te.run("-snapshot="+ids[0], "cat", "*"), "v1\nb\n")
+			et.Expect("second", te.run("-snapshot="+ids[1], "cat", "*"), "v2\nc\n")
+			et.Expect("by time", te.run("-snapshot=0s", "cat", "c.txt"), "c\n")
+
+			// the snapshots' revisions are protected from gdrive's pruning, the local backend never prunes.
+			if backend == "drive" {
+				gs := gdsnap{}
+				efftesting.Must(gs.init())
+				var kept []string
+				for _, id := range ids {
+					files := efftesting.Must1(gs.readsnapshot(id))
+					for _, relpath := range slices.Sorted(maps.Keys(files)) {
+						fi := files[relpath]
+						for _, r := range efftesting.Must1(gs.backend.revisions(&fi)) {
+							if r.ID == fi.HeadRevisionID {
+								kept = append(kept, relpath+"="+strconv.FormatBool(r.KeepForever))
+							}
+						}
+					}
+				}
+				et.Expect("kept", strings.Join(kept, " "), "a.txt=true b.txt=true a.txt=true c.txt=true")
+			}
+
+			// the deleted file can be restored from the snapshot.
+			te.run("-snapshot="+ids[0], "restore", "*")
+			et.Expect("restored", te.read("a.txt")+te.read("b.txt"), "v1\nb\n")
+			et.Expect("save", runsubcommand("save", []string{te.dir}), "gdsnap.SnapshotUnsupported subcommand=save")
+		})
+	}
+}
+
+func TestLog(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			te.write("a.txt", "v1\n", "2020-01-01T00:00:00.000Z")
+			te.write("b.txt", "b\n", "2020-02-01T00:00:00.000Z")
+			te.cycle("a.txt", "b.txt")
+			te.write("a.txt", "v2\n", "2021-01-01T00:00:00.000Z")
+			efftesting.Must(os.Symlink("a.txt", filepath.Join(te.dir, "link")))
+			mtime := unix.NsecToTimeval(efftesting.Must1(time.Parse(tLayout, "2021-02-01T00:00:00.000Z")).UnixNano())
+			efftesting.Must(unix.Lutimes(filepath.Join(te.dir, "link"), []unix.Timeval{mtime, mtime}))
+			te.cycle("a.txt", "link")
+			time.Sleep(2 * time.Millisecond)
+			efftesting.Must(os.Remove(filepath.Join(te.dir, "b.txt")))
+			te.cycle("b.txt")
+			te.write("b.txt", "b2\n", "2099-01-01T00:00:00.000Z")
+			te.cycle("b.txt")
+
+			// the sizes are the stored ones which depend on the metadata record, drop them.
+			nosize := func(out string) string {
+				var lines []string
+				for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+					f := strings.Fields(line)
+					if len(f) == 4 && f[0] > "2022" && f[0] < "2099" {
+						f[0] = "now"
+					}
+					lines = append(lines, strings.Join(slices.Delete(f, 2, 3), " "))
+				}
+				return strings.Join(lines, "\n")
+			}
+			et.Expect("all", nosize(te.run("log")), `
+2020-01-01T00:00:00.000Z created a.txt
+2020-02-01T00:00:00.000Z created b.txt
+2021-01-01T00:00:00.000Z modified a.txt
+2021-02-01T00:00:00.000Z symlink link
+now deleted b.txt
+2099-01-01T00:00:00.000Z created b.txt`)
+			et.Expect("range", nosize(te.run("-since=2021", "-until=2021-01-31", "log")), "2021-01-01T00:00:00.000Z modified a.txt")
+			et.Expect("glob", nosize(te.run("-since=", "-until=", "log", "b*")), `
+2020-02-01T00:00:00.000Z created b.txt
+now deleted b.txt
+2099-01-01T00:00:00.000Z created b.txt`)
+
+			var e logentry
+			efftesting.Must(json.Unmarshal([]byte(te.run("-json=true", "log", "link")), &e))
+			et.Expect("json", fmt.Sprintf("%s %s %s %s %t", e.Time, e.Path, e.Kind, e.MimeType[:14], e.Size > 0 && e.Revision != ""), "2021-02-01T00:00:00.000Z link symlink gdsnap/symlink true")
+			_, err := te.runerr("-since=yesterday", "log")
+			et.Expect("bad since", err != nil, "true")
+		})
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			setflag(t, "ignore", "cache/**")
+			te.write(".gdsnapignore", "# comment\n*.log\n!keep.log\nbuild/\n/top.txt\ndocs/**/*.tmp\n\\#hash\n", "2020-01-01T00:00:00.000Z")
+			te.write("sub/.gdsnapignore", "!*.log\nsecret\n", "2020-01-01T00:00:00.000Z")
+			for _, relpath := range []string{
+				"a.txt", "a.log", "keep.log", "#hash", "build/out", "sub/build", "top.txt", "sub/top.txt",
+				"docs/x.tmp", "docs/d/y.tmp", "docs/z.txt", "sub/x.log", "sub/secret", "other/secret", "cache/c",
+			} {
+				te.write(relpath, relpath+"\n", "2020-01-01T00:00:00.000Z")
+			}
+			saved := func() string {
+				gs := gdsnap{}
+				efftesting.Must(gs.init())
+				efftesting.Must(gs.listfiles())
+				var live []string
+				for _, relpath := range filterfiles(gs.files, nil) {
+					if !gs.files[relpath].Trashed {
+						live = append(live, relpath)
+					}
+				}
+				return strings.Join(live, " ")
+			}
+			te.run("save", te.dir)
+			et.Expect("saved", saved(), ".gdsnapignore a.txt docs/z.txt keep.log other/secret sub/.gdsnapignore sub/build sub/top.txt sub/x.log")
+
+			// a changed rule takes effect for the other files of the same cycle.
+			te.write(".gdsnapignore", "a.txt\n", "2021-01-01T00:00:00.000Z")
+			te.write("a.txt", "a2\n", "2021-01-01T00:00:00.000Z")
+			te.write("a.log", "log2\n", "2021-01-01T00:00:00.000Z")
+			te.cycle(".gdsnapignore", "a.txt", "a.log")
+			et.Expect("changed rules", saved(), ".gdsnapignore a.log docs/z.txt keep.log other/secret sub/.gdsnapignore sub/build sub/top.txt sub/x.log")
+
+			// the globs of the arguments support the same syntax, ! excludes.
+			et.Expect("globs", te.run("cat", "**", "!**.log", "![.]*", "!sub/.*", "!a.txt"), "docs/z.txt\nother/secret\nsub/build\nsub/top.txt\n")
+		})
+	}
+}
+
+func TestMount(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			setflag(t, "sizelimitmb", "1")
+			te.write("a.txt", "v1\n", "2020-01-01T00:00:00.000Z")
+			te.cycle("a.txt")
+			time.Sleep(2 * time.Millisecond)
+			big := make([]byte, 1500000)
+			rand.Read(big)
+			te.write("a.txt", "v2\n", "2021-01-01T00:00:00.000Z")
+			te.write("sub/big", string(big), "2021-01-01T00:00:00.000Z")
+			te.write("sub/copy", "v2\n", "2021-01-01T00:00:00.000Z")
+			efftesting.Must(os.Symlink("../a.txt", filepath.Join(te.dir, "sub/link")))
+			efftesting.Must(os.Mkdir(filepath.Join(te.dir, "empty"), 0755))
+			te.cycle("a.txt")
+			te.cycle("sub", "empty")
+
+			gs := gdsnap{}
+			efftesting.Must(gs.init())
+			mnt := t.TempDir()
+			server, err := gs.mount(mnt)
+			if err != nil {
+				t.Skipf("can't mount fuse here: %v", err)
+			}
+			t.Cleanup(func() { server.Unmount() })
+			read := func(relpath string) string {
+				content, err := os.ReadFile(filepath.Join(mnt, relpath))
+				if err != nil {
+					return err.Error()
+				}
+				return string(content)
+			}
+			ls := func(relpath string) string {
+				var names []string
+				for _, e := range efftesting.Must1(os.ReadDir(filepath.Join(mnt, relpath))) {
+					names = append(names, e.Name())
+				}
+				return strings.Join(names, " ")
+			}
+
+			et.Expect("root", ls(""), "by-time head snapshots")
+			et.Expect("head", ls("head"), "a.txt empty sub")
+			et.Expect("head a.txt", read("head/a.txt"), "v2\n")
+			et.Expect("head copy", read("head/sub/copy"), "v2\n")
+			et.Expect("head big", read("head/sub/big") == string(big), "true")
+			et.Expect("head link", efftesting.Must1(os.Readlink(filepath.Join(mnt, "head/sub/link"))), "../a.txt")
+			et.Expect("head link target", read("head/sub/link"), "v2\n")
+			finfo := efftesting.Must1(os.Stat(filepath.Join(mnt, "head/a.txt")))
+			et.Expect("head attr", fmt.Sprintf("%s %d %s", finfo.Mode(), finfo.Size(), finfo.ModTime().UTC().Format(tLayout)), "-r--r--r-- 3 2021-01-01T00:00:00.000Z")
+			et.Expect("read-only", os.WriteFile(filepath.Join(mnt, "head/a.txt"), nil, 0644) != nil, "true")
+
+			ids := strings.Fields(te.run("snapshots"))
+			et.Expect("snapshots", ls("snapshots") == strings.Join(ids, " "), "true")
+			et.Expect("first snapshot", ls("snapshots/"+ids[0]), "a.txt")
+			et.Expect("first snapshot a.txt", read("snapshots/"+ids[0]+"/a.txt"), "v1\n")
+
+			et.Expect("by-time", ls("by-time"), "")
+			et.Expect("by-time 2020", ls("by-time/2020-06"), "a.txt")
+			et.Expect("by-time 2020 a.txt", read("by-time/2020-06/a.txt"), "v1\n")
+			et.Expect("by-time now", ls("by-time/0s"), "a.txt empty sub")
+			_, err = os.Stat(filepath.Join(mnt, "by-time/yesterday"))
+			et.Expect("by-time invalid", os.IsNotExist(err), "true")
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			te.write("a.txt", "1\n2\n3\n", "2020-01-01T00:00:00.000Z")
+			te.write("b.txt", "b\n", "2020-01-01T00:00:00.000Z")
+			te.cycle("a.txt", "b.txt")
+			time.Sleep(2 * time.Millisecond)
+			te.write("a.txt", "1\ntwo\n3\n", "2021-01-01T00:00:00.000Z")
+			te.write("c.txt", "c\n", "2021-01-01T00:00:00.000Z")
+			efftesting.Must(os.Remove(filepath.Join(te.dir, "b.txt")))
+			te.cycle("a.txt", "b.txt", "c.txt")
+			ids := strings.Fields(te.run("snapshots"))
+
+			et.Expect("times", te.run("-from=2020-06", "-to=2021-06", "diff"), `
+				--- from/a.txt
+				+++ to/a.txt
+				@@ -1,3 +1,3 @@
+				 1
+				-2
+				+two
+				 3
+				--- /dev/null
+				+++ to/c.txt
+				@@ -0,0 +1 @@
+				+c
+			`)
+			et.Expect("snapshots", te.run("-from=snapshot:"+ids[0], "-to=snapshot:"+ids[1], "-summary=true", "diff"), `
+				modified a.txt
+				removed b.txt
+				added c.txt
+			`)
+			// -from and -to stay set from the previous run.
+			et.Expect("glob", te.run("-summary=false", "diff", "b.txt"), `
+				--- from/b.txt
+				+++ /dev/null
+				@@ -1 +0,0 @@
+				-b
+			`)
+
+			// without -to the new side is the disk.
+			te.write("d.txt", "d\n", "2022-01-01T00:00:00.000Z")
+			et.Expect("from to disk", te.run("-from=2020-06", "-to=", "-summary=true", "diff"), `
+				modified a.txt
+				removed b.txt
+				added c.txt
+				added d.txt
+			`)
+			et.Expect("head to disk", te.run("-from=", "diff"), "added d.txt\n")
+
+			_, err := te.runerr("-from=", "-to=2021", "diff")
+			et.Expect("to without from", err, "gdsnap.ToWithoutFrom (-to needs -from)")
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			day := time.Now().UTC().Truncate(24 * time.Hour)
+			at := func(d time.Duration) string { return day.Add(d).Format(tLayout) }
+			save := func(content string, mtime string) {
+				te.write("a.txt", content, mtime)
+				te.run("save", filepath.Join(te.dir, "a.txt"))
+			}
+
+			// v1 is too old for the policy but b.txt references it.
+			save("v1\n", at(-40*24*time.Hour))
+			te.write("b.txt", "v1\n", at(-40*24*time.Hour))
+			te.run("save", filepath.Join(te.dir, "b.txt"))
+			save("v2\n", at(-10*24*time.Hour+time.Hour))
+			save("v3\n", at(-10*24*time.Hour+2*time.Hour))
+			save("v4\n", at(-time.Minute))
+			save("v5\n", at(0))
+			revisions := func() string {
+				gs := gdsnap{}
+				efftesting.Must(gs.init())
+				efftesting.Must(gs.listfiles())
+				fi := gs.files["a.txt"]
+				var contents []string
+				for _, r := range efftesting.Must1(gs.backend.revisions(&fi)) {
+					_, _, rc, err := gs.fetchrev(&fi, r.ID, r.MimeType)
+					efftesting.Must(err)
+					contents = append(contents, strings.TrimSpace(string(efftesting.Must1(io.ReadAll(rc)))))
+					rc.Close()
+				}
+				return strings.Join(contents, " ")
+			}
+			et.Expect("before", revisions(), "v1 v2 v3 v4 v5")
+
+			setflag(t, "retention", "1d:all,30d:1d")
+			et.Expect("dry run", strings.Count(te.run("-dryrun=true", "prune"), "\n"), "2")
+			et.Expect("after dry run", revisions(), "v1 v2 v3 v4 v5")
+			setflag(t, "dryrun", "false")
+			te.run("prune")
+			et.Expect("after prune", revisions(), "v1 v3 v4 v5")
+			et.Expect("ref", te.run("cat", "b.txt"), "v1\n")
+			if backend == "drive" {
+				var kept []string
+				for _, f := range te.fd.files {
+					if f.Name == "a.txt/"+shasumPart(f.Name) {
+						for _, r := range f.Revisions {
+							kept = append(kept, strconv.FormatBool(r.KeepForever))
+						}
+					}
+				}
+				et.Expect("kept", strings.Join(kept, " "), "true true true false")
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			te.write("a.txt", "a\n", "2020-01-01T00:00:00.000Z")
+			te.write("b.txt", "b\n", "2020-01-01T00:00:00.000Z")
+			te.write("c.txt", "c\n", "2020-01-01T00:00:00.000Z")
+			te.write("copy.txt", "a\n", "2020-01-01T00:00:00.000Z")
+			efftesting.Must(os.Symlink("a.txt", filepath.Join(te.dir, "link")))
+			te.run("save", filepath.Join(te.dir, "a.txt"))
+			te.run("save", te.dir)
+			et.Expect("ok", te.run("verify"), "verified 5 files: 0 corrupt, 0 missing, 0 extra, 0 changed.\n")
+
+			// flip a bit in the stored content of a.txt.
+			if backend == "drive" {
+				for _, f := range te.fd.files {
+					if namePart(f.Name) == "a.txt" {
+						f.Revisions[len(f.Revisions)-1].Content[30] ^= 1
+					}
+				}
+			} else {
+				filepath.WalkDir(*gdirFlag, func(path string, d os.DirEntry, err error) error {
+					if err == nil && filepath.Base(path) == "info.json" && strings.Contains(string(efftesting.Must1(os.ReadFile(path))), `"Name":"a.txt/`) {
+						rev := filepath.Join(filepath.Dir(path), "00000001")
+						content := efftesting.Must1(os.ReadFile(rev))
+						content[30] ^= 1
+						efftesting.Must(os.WriteFile(rev, content, 0600))
+					}
+					return nil
+				})
+			}
+			te.write("b.txt", "b2\n", "2021-01-01T00:00:00.000Z")
+			efftesting.Must(os.Remove(filepath.Join(te.dir, "c.txt")))
+			te.write("d.txt", "d\n", "2020-01-01T00:00:00.000Z")
+
+			stdout := efftesting.Must1(os.CreateTemp(t.TempDir(), "stdout"))
+			origstdout := os.Stdout
+			os.Stdout = stdout
+			err := runsubcommand("verify", nil)
+			os.Stdout = origstdout
+			et.Expect("error", err, "gdsnap.VerifyFailed corrupt=2 missing=1 extra=1 changed=1")
+			et.Expect("report", string(efftesting.Must1(os.ReadFile(stdout.Name()))), `
+				corrupt a.txt: gdsnap.OpenEncryptedContent name=a.txt: chacha20poly1305: message authentication failed
+				changed b.txt: the file on disk differs from the backup.
+				extra c.txt: it's backed up but it's not on disk.
+				corrupt copy.txt: gdsnap.OpenEncryptedContent name=copy.txt: chacha20poly1305: message authentication failed
+				missing d.txt: it's on disk but it's not backed up.
+				verified 5 files: 2 corrupt, 1 missing, 1 extra, 1 changed.
+				`+"\a")
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			te.write("a.txt", "v1\n", "2020-01-01T00:00:00.000Z")
+			te.write("b.txt", "b\n", "2020-01-01T00:00:00.000Z")
+			te.cycle("a.txt", "b.txt")
+			te.write("a.txt", "v2\n", "2021-01-01T00:00:00.000Z")
+			te.cycle("a.txt")
+
+			// an older revision of the content is safe to overwrite.
+			te.run("-t=2020-06", "restore", "a.txt")
+			et.Expect("old", te.read("a.txt"), "v1\n")
+
+			// the local edits are not overwritten.
+			te.write("a.txt", "local edit\n", "2022-01-01T00:00:00.000Z")
+			efftesting.Must(os.Remove(filepath.Join(te.dir, "b.txt")))
+			stdout, err := te.runerr("restore", "*")
+			et.Expect("conflict", stdout, "conflict a.txt: gdsnap.LocalChangesNotBackedUp\n")
+			et.Expect("conflict error", err, "gdsnap.RestoreFailed conflicts=1 failures=0 (use -force to overwrite the conflicting files or -stagedir to restore elsewhere)")
+			et.Expect("kept", te.read("a.txt")+te.read("b.txt"), "local edit\nb\n")
+
+			// the dry run doesn't touch the files.
+			efftesting.Must(os.Remove(filepath.Join(te.dir, "b.txt")))
+			fetches := te.fd.requests["GET /drive/v3/files/file"]
+			et.Expect("dryrun", te.run("-n=true", "-force=true", "restore", "*"), "would restore a.txt.\nwould restore b.txt.\n")
+			if backend == "drive" {
+				// only the key header is downloaded.
+				et.Expect("dryrun fetches", te.fd.requests["GET /drive/v3/files/file"]-fetches, "1")
+			}
+			_, err = os.Stat(filepath.Join(te.dir, "b.txt"))
+			et.Expect("dryrun files", te.read("a.txt")+strconv.FormatBool(os.IsNotExist(err)), "local edit\ntrue")
+			setflag(t, "force", "false")
+			et.Expect("dryrun conflict", te.run("restore", "*"), `
+				conflict a.txt: gdsnap.LocalChangesNotBackedUp
+				would restore b.txt.
+				the restore would fail with 1 conflicts (use -force to overwrite the conflicting files or -stagedir to restore elsewhere).
+			`)
+			setflag(t, "n", "false")
+
+			// the staging directory is restored without conflicts.
+			stage := t.TempDir()
+			te.run("-stagedir="+stage, "restore", "*")
+			et.Expect("staged", string(efftesting.Must1(os.ReadFile(filepath.Join(stage, "a.txt")))), "v2\n")
+			et.Expect("staged local", te.read("a.txt"), "local edit\n")
+			setflag(t, "stagedir", "")
+
+			// a failed download leaves the local file intact.
+			if backend == "drive" {
+				te.fd.fail["GET /drive/v3/files/file"] = 1
+				_, err := te.runerr("-force=true", "restore", "a.txt")
+				et.Expect("failed download", err != nil, "true")
+				et.Expect("intact", te.read("a.txt"), "local edit\n")
+			}
+			te.run("-force=true", "restore", "a.txt")
+			et.Expect("forced", te.read("a.txt"), "v2\n")
+			entries, _ := filepath.Glob(filepath.Join(te.dir, ".gdsnap.restore.*"))
+			et.Expect("no temp files", len(entries), "0")
+		})
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			mtime := time.Unix(1600000000, 123456789)
+			te.write("a.txt", "a\n", "2020-01-01T00:00:00.000Z")
+			te.write("b.txt", "a\n", "2020-01-01T00:00:00.000Z")
+			efftesting.Must(os.Chtimes(filepath.Join(te.dir, "a.txt"), mtime, mtime))
+			xattrs := unix.Setxattr(filepath.Join(te.dir, "a.txt"), "user.gdsnap", []byte("hello"), 0) == nil
+			efftesting.Must(os.Symlink("a.txt", filepath.Join(te.dir, "link")))
+			efftesting.Must(os.MkdirAll(filepath.Join(te.dir, "empty/inner"), 0700))
+			te.cycle("a.txt", "b.txt", "link", "empty")
+			et.Expect("verify", te.run("verify"), "verified 4 files: 0 corrupt, 0 missing, 0 extra, 0 changed.\n")
+			et.Expect("cat dir", te.run("cat", "empty/inner"), "empty/inner is an empty directory.")
+
+			stage := t.TempDir()
+			te.run("-stagedir="+stage, "restore", "**")
+			stat := func(root, relpath string) string {
+				finfo, err := os.Lstat(filepath.Join(root, relpath))
+				if err != nil {
+					return err.Error()
+				}
+				return fmt.Sprintf("%s %d", finfo.Mode(), finfo.ModTime().UnixNano())
+			}
+			et.Expect("data", stat(stage, "a.txt"), "-rw-r--r-- 1600000000123456789")
+			et.Expect("ref", stat(stage, "b.txt"), "-rw-r--r-- 1577836800000000000")
+			et.Expect("dir", stat(stage, "empty/inner") == stat(te.dir, "empty/inner"), "true")
+			et.Expect("symlink", stat(stage, "link") == stat(te.dir, "link"), "true")
+			if xattrs {
+				value := make([]byte, 16)
+				n := efftesting.Must1(unix.Getxattr(filepath.Join(stage, "a.txt"), "user.gdsnap", value))
+				et.Expect("xattr", string(value[:n]), "hello")
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	et := efftesting.New(t)
+	te := newtestenv(t, "drive")
+	te.write("a.txt", "v1\n", "2020-01-01T00:00:00.000Z")
+	te.write("b.txt", "v1\n", "2020-01-01T00:00:00.000Z")
+	gs := gdsnap{}
+	efftesting.Must(gs.initbackend())
+	efftesting.Must(gs.initkeys(true))
+	touched := map[string]bool{filepath.Join(te.dir, "a.txt"): true}
+
+	// a failing listing fails the whole cycle.
+	te.fd.fail["GET /drive/v3/files"] = 1
+	et.Expect("failed listing", gs.cycle(touched) != nil, "true")
+	et.Expect("touched after failed listing", len(touched), "1")
+
+	// a failing upload keeps the file for a retry.
+	te.fd.fail["POST /upload/drive/v3/files"] = 1
+	et.Expect("cycle", gs.cycle(touched), "null")
+	et.Expect("touched after failed upload", len(touched), "1")
+	et.Expect("failures", gs.retries[filepath.Join(te.dir, "a.txt")].failures, "1")
+	et.Expect("retry wait", gs.nextcycle(touched).Round(time.Second), "30s")
+
+	// the failed file is skipped until its backoff expires.
+	touched[filepath.Join(te.dir, "b.txt")] = true
+	efftesting.Must(gs.cycle(touched))
+	et.Expect("touched during backoff", len(touched), "1")
+	gs.retries[filepath.Join(te.dir, "a.txt")].next = time.Time{}
+	efftesting.Must(gs.cycle(touched))
+	et.Expect("touched after retry", len(touched), "0")
+	et.Expect("retries after retry", len(gs.retries), "0")
+	et.Expect("cat", te.run("cat", "a.txt", "b.txt"), "v1\nv1\n")
+}
+
+func TestStatus(t *testing.T) {
+	et := efftesting.New(t)
+	te := newtestenv(t, "drive")
+	te.write("a.txt", "v1\n", "2020-01-01T00:00:00.000Z")
+	te.write("b.txt", "v1\n", "2020-01-01T00:00:00.000Z")
+	gs := gdsnap{}
+	efftesting.Must(gs.initbackend())
+	efftesting.Must(gs.initkeys(true))
+	gs.stats.started.Store(efftesting.Must1(time.Parse(tLayout, "2020-01-02T00:00:00.000Z")).UnixNano())
+	sock := filepath.Join(t.TempDir(), "status.sock")
+	ln := efftesting.Must1(statuslisten(sock))
+	t.Cleanup(func() { ln.Close() })
+	gs.stats.serve(ln)
+
+	// the times and durations of the cycles vary.
+	mask := func(s string) string {
+		s = regexp.MustCompile(`20(2[1-9]|[3-9]\d)-\d\d-\d\dT[0-9:.]*Z`).ReplaceAllString(s, "[time]")
+		s = regexp.MustCompile(`took [0-9.]+s`).ReplaceAllString(s, "took [dur]")
+		s = regexp.MustCompile(`"lastCycleSeconds":[^,]*`).ReplaceAllString(s, `"lastCycleSeconds":[dur]`)
+		return regexp.MustCompile(`(?m)_seconds [0-9.e+-]+$`).ReplaceAllString(s, "_seconds [value]")
+	}
+	et.Expect("before the cycles", mask(te.run("-statusaddr="+sock, "status")), `
+		started:      2020-01-02T00:00:00.000Z
+		last cycle:   never (took [dur])
+		last success: never
+		pending:      0 files
+		uploads:      0 (0 bytes)
+		deletions:    0
+		failures:     0
+		cycles:       0 (0 failed)
+		quota:        0 MB free of 0 MB
+	`)
+
+	touched := map[string]bool{filepath.Join(te.dir, "a.txt"): true, filepath.Join(te.dir, "b.txt"): true}
+	efftesting.Must(gs.cycle(touched))
+	te.write("a.txt", "v2\n", "2020-01-03T00:00:00.000Z")
+	te.write("c.txt", "v1\n", "2020-01-03T00:00:00.000Z")
+	efftesting.Must(os.Remove(filepath.Join(te.dir, "b.txt")))
+	touched = map[string]bool{filepath.Join(te.dir, "a.txt"): true, filepath.Join(te.dir, "b.txt"): true}
+	efftesting.Must(gs.cycle(touched))
+	// the new file fails to upload.
+	touched[filepath.Join(te.dir, "c.txt")] = true
+	te.fd.fail["POST /upload/drive/v3/files"] = 1
+	efftesting.Must(gs.cycle(touched))
+	// the snapshot fails to upload.
+	te.write("a.txt", "v3\n", "2020-01-04T00:00:00.000Z")
+	touched[filepath.Join(te.dir, "a.txt")] = true
+	te.fd.fail["POST /upload/drive/v3/files"] = 1
+	et.Expect("failed cycle", gs.cycle(touched) != nil, "true")
+	et.Expect("after the cycles", mask(te.run("status")), `
+		started:      2020-01-02T00:00:00.000Z
+		last cycle:   [time] (took [dur])
+		last success: [time]
+		pending:      1 files
+		uploads:      4 (422 bytes)
+		deletions:    1
+		failures:     1
+		cycles:       4 (1 failed)
+		quota:        16106 MB free of 16107 MB
+	`)
+	et.Expect("json", mask(te.run("-json=true", "status")), `
+		{"started":"2020-01-02T00:00:00.000Z","lastCycle":"[time]","lastSuccess":"[time]","lastCycleSeconds":[dur],"pending":1,"paused":false,"uploads":4,"deletions":1,"uploadedBytes":422,"failures":1,"cycles":4,"cycleFailures":1,"quotaFreeMB":16106,"quotaUsageMB":1,"quotaLimitMB":16107}
+	`)
+	et.Expect("metrics", mask(string(efftesting.Must1(fetchstatus(sock, "/metrics")))), `
+		# HELP gdsnap_uploads_total The number of the uploaded revisions.
+		# TYPE gdsnap_uploads_total counter
+		gdsnap_uploads_total 4
+		# HELP gdsnap_deletions_total The number of the files deleted from the backup.
+		# TYPE gdsnap_deletions_total counter
+		gdsnap_deletions_total 1
+		# HELP gdsnap_uploaded_bytes_total The number of the uploaded bytes after compression and encryption.
+		# TYPE gdsnap_uploaded_bytes_total counter
+		gdsnap_uploaded_bytes_total 422
+		# HELP gdsnap_failures_total The number of the failed file backups.
+		# TYPE gdsnap_failures_total counter
+		gdsnap_failures_total 1
+		# HELP gdsnap_cycles_total The number of the backup cycles.
+		# TYPE gdsnap_cycles_total counter
+		gdsnap_cycles_total 4
+		# HELP gdsnap_cycle_failures_total The number of the failed backup cycles.
+		# TYPE gdsnap_cycle_failures_total counter
+		gdsnap_cycle_failures_total 1
+		# HELP gdsnap_last_cycle_duration_seconds The duration of the last backup cycle.
+		# TYPE gdsnap_last_cycle_duration_seconds gauge
+		gdsnap_last_cycle_duration_seconds [value]
+		# HELP gdsnap_last_success_timestamp_seconds The unix time of the end of the last successful backup cycle.
+		# TYPE gdsnap_last_success_timestamp_seconds gauge
+		gdsnap_last_success_timestamp_seconds [value]
+		# HELP gdsnap_pending_files The number of the changed files waiting for the next backup cycle.
+		# TYPE gdsnap_pending_files gauge
+		gdsnap_pending_files 1
+		# HELP gdsnap_paused 1 if the backup cycles are paused via the control socket.
+		# TYPE gdsnap_paused gauge
+		gdsnap_paused 0
+		# HELP gdsnap_quota_free_megabytes The free gdrive quota.
+		# TYPE gdsnap_quota_free_megabytes gauge
+		gdsnap_quota_free_megabytes 16106
+		# HELP gdsnap_quota_usage_megabytes The used gdrive quota.
+		# TYPE gdsnap_quota_usage_megabytes gauge
+		gdsnap_quota_usage_megabytes 1
+		# HELP gdsnap_quota_limit_megabytes The gdrive quota limit.
+		# TYPE gdsnap_quota_limit_megabytes gauge
+		gdsnap_quota_limit_megabytes 16107
+	`)
+	_, err := te.runerr("-statusaddr="+filepath.Join(t.TempDir(), "missing.sock"), "status")
+	et.Expect("missing daemon", err != nil, "true")
+}
+
+func TestControl(t *testing.T) {
+	et := efftesting.New(t)
+	te := newtestenv(t, "drive")
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	sock := filepath.Join(t.TempDir(), "ctl.sock")
+	for _, kv := range [][2]string{{"controlsock", sock}, {"cycledur", "50ms"}, {"ignore", ""}, {"watcher", "inotify"}} {
+		setflag(t, kv[0], kv[1])
+	}
+	te.write("a.txt", "a\n", "2020-01-01T00:00:00.000Z")
+	watchdone := make(chan error, 1)
+	go func() { watchdone <- runsubcommand("watch", nil) }()
+
+	// the commands wait for the initial scan.
+	_, err := te.runerr("ctl", "pause")
+	for i := 0; err != nil && i < 100; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, err = te.runerr("ctl", "pause")
+	}
+	efftesting.Must(err)
+	et.Expect("initial", te.run("cat", "a.txt"), "a\n")
+
+	// await waits until a file is backed up.
+	await := func(relpath string) string {
+		for i := 0; i < 100; i++ {
+			if out := te.run("cat", relpath); out != "" {
+				return out
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return "timeout"
+	}
+	te.write("b.txt", "b\n", "2020-01-01T00:00:00.000Z")
+	time.Sleep(300 * time.Millisecond)
+	et.Expect("paused", te.run("cat", "b.txt"), "")
+	te.run("ctl", "flush")
+	et.Expect("flushed", te.run("cat", "b.txt"), "b\n")
+	te.run("ctl", "resume")
+	te.write("c.txt", "c\n", "2020-01-01T00:00:00.000Z")
+	et.Expect("resumed", await("c.txt"), "c\n")
+
+	te.run("ctl", "pause")
+	te.write("d.txt", "d\n", "2020-01-01T00:00:00.000Z")
+	te.run("ctl", "save", filepath.Join(te.dir, "d.txt"))
+	et.Expect("saved", te.run("cat", "d.txt"), "d\n")
+	_, err = te.runerr("ctl", "save", home)
+	et.Expect("save outside", strings.NewReplacer(home, "$HOME", te.dir+"/", "$DIR").Replace(err.Error()), "gdsnap.ControlFailed cmd=save: gdsnap.SaveOutsideDir path=$HOME dir=$DIR")
+	_, err = te.runerr("ctl", "frobnicate")
+	et.Expect("unknown", err, `gdsnap.ControlFailed cmd=frobnicate: gdsnap.UnknownControlCommand cmd="frobnicate"`)
+
+	efftesting.Must(os.WriteFile(filepath.Join(home, ".gdsnap"), []byte(`* ignore "*.tmp"`+"\n"), 0600))
+	te.run("ctl", "reload-config")
+	te.write("e.tmp", "e\n", "2020-01-01T00:00:00.000Z")
+	te.run("ctl", "save", filepath.Join(te.dir, "e.tmp"))
+	et.Expect("ignored", te.run("cat", "e.tmp"), "")
+	efftesting.Must(os.WriteFile(filepath.Join(home, ".gdsnap"), []byte(`* gdir "othergdir"`+"\n"), 0600))
+	_, err = te.runerr("ctl", "reload-config")
+	et.Expect("restart needed", err, "gdsnap.ControlFailed cmd=reload-config: gdsnap.RestartNeeded flags=gdir")
+	et.Expect("gdir", *gdirFlag, "testgdir")
+
+	te.run("ctl", "quit")
+	et.Expect("quit", <-watchdone, "null")
+}
+
+func TestSets(t *testing.T) {
+	et := efftesting.New(t)
+	te := newtestenv(t, "drive")
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	sock := filepath.Join(t.TempDir(), "ctl.sock")
+	for _, kv := range [][2]string{{"controlsock", sock}, {"cycledur", "50ms"}, {"sets", "work,personal"}, {"watcher", "inotify"}} {
+		setflag(t, kv[0], kv[1])
+	}
+	workdir, personaldir := filepath.Join(te.dir, "work"), filepath.Join(te.dir, "personal")
+	config := fmt.Sprintf(`work dir %q
+work gdir "workgdir"
+work ignore "*.tmp"
+personal dir %q
+personal gdir "personalgdir"
+personal password "otherpassword"
+`, workdir, personaldir)
+	efftesting.Must(os.WriteFile(filepath.Join(home, ".gdsnap"), []byte(config), 0600))
+	te.write("work/a.txt", "a\n", "2020-01-01T00:00:00.000Z")
+	te.write("work/b.tmp", "b\n", "2020-01-01T00:00:00.000Z")
+	te.write("personal/c.txt", "c\n", "2020-01-01T00:00:00.000Z")
+	watchdone := make(chan error, 1)
+	go func() { watchdone <- runsubcommand("watch", nil) }()
+
+	// the commands wait for the initial scans.
+	_, err := te.runerr("ctl", "pause")
+	for i := 0; err != nil && i < 100; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, err = te.runerr("ctl", "pause")
+	}
+	efftesting.Must(err)
+	te.fd.mu.Lock()
+	et.Expect("shared token", te.fd.requests["POST /token"], "1")
+	te.fd.mu.Unlock()
+
+	// catset runs cat in the backup of a set without touching the flags that the watch reads.
+	catset := func(set *backupset) func(relpath string) string {
+		return func(relpath string) string {
+			gs := &gdsnap{set: set}
+			efftesting.Must(gs.initbackend())
+			efftesting.Must(gs.initkeys(false))
+			return efftesting.Must1(te.capture(func() error { return gs.subcommandCat([]string{relpath}) }))
+		}
+	}
+	work := catset(&backupset{profile: "work", backend: "drive", dir: workdir + "/", gdir: "workgdir"})
+	personal := catset(&backupset{profile: "personal", backend: "drive", dir: personaldir + "/", gdir: "personalgdir", password: "otherpassword"})
+	et.Expect("work", work("a.txt"), "a\n")
+	et.Expect("work ignore", work("b.tmp"), "")
+	et.Expect("personal", personal("c.txt"), "c\n")
+	et.Expect("personal other set", personal("a.txt"), "")
+
+	// save goes to the set of the path.
+	te.write("work/d.txt", "d\n", "2020-01-01T00:00:00.000Z")
+	te.write("personal/e.txt", "e\n", "2020-01-01T00:00:00.000Z")
+	te.run("ctl", "save", filepath.Join(personaldir, "e.txt"))
+	et.Expect("saved", personal("e.txt"), "e\n")
+	et.Expect("not saved", work("d.txt"), "")
+	_, err = te.runerr("ctl", "save", home)
+	et.Expect("save outside", strings.NewReplacer(home, "$HOME", te.dir, "$DIR").Replace(err.Error()), "gdsnap.ControlFailed cmd=save: gdsnap.SaveOutsideDir path=$HOME dir=$DIR/work/,$DIR/personal/")
+	te.run("ctl", "flush")
+	et.Expect("flushed", work("d.txt"), "d\n")
+
+	efftesting.Must(os.WriteFile(filepath.Join(home, ".gdsnap"), []byte(config+`personal gdir "othergdir"`+"\n"), 0600))
+	_, err = te.runerr("ctl", "reload-config")
+	et.Expect("restart needed", err, "gdsnap.ControlFailed cmd=reload-config: gdsnap.RestartNeeded set=personal")
+
+	te.run("ctl", "quit")
+	et.Expect("quit", <-watchdone, "null")
+
+	// the dirs of the sets must not overlap.
+	efftesting.Must(os.WriteFile(filepath.Join(home, ".gdsnap"), []byte(config+fmt.Sprintf("personal dir %q\n", workdir+"/sub")), 0600))
+	_, err = te.runerr("watch")
+	et.Expect("overlap", strings.ReplaceAll(err.Error(), te.dir, "$DIR"), "gdsnap.OverlappingSets sets=work,personal dirs=$DIR/work/,$DIR/work/sub/")
+	efftesting.Must(os.WriteFile(filepath.Join(home, ".gdsnap"), []byte("work dir \"/tmp\"\n"), 0600))
+	_, err = te.runerr("watch")
+	et.Expect("missing gdir", err, `gdsnap.MissingSetFlag set=work flag=gdir (add a "work gdir \"...\"" line for it to the config)`)
+}
+
+func TestLock(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			te.write("a.txt", "a\n", "2020-01-01T00:00:00.000Z")
+			te.run("save", te.dir)
+			gs := &gdsnap{}
+			efftesting.Must(gs.init())
+			et.Expect("released", efftesting.Must1(gs.readlease()) == nil, "true")
+
+			// the varying parts of the errors are masked.
+			lockfile := efftesting.Must1(gs.lockpath())
+			mask := func(err error) string {
+				if err == nil {
+					return "<nil>"
+				}
+				s := strings.NewReplacer(lockfile, "$LOCK", hostname(), "$HOST", fmt.Sprintf("pid=%d ", os.Getpid()), "pid=$PID ").Replace(err.Error())
+				return regexp.MustCompile(`20(2[1-9]|[3-9]\d)-\d\d-\d\dT[0-9:.]*Z`).ReplaceAllString(s, "[time]")
+			}
+
+			tryacquire := func(op string) error {
+				release, err := gs.acquirelock(op)
+				if err == nil {
+					release()
+				}
+				return err
+			}
+
+			// the local lock.
+			release := efftesting.Must1(gs.acquirelock("watch"))
+			_, err := te.runerr("save", te.dir)
+			et.Expect("locked", mask(err), "gdsnap.Locked host=$HOST pid=$PID op=watch since=[time] (another gdsnap operates on this backup, wait for it to finish or stop it; lock=$LOCK)")
+			et.Expect("reading while locked", te.run("cat", "a.txt"), "a\n")
+			release()
+			et.Expect("relocked", mask(tryacquire("save")), "<nil>")
+
+			// the lease of another host.
+			putlease := func(l lease) { efftesting.Must(gs.backend.putmeta("lease", efftesting.Must1(json.Marshal(l)))) }
+			putlease(lease{Host: "otherhost", PID: 1, Op: "watch", Since: "2020-01-01T00:00:00.000Z", Expires: "2999-01-01T00:00:00.000Z", Token: "other"})
+			_, err = te.runerr("save", te.dir)
+			et.Expect("leased", mask(err), "gdsnap.Leased host=otherhost pid=1 op=watch since=2020-01-01T00:00:00.000Z (another gdsnap operates on this backup, wait for it to finish or stop it; the lease expires at 2999-01-01T00:00:00.000Z unless renewed)")
+
+			// the expired leases and the leases of the dead processes on this host are taken over.
+			putlease(lease{Host: "otherhost", PID: 1, Op: "watch", Since: "2020-01-01T00:00:00.000Z", Expires: "2020-01-01T00:10:00.000Z", Token: "other"})
+			et.Expect("expired", mask(tryacquire("save")), "<nil>")
+			cmd := exec.Command("true")
+			efftesting.Must(cmd.Run())
+			putlease(lease{Host: hostname(), PID: cmd.Process.Pid, Op: "watch", Since: "2020-01-01T00:00:00.000Z", Expires: "2999-01-01T00:00:00.000Z", Token: "other"})
+			et.Expect("dead", mask(tryacquire("save")), "<nil>")
+
+			// the holder renews the lease.
+			efftesting.Override(&leasedur, 300*time.Millisecond)
+			release = efftesting.Must1(gs.acquirelock("watch"))
+			before := efftesting.Must1(gs.readlease())
+			time.Sleep(250 * time.Millisecond)
+			after := efftesting.Must1(gs.readlease())
+			et.Expect("renewed", after.Token == before.Token && after.Expires > before.Expires, "true")
+			release()
+			et.Expect("released after renewals", efftesting.Must1(gs.readlease()) == nil, "true")
+
+			// two hosts racing for the lease: gdrive can't create a file atomically so each host creates its own copy.
+			gs2 := &gdsnap{}
+			efftesting.Must(gs2.init())
+			for round := range 10 {
+				var wg sync.WaitGroup
+				start := make(chan struct{})
+				errs := make([]error, 2)
+				leases := make([]*lease, 2)
+				for i, g := range []*gdsnap{gs, gs2} {
+					leases[i] = &lease{Host: fmt.Sprintf("host%d", i), PID: 1, Op: "save", Since: "2020-01-01T00:00:00.000Z", Token: fmt.Sprintf("token%d", i)}
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						<-start
+						errs[i] = g.acquirelease(leases[i])
+					}()
+				}
+				close(start)
+				wg.Wait()
+				if (errs[0] == nil) == (errs[1] == nil) {
+					t.Fatalf("round %d: want exactly one winner, got errors %v and %v", round, errs[0], errs[1])
+				}
+				winner, loser := 0, 1
+				if errs[0] != nil {
+					winner, loser = 1, 0
+				}
+				if msg := errs[loser].Error(); !strings.HasPrefix(msg, "gdsnap.Leased ") && !strings.HasPrefix(msg, "gdsnap.LeaseRace") {
+					t.Fatalf("round %d: unexpected error %v", round, errs[loser])
+				}
+				copies := efftesting.Must1(gs.backend.metacopies("lease"))
+				if len(copies) != 1 || !strings.Contains(string(copies[0].data), leases[winner].Token) {
+					t.Fatalf("round %d: want only the lease of host%d, got %d copies", round, winner, len(copies))
+				}
+				efftesting.Must(gs.backend.deletemeta("lease"))
+			}
+		})
+	}
+}
+
+func TestExport(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			te.write("a.txt", "hello\n", "2020-01-01T00:00:00.000Z")
+			te.write("b.txt", "b1\n", "2020-01-01T00:00:00.000Z")
+			te.cycle("a.txt", "b.txt")
+			te.write("b.txt", "b2\n", "2020-02-01T00:00:00.000Z")
+			efftesting.Must(os.Symlink("a.txt", filepath.Join(te.dir, "link")))
+			te.cycle("b.txt", "link")
+			time.Sleep(2 * time.Millisecond)
+			// the move makes c.txt a reference to a.txt's content.
+			efftesting.Must(os.Rename(filepath.Join(te.dir, "a.txt"), filepath.Join(te.dir, "c.txt")))
+			te.cycle("a.txt", "c.txt")
+			te.write("b.txt", "b1\n", "2020-03-01T00:00:00.000Z")
+			te.cycle("b.txt")
+			et.Expect("mimes", te.mimes("a.txt", "b.txt", "c.txt"), "gdsnap/deleted gdsnap/ref644-m-k1 gdsnap/ref644-m-k1")
+
+			// the state to compare the imported backups to, the stored sizes of the references depend on the IDs.
+			nosize := func(out string) string {
+				var lines []string
+				for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+					lines = append(lines, strings.Join(slices.Delete(strings.Fields(line), 2, 3), " "))
+				}
+				return strings.Join(lines, "\n")
+			}
+			state := func() string {
+				s := nosize(te.run("log")) + "\n"
+				for _, id := range strings.Fields(te.run("snapshots")) {
+					s += id + ": " + te.run("-snapshot="+id, "cat", "*")
+				}
+				return s + te.run("-snapshot=", "-t=2020-01-15", "cat", "*")
+			}
+			want := state()
+			et.Expect("state", regexp.MustCompile(`20(2[1-9]|[3-9]\d)-\d\d-\d\dT[0-9:.]*Z`).ReplaceAllString(want, "[time]"), `
+				2020-01-01T00:00:00.000Z created a.txt
+				2020-01-01T00:00:00.000Z created b.txt
+				2020-01-01T00:00:00.000Z created c.txt
+				2020-02-01T00:00:00.000Z modified b.txt
+				2020-03-01T00:00:00.000Z modified b.txt
+				[time] symlink link
+				[time] deleted a.txt
+				[time]: hello
+				b1
+				[time]: hello
+				b2
+				link is a symlink to a.txt.[time]: b2
+				hello
+				link is a symlink to a.txt.[time]: b1
+				hello
+				link is a symlink to a.txt.hello
+				b1
+				hello
+				link is deleted.`)
+
+			archive := filepath.Join(t.TempDir(), "backup.gdsnap")
+			te.run("export", archive)
+			content := efftesting.Must1(os.ReadFile(archive))
+			et.Expect("encrypted", bytes.Contains(content, []byte("b.txt")) || bytes.Contains(content, []byte("gdsnap/ref")), "false")
+			srcgdir := *gdirFlag
+
+			for _, target := range []string{"drive", "local"} {
+				gdir := "importgdir"
+				if target == "local" {
+					gdir = t.TempDir()
+				}
+				te.run("-backend="+target, "-gdir="+gdir, "import", archive)
+				et.Expect("imported "+target, state() == want, "true")
+				et.Expect("verify "+target, te.run("verify"), `
+					verified 3 files: 0 corrupt, 0 missing, 0 extra, 0 changed.
+				`)
+				_, err := te.runerr("import", archive)
+				et.Expect("non-empty "+target, err, "gdsnap.ImportIntoNonEmpty files=4 snapshots=4 (import into a new -gdir or -profile)")
+				setflag(t, "backend", backend)
+				setflag(t, "gdir", srcgdir)
+			}
+
+			_, err := te.runerr("-gdir="+t.TempDir(), "-backend=local", "-password=wrong", "import", archive)
+			et.Expect("wrong password", err, "gdsnap.WrongPassword: chacha20poly1305: message authentication failed")
+			_, err = te.runerr("-gdir="+t.TempDir(), "-password=testpassword", "-encryptnames=true", "import", archive)
+			et.Expect("encryptnames", err, "gdsnap.EncryptnamesMismatch archive=false (import it with -encryptnames=false)")
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	et := efftesting.New(t)
+	var waits []string
+	for _, failures := range []int{1, 2, 3, 4, 10, 100} {
+		waits = append(waits, backoff(failures).String())
+	}
+	et.Expect("", strings.Join(waits, " "), "30s 1m0s 2m0s 4m0s 4h16m0s 24h0m0s")
+}
+
+func TestParallelSave(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			setflag(t, "jobs", "8")
+			for i := range 40 {
+				te.write(fmt.Sprintf("dir%d/f%02d.txt", i%3, i), fmt.Sprintf("content %d\n", i%10), "2020-01-01T00:00:00.000Z")
+			}
+			te.run("save", te.dir)
+
+			gs := gdsnap{}
+			efftesting.Must(gs.init())
+			efftesting.Must(gs.listfiles())
+			mimes := map[string]int{}
+			for _, fi := range gs.files {
+				mimes[strings.TrimSuffix(fi.MimeType, "-k1")]++
+			}
+			et.Expect("mimes", mimes, `
+				{
+				  "gdsnap/data644-m": 10,
+				  "gdsnap/ref644-m": 30
+				}`)
+			et.Expect("cat", te.run("cat", "dir0/f00.txt", "dir1/f10.txt", "dir2/f38.txt"), "content 0\ncontent 0\ncontent 8\n")
+		})
+	}
+}
+
+func TestStateCache(t *testing.T) {
+	et := efftesting.New(t)
+	te := newtestenv(t, "drive")
+	te.fd.pagesize = 2
+	te.write("a.txt", "a\n", "2020-01-01T00:00:00.000Z")
+	te.write("b.txt", "b\n", "2020-01-01T00:00:00.000Z")
+	te.run("save", te.dir)
+
+	// listfiles returns the requests it made.
+	list := func(gs *gdsnap) string {
+		before := maps.Clone(te.fd.requests)
+		efftesting.Must(gs.listfiles())
+		var requests []string
+		for _, key := range []string{"GET /drive/v3/files", "GET /drive/v3/changes"} {
+			requests = append(requests, fmt.Sprintf("%s:%d", key, te.fd.requests[key]-before[key]))
+		}
+		return strings.Join(requests, " ")
+	}
+	names := func(gs *gdsnap) string {
+		var names []string
+		for relpath, fi := range gs.files {
+			names = append(names, fmt.Sprintf("%s:%t", relpath, fi.Trashed))
+		}
+		slices.Sort(names)
+		return strings.Join(names, " ")
+	}
+
+	// a new process continues from the cache of the previous one.
+	gs := &gdsnap{}
+	efftesting.Must(gs.init())
+	et.Expect("cached", list(gs), "GET /drive/v3/files:0 GET /drive/v3/changes:2")
+	et.Expect("cached files", names(gs), "a.txt:false b.txt:false")
+
+	// the changes made by other processes are picked up from the change feed.
+	te.write("c.txt", "c\n", "2020-01-01T00:00:00.000Z")
+	te.write("d.txt", "d\n", "2020-01-01T00:00:00.000Z")
+	efftesting.Must(os.Remove(filepath.Join(te.dir, "a.txt")))
+	te.run("save", te.dir, filepath.Join(te.dir, "a.txt"))
+	et.Expect("changes", list(gs), "GET /drive/v3/files:0 GET /drive/v3/changes:3")
+	et.Expect("changed files", names(gs), "a.txt:true b.txt:false c.txt:false d.txt:false")
+	et.Expect("unchanged", list(gs), "GET /drive/v3/files:0 GET /drive/v3/changes:1")
+
+	// the permanently deleted files disappear.
+	for id, f := range te.fd.files {
+		if namePart(f.Name) == "b.txt" {
+			delete(te.fd.files, id)
+			te.fd.changelog = append(te.fd.changelog, id)
+		}
+	}
+	list(gs)
+	et.Expect("removed", names(gs), "a.txt:true c.txt:false d.txt:false")
+
+	// -rebuildcache lists everything again.
+	setflag(t, "rebuildcache", "true")
+	gs = &gdsnap{}
+	efftesting.Must(gs.init())
+	et.Expect("rebuild", list(gs), "GET /drive/v3/files:2 GET /drive/v3/changes:0")
+	et.Expect("rebuilt files", names(gs), "a.txt:true c.txt:false d.txt:false")
+}
+
+func TestWatchers(t *testing.T) {
+	for _, name := range []string{"inotify", "fanotify", "scan"} {
+		t.Run(name, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, "local")
+			setflag(t, "watcher", name)
+			setflag(t, "scandur", "10ms")
+			te.write("a.txt", "a\n", "2020-01-01T00:00:00.000Z")
+			te.write("dir/b.txt", "b\n", "2020-01-01T00:00:00.000Z")
+			w := efftesting.Must1(newwatcher(newignorer(te.dir+"/", nil)))
+			filech := make(chan string, 1000)
+			ctx, cancel := context.WithCancel(context.Background())
+			watcherr := make(chan error, 1)
+			go func() { watcherr <- w.watch(ctx, filech) }()
+			defer func() {
+				cancel()
+				<-watcherr
+			}()
+
+			// await waits until all relpaths arrive on filech and returns the missing ones on timeout.
+			await := func(relpaths ...string) string {
+				want := map[string]bool{}
+				for _, relpath := range relpaths {
+					want[filepath.Join(te.dir, relpath)] = true
+				}
+				timeout := time.After(5 * time.Second)
+				for len(want) > 0 {
+					select {
+					case fn := <-filech:
+						delete(want, fn)
+					case <-timeout:
+						return fmt.Sprint(slices.Sorted(maps.Keys(want)))
+					}
+				}
+				return "ok"
+			}
+			et.Expect("initial", await("a.txt", "dir/b.txt"), "ok")
+
+			// let the scan watcher finish its first walk.
+			time.Sleep(100 * time.Millisecond)
+			te.write("dir/new/c.txt", "c\n", "2020-01-01T00:00:00.000Z")
+			te.write("a.txt", "a2\n", "2021-01-01T00:00:00.000Z")
+			efftesting.Must(os.Remove(filepath.Join(te.dir, "dir/b.txt")))
+			et.Expect("changes", await("a.txt", "dir/b.txt", "dir/new/c.txt"), "ok")
+
+			// the empty directories are reported when they come and go.
+			efftesting.Must(os.Mkdir(filepath.Join(te.dir, "empty"), 0700))
+			et.Expect("empty dir", await("empty"), "ok")
+			time.Sleep(100 * time.Millisecond)
+			efftesting.Must(os.Remove(filepath.Join(te.dir, "empty")))
+			et.Expect("removed empty dir", await("empty"), "ok")
+		})
+	}
+}
+
+func TestAuth(t *testing.T) {
+	et := efftesting.New(t)
+	te := newtestenv(t, "drive")
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	cfgfile := filepath.Join(home, ".cache/gdsnap")
+	efftesting.Must(os.MkdirAll(filepath.Dir(cfgfile), 0755))
+	efftesting.Must(os.WriteFile(cfgfile, []byte("* gdir \"1234\"\ntestprofile refreshtoken \"old\"\nother refreshtoken \"other\""), 0644))
+	efftesting.Override(&authURL, te.fd.srv.URL+"/auth")
+	efftesting.Override(&deviceURL, te.fd.srv.URL+"/device/code")
+	efftesting.Override(&deviceinterval, time.Millisecond)
+	// the browser follows the redirect to the loopback listener.
+	efftesting.Override(&openurl, func(u string) error {
+		go func() {
+			if response, err := http.Get(u); err == nil {
+				response.Body.Close()
+			}
+		}()
+		return nil
+	})
+
+	_, err := te.runerr("auth")
+	et.Expect("already authorized", err, "gdsnap.RefreshtokenAlreadyDefined (use \"gdsnap -refreshtoken= auth\" to force auth regardless)")
+
+	run := func(args ...string) string { return strings.ReplaceAll(te.run(args...), home, "$HOME") }
+	out := strings.Split(run("-refreshtoken=", "auth"), "\n")
+	et.Expect("loopback", out[len(out)-2], "saved the refresh token of the testprofile profile into $HOME/.cache/gdsnap (this is a sensitive token, don't share it!).")
+	et.Expect("config", string(efftesting.Must1(os.ReadFile(cfgfile))), `
+		* gdir "1234"
+		other refreshtoken "other"
+		testprofile refreshtoken "fakerefreshtoken"
+	`)
+	et.Expect("permissions", efftesting.Must1(os.Stat(cfgfile)).Mode().Perm(), "-rw-------")
+
+	te.fd.devicepending = 2
+	efftesting.Must(os.Remove(cfgfile))
+	et.Expect("device", run("-headless=true", "auth"), `
+		visit https://www.google.com/device on any device and enter the code FAKE-CODE to authorize gdsnap.
+		saved the refresh token of the testprofile profile into $HOME/.cache/gdsnap (this is a sensitive token, don't share it!).
+	`)
+	et.Expect("device config", string(efftesting.Must1(os.ReadFile(cfgfile))), "testprofile refreshtoken \"fakerefreshtoken\"\n")
+	// the loopback flow's exchange and the 3 polls of the device flow.
+	et.Expect("token requests", te.fd.requests["POST /token"], "4")
+}
+
+func TestRateLimit(t *testing.T) {
+	et := efftesting.New(t)
+	te := newtestenv(t, "drive")
+	efftesting.Override(&ratelimitwait, time.Millisecond)
+	setflag(t, "jobs", "4")
+	for i := range 8 {
+		te.write(fmt.Sprintf("f%d.txt", i), fmt.Sprintf("v%d\n", i), "2020-01-01T00:00:00.000Z")
+	}
+	te.fd.ratelimit["GET /drive/v3/files"] = 2
+	te.fd.ratelimit["POST /upload/drive/v3/files"] = 5
+	te.run("save", te.dir)
+	et.Expect("ratelimited", te.fd.ratelimit["POST /upload/drive/v3/files"], "0")
+	et.Expect("cat", te.run("cat", "*"), "v0\nv1\nv2\nv3\nv4\nv5\nv6\nv7\n")
+
+	// a persistent rate limit eventually fails the request.
+	te.write("f0.txt", "v8\n", "2021-01-01T00:00:00.000Z")
+	te.fd.ratelimit["PATCH /upload/drive/v3/files/file"] = 100
+	err := runsubcommand("save", []string{filepath.Join(te.dir, "f0.txt")})
+	et.Expect("persistent", strings.Contains(fmt.Sprint(err), "userRateLimitExceeded"), "true")
+	et.Expect("attempts", 100-te.fd.ratelimit["PATCH /upload/drive/v3/files/file"], "8")
+}
+
+func TestLargeFile(t *testing.T) {
+	for _, backend := range []string{"drive", "local"} {
+		t.Run(backend, func(t *testing.T) {
+			et := efftesting.New(t)
+			te := newtestenv(t, backend)
+			content := make([]byte, 6e6)
+			rand.Read(content)
+			te.write("large", string(content), "2020-01-01T00:00:00.000Z")
+			te.run("save", filepath.Join(te.dir, "large"))
+			et.Expect("content matches", bytes.Equal([]byte(te.run("cat", "large")), content), "true")
+			if backend == "drive" {
+				et.Expect("resumable uploads", te.fd.requests["PUT /upload/session"], "1")
+			}
+
+			// files over -sizelimitmb are streamed in pieces.
+			efftesting.Override(&uploadPieceSize, 256<<10)
+			setflag(t, "sizelimitmb", "1")
+			huge := make([]byte, 3e6)
+			rand.Read(huge)
+			te.write("huge", string(huge), "2020-01-01T00:00:00.000Z")
+			te.write("hugecopy", string(huge), "2020-01-01T00:00:00.000Z")
+			te.run("save", filepath.Join(te.dir, "huge"))
+			te.run("save", filepath.Join(te.dir, "hugecopy"))
+			et.Expect("mimes", te.mimes("huge", "hugecopy"), "gdsnap/stream644-m-k1 gdsnap/ref644-m-k1")
+			et.Expect("stream matches", bytes.Equal([]byte(te.run("cat", "huge")), huge), "true")
+			if backend == "drive" {
+				et.Expect("pieces", te.fd.requests["PUT /upload/session"], "13")
+			}
+			efftesting.Must(os.Remove(filepath.Join(te.dir, "hugecopy")))
+			te.run("restore", "hugecopy")
+			et.Expect("restored copy matches", te.read("hugecopy") == string(huge), "true")
+
+			if backend == "drive" {
+				// the failed pieces are resumed from where the upload session stopped.
+				efftesting.Override(&ratelimitwait, time.Millisecond)
+				te.fd.fail["PUT /upload/session"], te.fd.partial = 1, 2
+				flaky := make([]byte, 15e5)
+				rand.Read(flaky)
+				te.write("flaky", string(flaky), "2020-01-01T00:00:00.000Z")
+				te.run("save", filepath.Join(te.dir, "flaky"))
+				et.Expect("flaky matches", te.read("flaky") == te.run("cat", "flaky"), "true")
+				et.Expect("flaky retries", te.fd.fail["PUT /upload/session"]+te.fd.partial, "0")
+			}
+		})
+	}
+}
+
+func TestStream(t *testing.T) {
+	et := efftesting.New(t)
+	aead := efftesting.Must1(chacha20poly1305.NewX(make([]byte, chacha20poly1305.KeySize)))
+	seal := func(plaintext []byte) []byte {
+		buf := &bytes.Buffer{}
+		sw := efftesting.Must1(newstreamwriter(aead, buf))
+		efftesting.Must1(sw.Write(plaintext))
+		efftesting.Must(sw.Close())
+		return buf.Bytes()
+	}
+	open := func(ciphertext []byte) ([]byte, error) {
+		sr, err := newstreamreader([]cipher.AEAD{aead}, bytes.NewReader(ciphertext))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(sr)
+	}
+
+	var sizes []string
+	for _, size := range []int{0, 1, streamchunk, streamchunk + 1, 3 * streamchunk} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		ciphertext := seal(plaintext)
+		got, err := open(ciphertext)
+		efftesting.Must(err)
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("stream of %d bytes doesn't roundtrip", size)
+		}
+		sizes = append(sizes, strconv.Itoa(len(ciphertext)-size))
+	}
+	et.Expect("overheads", strings.Join(sizes, " "), "40 40 40 56 72")
+
+	ciphertext := seal(make([]byte, 2*streamchunk+1))
+	chunk := streamchunk + aead.Overhead()
+	f := func(ciphertext []byte) string {
+		_, err := open(ciphertext)
+		return efftesting.Stringify(err)
+	}
+	et.Expect("truncated", f(ciphertext[:24+2*chunk]), "gdsnap.OpenStreamChunk chunk=1 last=true: chacha20poly1305: message authentication failed")
+	et.Expect("partial chunk", f(ciphertext[:len(ciphertext)-1]), "gdsnap.OpenStreamChunk chunk=2 last=true: chacha20poly1305: message authentication failed")
+	swapped := append(append(append([]byte{}, ciphertext[:24]...), ciphertext[24+chunk:24+2*chunk]...), ciphertext[24:24+chunk]...)
+	swapped = append(swapped, ciphertext[24+2*chunk:]...)
+	et.Expect("reordered", f(swapped), "gdsnap.OpenStreamChunk chunk=0 last=false: chacha20poly1305: message authentication failed")
+	et.Expect("empty", f(nil), "gdsnap.ReadStreamNonce: EOF")
+}
+
+func TestMain(m *testing.M) {
+	initflags()
+	os.Exit(efftesting.Main(m))
+}
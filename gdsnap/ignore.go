@@ -0,0 +1,182 @@
+package gdsnap
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ignorefile is the name of the files with the ignore rules, see the ignoring section of the help.
+const ignorefile = ".gdsnapignore"
+
+// ignorerule is a line of an ignore file.
+type ignorerule struct {
+	pattern string
+
+	// anchored rules match the path relative to the ignore file's directory, the others match the basename.
+	anchored bool
+	dironly  bool
+	negate   bool
+}
+
+// parseignore parses the content of an ignore file with the gitignore syntax.
+func parseignore(content string) []ignorerule {
+	var rules []ignorerule
+	sc := bufio.NewScanner(strings.NewReader(content))
+	for sc.Scan() {
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		// the trailing spaces are dropped unless they are escaped.
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r ignorerule
+		line, r.negate = strings.CutPrefix(line, "!")
+		line, r.dironly = strings.CutSuffix(line, "/")
+		if strings.Contains(line, "/") {
+			r.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		r.pattern = line
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// matchgitglob is matchglob with the gitignore specific handling of **:
+// a leading **/ and a /**/ in the middle match zero directories too.
+func matchgitglob(pattern, name string) bool {
+	if matchglob(pattern, name) {
+		return true
+	}
+	if rest, ok := strings.CutPrefix(pattern, "**/"); ok && matchgitglob(rest, name) {
+		return true
+	}
+	for i := 0; i < len(pattern); i++ {
+		if strings.HasPrefix(pattern[i:], "/**/") && matchgitglob(pattern[:i]+pattern[i+3:], name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r ignorerule) match(relpath string, isdir bool) bool {
+	if r.dironly && !isdir {
+		return false
+	}
+	if !r.anchored {
+		relpath = path.Base(relpath)
+	}
+	return matchgitglob(r.pattern, relpath)
+}
+
+// ignorer decides which paths under a set's dir are not backed up.
+// the rules come from the set's -ignore globs and from the ignore files anywhere in the tree.
+// it's safe for concurrent use.
+type ignorer struct {
+	// root is the directory of the set with a trailing /.
+	root string
+
+	mu    sync.Mutex
+	globs []string
+	// rules caches the rules of the ignore file of each directory keyed by the directory's relpath, "" is the root.
+	rules map[string][]ignorerule
+}
+
+func newignorer(root string, globs []string) *ignorer {
+	return &ignorer{root: root, globs: globs, rules: map[string][]ignorerule{}}
+}
+
+// dirrules returns the rules of the ignore file in a directory.
+func (ig *ignorer) dirrules(dir string) []ignorerule {
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+	rules, ok := ig.rules[dir]
+	if !ok {
+		content, err := os.ReadFile(filepath.Join(ig.root, dir, ignorefile))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			log.Printf("[warning] can't read %s, ignoring it: %v", path.Join(dir, ignorefile), err)
+		}
+		rules = parseignore(string(content))
+		ig.rules[dir] = rules
+	}
+	return rules
+}
+
+// reset switches to new -ignore globs and rereads the ignore files, see reload-config.
+func (ig *ignorer) reset(globs []string) {
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+	ig.globs, ig.rules = globs, map[string][]ignorerule{}
+}
+
+// changed drops the cached rules if relpath is an ignore file.
+func (ig *ignorer) changed(relpath string) {
+	if path.Base(relpath) != ignorefile {
+		return
+	}
+	dir := path.Dir(relpath)
+	if dir == "." {
+		dir = ""
+	}
+	ig.mu.Lock()
+	delete(ig.rules, dir)
+	ig.mu.Unlock()
+}
+
+// ignored reports whether relpath is ignored.
+// like in git a path is ignored if any of its parent directories is, a negated rule can't re-include it then.
+func (ig *ignorer) ignored(relpath string, isdir bool) bool {
+	if relpath == "" {
+		return false
+	}
+	parts := strings.Split(relpath, "/")
+	for i := 1; i <= len(parts); i++ {
+		if ig.match(parts[:i], isdir || i < len(parts)) {
+			return true
+		}
+	}
+	return false
+}
+
+// match applies the rules to a path without looking at its parents.
+// the last matching rule decides and the deeper ignore files take precedence.
+func (ig *ignorer) match(parts []string, isdir bool) bool {
+	relpath := strings.Join(parts, "/")
+	ig.mu.Lock()
+	globs := ig.globs
+	ig.mu.Unlock()
+	for _, glob := range globs {
+		if matchglob(glob, relpath) {
+			return true
+		}
+	}
+	ignored := false
+	for i := range parts {
+		dir := strings.Join(parts[:i], "/")
+		for _, r := range ig.dirrules(dir) {
+			if r.match(strings.Join(parts[i:], "/"), isdir) {
+				ignored = !r.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// ignoredabs is ignored for absolute paths.
+func (ig *ignorer) ignoredabs(abspath string, isdir bool) bool {
+	relpath, ok := strings.CutPrefix(abspath, ig.root)
+	return ok && ig.ignored(relpath, isdir)
+}
@@ -0,0 +1,251 @@
+package gdsnap
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// keyheader is the "keys" metadata blob of a profile.
+// the data keys are random and they are stored wrapped by a key derived from the password and the salt.
+// rekey adds a new data key and rewraps all of them under the new password so the old revisions remain readable.
+// the key with ID 0 is the legacy key which is derived directly from the password with a hardcoded salt.
+// it's present only in the backups that were started before the key header existed.
+type keyheader struct {
+	Salt    []byte       `json:"salt"`
+	Time    uint32       `json:"time"`
+	Memory  uint32       `json:"memory"`
+	Threads uint8        `json:"threads"`
+	Current int          `json:"current"`
+	Keys    []wrappedkey `json:"keys"`
+}
+
+type wrappedkey struct {
+	ID  int    `json:"id"`
+	Key []byte `json:"key"`
+}
+
+const legacySalt = "tmc4~tyőDKßVWaSa"
+
+func legacykey(password string) []byte {
+	return argon2.IDKey([]byte(legacySalt), []byte(password), 1, 64<<10, 4, chacha20poly1305.KeySize)
+}
+
+// newkey returns a new random data key.
+func newkey() ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("gdsnap.ReadNewKey: %v", err)
+	}
+	return key, nil
+}
+
+func (h *keyheader) kek(password string) (cipher.AEAD, error) {
+	kek, err := chacha20poly1305.NewX(argon2.IDKey([]byte(password), h.Salt, h.Time, h.Memory, h.Threads, chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.CreateChachaCipher: %v", err)
+	}
+	return kek, nil
+}
+
+// newkeyheader wraps the data keys under a new password with a fresh salt.
+func newkeyheader(password string, keys map[int][]byte, current int) (*keyheader, error) {
+	h := &keyheader{Salt: make([]byte, 16), Time: 1, Memory: 64 << 10, Threads: 4, Current: current}
+	if _, err := io.ReadFull(rand.Reader, h.Salt); err != nil {
+		return nil, fmt.Errorf("gdsnap.ReadNewSalt: %v", err)
+	}
+	kek, err := h.kek(password)
+	if err != nil {
+		return nil, err
+	}
+	for id, key := range keys {
+		nonce := make([]byte, kek.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, fmt.Errorf("gdsnap.ReadNewNonce: %v", err)
+		}
+		h.Keys = append(h.Keys, wrappedkey{id, kek.Seal(nonce, nonce, key, []byte(strconv.Itoa(id)))})
+	}
+	sort.Slice(h.Keys, func(i, j int) bool { return h.Keys[i].ID < h.Keys[j].ID })
+	return h, nil
+}
+
+// unwrap returns the data keys by their ID.
+func (h *keyheader) unwrap(password string) (map[int][]byte, error) {
+	kek, err := h.kek(password)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[int][]byte{}
+	for _, wk := range h.Keys {
+		if len(wk.Key) < kek.NonceSize() {
+			return nil, fmt.Errorf("gdsnap.WrappedKeyTooShort id=%d", wk.ID)
+		}
+		key, err := kek.Open(nil, wk.Key[:kek.NonceSize()], wk.Key[kek.NonceSize():], []byte(strconv.Itoa(wk.ID)))
+		if err != nil {
+			return nil, fmt.Errorf("gdsnap.WrongPassword: %v", err)
+		}
+		keys[wk.ID] = key
+	}
+	if _, ok := keys[h.Current]; !ok {
+		return nil, fmt.Errorf("gdsnap.MissingCurrentKey id=%d", h.Current)
+	}
+	return keys, nil
+}
+
+// keyring holds the data keys of a profile.
+type keyring struct {
+	current int
+	keys    map[int][]byte
+	aeads   map[int]cipher.AEAD
+}
+
+func newkeyring(keys map[int][]byte, current int) (*keyring, error) {
+	kr := &keyring{current: current, keys: keys, aeads: map[int]cipher.AEAD{}}
+	for id, key := range keys {
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, fmt.Errorf("gdsnap.CreateChachaCipher id=%d: %v", id, err)
+		}
+		kr.aeads[id] = aead
+	}
+	return kr, nil
+}
+
+func (kr *keyring) currentaead() cipher.AEAD {
+	return kr.aeads[kr.current]
+}
+
+// oldest returns the ID of the oldest key.
+func (kr *keyring) oldest() int {
+	oldest := kr.current
+	for id := range kr.keys {
+		oldest = min(oldest, id)
+	}
+	return oldest
+}
+
+// candidates returns the keys to try for a decryption, the hinted one first.
+func (kr *keyring) candidates(hint int) []cipher.AEAD {
+	ids := make([]int, 0, len(kr.aeads))
+	for id := range kr.aeads {
+		if id != hint {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	var aeads []cipher.AEAD
+	if aead, ok := kr.aeads[hint]; ok {
+		aeads = append(aeads, aead)
+	}
+	for _, id := range ids {
+		aeads = append(aeads, kr.aeads[id])
+	}
+	return aeads
+}
+
+// open decrypts a nonce prefixed ciphertext with whichever key works.
+func (kr *keyring) open(hint int, ciphertext []byte) ([]byte, error) {
+	var err error
+	for _, aead := range kr.candidates(hint) {
+		if len(ciphertext) < aead.NonceSize() {
+			return nil, fmt.Errorf("gdsnap.CiphertextTooShort got=%d want=%d", len(ciphertext), aead.NonceSize())
+		}
+		var plaintext []byte
+		if plaintext, err = aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil); err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, err
+}
+
+// keysuffix returns the suffix of the mimetypes of the content encrypted with the current key.
+func (kr *keyring) keysuffix() string {
+	if kr.current == 0 {
+		return ""
+	}
+	return "-k" + strconv.Itoa(kr.current)
+}
+
+// mimekey splits the key ID suffix from a mimetype.
+// the mimetypes without the suffix are encrypted with the legacy key if at all.
+func mimekey(mime string) (string, int) {
+	i := strings.LastIndex(mime, "-k")
+	if i == -1 {
+		return mime, 0
+	}
+	id, err := strconv.Atoi(mime[i+2:])
+	if err != nil {
+		return mime, 0
+	}
+	return mime[:i], id
+}
+
+// loadkeys reads the key header of the profile.
+// a missing header is created if create is set, otherwise it's an error.
+func (gs *gdsnap) loadkeys(create bool) error {
+	data, err := gs.backend.getmeta("keys")
+	if errors.Is(err, fs.ErrNotExist) && create {
+		if err := gs.createkeys(); err != nil {
+			return err
+		}
+		// use what's stored in case it differs from what was written.
+		data, err = gs.backend.getmeta("keys")
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("gdsnap.MissingKeyHeader (the backup has no key header, check -gdir and -profile or run save first)")
+	}
+	if err != nil {
+		return err
+	}
+	var h keyheader
+	if err := json.Unmarshal(data, &h); err != nil {
+		return fmt.Errorf("gdsnap.ParseKeyHeader: %v", err)
+	}
+	keys, err := h.unwrap(gs.set.password)
+	if err != nil {
+		return err
+	}
+	gs.keys, err = newkeyring(keys, h.Current)
+	return err
+}
+
+// createkeys writes the key header of a new backup.
+func (gs *gdsnap) createkeys() error {
+	key, err := newkey()
+	if err != nil {
+		return err
+	}
+	keys := map[int][]byte{1: key}
+	files, err := gs.backend.list()
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		// keep the backups made before the key header readable.
+		keys[0] = legacykey(gs.set.password)
+	}
+	return gs.savekeys(keys, 1, gs.set.password)
+}
+
+// savekeys writes a new key header.
+func (gs *gdsnap) savekeys(keys map[int][]byte, current int, password string) error {
+	h, err := newkeyheader(password, keys, current)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return fmt.Errorf("gdsnap.MarshalKeyHeader: %v", err)
+	}
+	return gs.backend.putmeta("keys", data)
+}
@@ -0,0 +1,250 @@
+package gdsnap
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// leasedur is how long a remote lease is valid without a renewal.
+// the holder renews it at the third of this so a crashed holder blocks the other hosts at most this long.
+var leasedur = 10 * time.Minute
+
+// lockingsubcommands are the subcommands that modify the backup or -dir.
+// they take the local lock and the remote lease so that they don't race each other, see acquirelock.
+var lockingsubcommands = map[string]bool{"import": true, "prune": true, "rekey": true, "restore": true, "save": true, "watch": true}
+
+// lease is the remote lock of a backup stored in the "lease" metadata blob.
+type lease struct {
+	Host    string `json:"host"`
+	PID     int    `json:"pid"`
+	Op      string `json:"op"`
+	Since   string `json:"since"`
+	Expires string `json:"expires"`
+
+	// Token identifies the lease of a process.
+	Token string `json:"token"`
+}
+
+func (l lease) String() string {
+	return fmt.Sprintf("host=%s pid=%d op=%s since=%s", l.Host, l.PID, l.Op, l.Since)
+}
+
+// alive reports whether the lease's holder might still be running.
+// the holders on this host are checked via their pid, the others are trusted until the lease expires.
+func (l lease) alive(now time.Time) bool {
+	if now.UTC().Format(tLayout) >= l.Expires {
+		return false
+	}
+	if l.Host != hostname() {
+		return true
+	}
+	return l.PID == os.Getpid() || syscall.Kill(l.PID, 0) != syscall.ESRCH
+}
+
+// lockpath returns the path of the local lock file of the backup.
+func (gs *gdsnap) lockpath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("gdsnap.UserCacheDir: %v", err)
+	}
+	h := sha256.Sum256([]byte(gs.set.backend + "\x00" + gs.set.gdir + "\x00" + gs.set.profile))
+	return filepath.Join(dir, "gdsnapstate", fmt.Sprintf("%s-%x.lock", gs.set.profile, h[:8])), nil
+}
+
+// flocklocal takes the local lock of the backup and writes the holder into the lock file.
+// the lock is released when the returned file is closed, also when the process dies.
+func (gs *gdsnap) flocklocal(holder lease) (*os.File, error) {
+	name, err := gs.lockpath()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return nil, fmt.Errorf("gdsnap.MkdirLock: %v", err)
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.OpenLock file=%s: %v", name, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		content, _ := io.ReadAll(f)
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("gdsnap.Locked %s (another gdsnap operates on this backup, wait for it to finish or stop it; lock=%s)", strings.TrimSpace(string(content)), name)
+		}
+		return nil, fmt.Errorf("gdsnap.Flock file=%s: %v", name, err)
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(holder.String()+"\n"), 0)
+	}
+	return f, nil
+}
+
+// readleases returns the copies of the remote lease and their parsed form, the current lease first.
+// gdrive holds several copies after hosts raced for the lease, the oldest one is the lease, see acquirelock.
+// the unparseable copies are nil.
+func (gs *gdsnap) readleases() ([]metacopy, []*lease, error) {
+	copies, err := gs.backend.metacopies("lease")
+	if err != nil {
+		return nil, nil, fmt.Errorf("gdsnap.ReadLease: %v", err)
+	}
+	leases := make([]*lease, len(copies))
+	for i, c := range copies {
+		l := &lease{}
+		if err := json.Unmarshal(c.data, l); err != nil {
+			log.Printf("[warning] ignoring the unparseable lease: %v", err)
+			continue
+		}
+		leases[i] = l
+	}
+	return copies, leases, nil
+}
+
+// readlease returns the current remote lease or nil if there's none.
+func (gs *gdsnap) readlease() (*lease, error) {
+	_, leases, err := gs.readleases()
+	if err != nil || len(leases) == 0 {
+		return nil, err
+	}
+	return leases[0], nil
+}
+
+// marshallease returns the remote lease with a fresh expiration.
+func marshallease(l *lease) ([]byte, error) {
+	l.Expires = time.Now().Add(leasedur).UTC().Format(tLayout)
+	js, err := json.Marshal(l)
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.MarshalLease: %v", err)
+	}
+	return js, nil
+}
+
+// acquirelock takes the local lock and the remote lease of the backup for op.
+// the local lock is a flock so it's reliable but only works within a host.
+// the lease covers the other hosts backing up into the same -gdir with the same -profile.
+// it's renewed until the returned release function is called.
+func (gs *gdsnap) acquirelock(op string) (release func(), err error) {
+	token, err := randstr()
+	if err != nil {
+		return nil, err
+	}
+	l := &lease{Host: hostname(), PID: os.Getpid(), Op: op, Since: time.Now().UTC().Format(tLayout), Token: token}
+	f, err := gs.flocklocal(*l)
+	if err != nil {
+		return nil, err
+	}
+	if err := gs.acquirelease(l); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(leasedur / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			// readlease points putmeta at the current lease so this never overwrites another one's copy.
+			if cur, err := gs.readlease(); err != nil {
+				log.Printf("[warning] couldn't check the lease, skipping its renewal: %v", err)
+				continue
+			} else if cur == nil || cur.Token != l.Token {
+				log.Printf("[warning] the lease was taken over by %v, another gdsnap might race with this one.", cur)
+				warn()
+				return
+			}
+			js, err := marshallease(l)
+			if err == nil {
+				err = gs.backend.putmeta("lease", js)
+			}
+			if err != nil {
+				log.Printf("[warning] couldn't renew the lease: %v", err)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		if cur, err := gs.readlease(); err == nil && cur != nil && cur.Token == l.Token {
+			if err := gs.backend.deletemeta("lease"); err != nil {
+				log.Printf("[warning] couldn't release the lease, it expires at %s: %v", l.Expires, err)
+			}
+		}
+		f.Close()
+	}, nil
+}
+
+// acquirelease takes the remote lease of the backup for l.
+// each contender creates its own copy of the lease and the oldest copy wins,
+// the losers remove their copies so that gdrive's lack of an atomic create can't let two hosts in.
+func (gs *gdsnap) acquirelease(l *lease) error {
+	copies, leases, err := gs.readleases()
+	if err != nil {
+		return err
+	}
+	if len(leases) > 0 && leases[0] != nil && leases[0].alive(time.Now()) {
+		old := leases[0]
+		return fmt.Errorf("gdsnap.Leased %s (another gdsnap operates on this backup, wait for it to finish or stop it; the lease expires at %s unless renewed)", old, old.Expires)
+	}
+	if len(leases) > 0 && leases[0] != nil {
+		log.Printf("taking over the stale lease of %s.", leases[0])
+	}
+	// the stale copies go so that the new copies become the oldest ones.
+	for _, c := range copies {
+		if err := gs.backend.deletemetacopy("lease", c.id); err != nil {
+			log.Printf("[warning] couldn't delete the stale lease, a racing gdsnap might have deleted it already: %v", err)
+		}
+	}
+	js, err := marshallease(l)
+	if err != nil {
+		return err
+	}
+	id, err := gs.backend.addmetacopy("lease", js)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("gdsnap.LeaseRace (another gdsnap has just started on this backup)")
+	}
+	if err != nil {
+		return fmt.Errorf("gdsnap.WriteLease: %v", err)
+	}
+	// detect a racing host that created its copy at the same time.
+	copies, leases, err = gs.readleases()
+	if err != nil || len(leases) == 0 || leases[0] == nil || leases[0].Token != l.Token {
+		if err := gs.backend.deletemetacopy("lease", id); err != nil {
+			log.Printf("[warning] couldn't delete the losing copy of the lease: %v", err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(leases) == 0 {
+		return fmt.Errorf("gdsnap.LeaseRace (another gdsnap has just taken over the lease of this backup, retry)")
+	}
+	if cur := leases[0]; cur == nil || cur.Token != l.Token {
+		if cur == nil {
+			return fmt.Errorf("gdsnap.LeaseRace (another gdsnap has just started on this backup)")
+		}
+		return fmt.Errorf("gdsnap.LeaseRace %s (another gdsnap has just started on this backup)", cur)
+	}
+	// the losers remove their copies but they might die before that.
+	for _, c := range copies[1:] {
+		if err := gs.backend.deletemetacopy("lease", c.id); err != nil {
+			log.Printf("[warning] couldn't delete a losing copy of the lease: %v", err)
+		}
+	}
+	return nil
+}
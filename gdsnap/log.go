@@ -0,0 +1,124 @@
+package gdsnap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// logentry is a revision in the log subcommand's output.
+type logentry struct {
+	Time     string `json:"time"`
+	Path     string `json:"path"`
+	Kind     string `json:"kind"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Revision string `json:"revision"`
+}
+
+// revkind classifies a revision for the log.
+// prev is the mimetype of the previous revision, empty for the first one.
+func revkind(mime, prev string) string {
+	switch {
+	case mime == "gdsnap/deleted":
+		return "deleted"
+	case strings.HasPrefix(mime, "gdsnap/symlink"):
+		return "symlink"
+	case strings.HasPrefix(mime, "gdsnap/dir"):
+		return "dir"
+	case prev == "" || prev == "gdsnap/deleted":
+		return "created"
+	default:
+		return "modified"
+	}
+}
+
+// history returns the revisions of the files between since and until (inclusive) in chronological order.
+func (gs *gdsnap) history(relpaths []string, since, until string) ([]logentry, error) {
+	var entries []logentry
+	var mu sync.Mutex
+	var g errgroup.Group
+	g.SetLimit(max(*jobsFlag, 1))
+	for _, relpath := range relpaths {
+		fi := gs.files[relpath]
+		if fi.ModifiedTime < since && fi.Trashed {
+			// nothing happens to a file after its deletion.
+			continue
+		}
+		g.Go(func() error {
+			revs, err := gs.backend.revisions(&fi)
+			if err != nil {
+				return fmt.Errorf("gdsnap.LogRevisions relpath=%s: %v", relpath, err)
+			}
+			var local []logentry
+			prev := ""
+			for _, r := range revs {
+				kind := revkind(r.MimeType, prev)
+				prev = r.MimeType
+				if r.ModifiedTime < since || until != "" && r.ModifiedTime > until {
+					continue
+				}
+				var size int64
+				fmt.Sscan(r.Size, &size)
+				local = append(local, logentry{r.ModifiedTime, relpath, kind, size, r.MimeType, r.ID})
+			}
+			mu.Lock()
+			entries = append(entries, local...)
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Time != entries[j].Time {
+			return entries[i].Time < entries[j].Time
+		}
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, nil
+}
+
+func (gs *gdsnap) subcommandLog(args []string) error {
+	var since, until string
+	var err error
+	if *sinceFlag != "" {
+		if since, err = parsetime(*sinceFlag, time.Now()); err != nil {
+			return err
+		}
+	}
+	if *untilFlag != "" {
+		if until, err = parsetime(*untilFlag, time.Now()); err != nil {
+			return err
+		}
+	}
+	if err := gs.listfiles(); err != nil {
+		return err
+	}
+	entries, err := gs.history(filterfiles(gs.files, args), since, until)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, e := range entries {
+		if *jsonFlag {
+			body, err := json.Marshal(e)
+			if err != nil {
+				return fmt.Errorf("gdsnap.MarshalLogEntry relpath=%s: %v", e.Path, err)
+			}
+			fmt.Fprintln(out, string(body))
+		} else {
+			fmt.Fprintf(out, "%s %-8s %10d %s\n", e.Time, e.Kind, e.Size, e.Path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package gdsnap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// metadata is the part of a file's metadata that its mimetype doesn't record.
+// the revisions with the "-m" mimetype flag store it in front of their content, see header and readmetadata.
+// it's json so that new fields can be added later, restore ignores the ones it doesn't know.
+type metadata struct {
+	// Mtime is the modification time in unix nanoseconds.
+	Mtime int64
+
+	// UID and GID are the numeric owners, restore uses them only if User and Group don't exist locally.
+	UID, GID    int
+	User, Group string `json:",omitempty"`
+
+	// Xattrs are the extended attributes that the backing up user can read.
+	Xattrs map[string][]byte `json:",omitempty"`
+}
+
+// maxmetasize bounds the size of a metadata record so that a corrupt length doesn't allocate too much.
+const maxmetasize = 16 << 20
+
+// mimemeta splits the "-m" flag from a mimetype without the key suffix.
+func mimemeta(mime string) (string, bool) {
+	return strings.CutSuffix(mime, "-m")
+}
+
+// hasmeta reports whether the revisions with the given mimetype have a metadata record.
+func hasmeta(mime string) bool {
+	mime, _ = mimekey(mime)
+	_, ok := mimemeta(mime)
+	return ok
+}
+
+// collectmetadata reads the metadata of a file without following symlinks.
+func collectmetadata(abspath string) (*metadata, error) {
+	var st unix.Stat_t
+	if err := unix.Lstat(abspath, &st); err != nil {
+		return nil, fmt.Errorf("gdsnap.Lstat: %v", err)
+	}
+	m := &metadata{Mtime: st.Mtim.Nano(), UID: int(st.Uid), GID: int(st.Gid)}
+	if u, err := user.LookupId(strconv.Itoa(m.UID)); err == nil {
+		m.User = u.Username
+	}
+	if g, err := user.LookupGroupId(strconv.Itoa(m.GID)); err == nil {
+		m.Group = g.Name
+	}
+
+	size, err := unix.Llistxattr(abspath, nil)
+	if errors.Is(err, unix.ENOTSUP) || size == 0 {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.ListXattrs: %v", err)
+	}
+	names := make([]byte, size)
+	if size, err = unix.Llistxattr(abspath, names); err != nil {
+		return nil, fmt.Errorf("gdsnap.ListXattrs: %v", err)
+	}
+	m.Xattrs = map[string][]byte{}
+	for _, name := range strings.Split(strings.TrimRight(string(names[:size]), "\x00"), "\x00") {
+		size, err := unix.Lgetxattr(abspath, name, nil)
+		if errors.Is(err, unix.ENODATA) || errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+			// removed since the listing or not readable by this user, e.g. the trusted.* ones.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("gdsnap.GetXattr name=%s: %v", name, err)
+		}
+		value := make([]byte, size)
+		if size, err = unix.Lgetxattr(abspath, name, value); err != nil {
+			return nil, fmt.Errorf("gdsnap.GetXattr name=%s: %v", name, err)
+		}
+		m.Xattrs[name] = value[:size]
+	}
+	return m, nil
+}
+
+// apply sets the metadata on a file without following symlinks.
+// failing to change the owner is not an error for an unprivileged user since it can only give files to itself.
+func (m *metadata) apply(abspath string) error {
+	var errs []error
+	for name, value := range m.Xattrs {
+		if err := unix.Lsetxattr(abspath, name, value, 0); err != nil {
+			errs = append(errs, fmt.Errorf("gdsnap.SetXattr name=%s: %v", name, err))
+		}
+	}
+	uid, gid := m.UID, m.GID
+	if m.User != "" {
+		if u, err := user.Lookup(m.User); err == nil {
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if m.Group != "" {
+		if g, err := user.LookupGroup(m.Group); err == nil {
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	if err := unix.Lchown(abspath, uid, gid); err != nil && !(errors.Is(err, unix.EPERM) && unix.Geteuid() != 0) {
+		errs = append(errs, fmt.Errorf("gdsnap.Chown uid=%d gid=%d: %v", uid, gid, err))
+	}
+	times := []unix.Timespec{{Nsec: unix.UTIME_OMIT}, unix.NsecToTimespec(m.Mtime)}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, abspath, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		errs = append(errs, fmt.Errorf("gdsnap.SetMtime: %v", err))
+	}
+	return errors.Join(errs...)
+}
+
+// header returns the metadata in the format that precedes the content: its length as an uvarint and then the json.
+func (m *metadata) header() ([]byte, error) {
+	js, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.MarshalMetadata: %v", err)
+	}
+	return append(binary.AppendUvarint(nil, uint64(len(js))), js...), nil
+}
+
+// readmetadata reads the metadata header from r and returns the reader of the content after it.
+func readmetadata(r io.Reader) (*metadata, io.Reader, error) {
+	br, ok := r.(interface {
+		io.Reader
+		io.ByteReader
+	})
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, nil, fmt.Errorf("gdsnap.ReadMetadataSize: %v", err)
+	}
+	if size > maxmetasize {
+		return nil, nil, fmt.Errorf("gdsnap.MetadataTooLarge size=%d", size)
+	}
+	js := make([]byte, size)
+	if _, err := io.ReadFull(br, js); err != nil {
+		return nil, nil, fmt.Errorf("gdsnap.ReadMetadata: %v", err)
+	}
+	m := &metadata{}
+	if err := json.Unmarshal(js, m); err != nil {
+		return nil, nil, fmt.Errorf("gdsnap.ParseMetadata: %v", err)
+	}
+	return m, br, nil
+}
@@ -0,0 +1,406 @@
+package gdsnap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sync/errgroup"
+)
+
+// treeat returns the tree at time t with each file set to its revision at t, see revat.
+func (gs *gdsnap) treeat(t string) (map[string]fileinfo, error) {
+	tree := map[string]fileinfo{}
+	var mu sync.Mutex
+	var g errgroup.Group
+	g.SetLimit(max(*jobsFlag, 1))
+	for relpath, fi := range gs.files {
+		g.Go(func() error {
+			at, err := gs.revat(fi, t)
+			if err != nil {
+				return fmt.Errorf("gdsnap.RevisionAt relpath=%s: %v", relpath, err)
+			}
+			if at.MimeType != "gdsnap/deleted" {
+				mu.Lock()
+				tree[relpath] = at
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	return tree, g.Wait()
+}
+
+// mountmtime returns the modification time of a tree entry.
+func mountmtime(fi fileinfo) time.Time {
+	t, err := time.Parse(tLayout, fi.ModifiedTime)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// mountdir is a read-only directory of the mounted backup.
+type mountdir struct {
+	fs.Inode
+	perm  uint32
+	mtime time.Time
+}
+
+func (d *mountdir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = syscall.S_IFDIR | d.perm&^0222
+	out.SetTimes(nil, &d.mtime, &d.mtime)
+	return 0
+}
+
+// mounttree is a directory with a whole tree of files under it, e.g. head/ or a snapshot.
+// the tree's fileinfos are at the revision to show, like the ones of a snapshot.
+type mounttree struct {
+	mountdir
+	gs    *gdsnap
+	files map[string]fileinfo
+}
+
+func newmounttree(gs *gdsnap, files map[string]fileinfo) *mounttree {
+	return &mounttree{mountdir{perm: 0555}, gs, files}
+}
+
+func (t *mounttree) OnAdd(ctx context.Context) {
+	for relpath, fi := range t.files {
+		dir, base := path.Split(relpath)
+		p := &t.Inode
+		for _, component := range strings.Split(dir, "/") {
+			if component == "" {
+				continue
+			}
+			child := p.GetChild(component)
+			if child == nil {
+				child = p.NewPersistentInode(ctx, &mountdir{perm: 0555}, fs.StableAttr{Mode: syscall.S_IFDIR})
+				p.AddChild(component, child, true)
+			}
+			p = child
+		}
+
+		mime, _ := mimekey(fi.MimeType)
+		mime, _ = mimemeta(mime)
+		var node fs.InodeEmbedder
+		mode := uint32(syscall.S_IFREG)
+		switch {
+		case strings.HasPrefix(mime, "gdsnap/dir"):
+			// an existing mountdir means the directory got files after this entry was saved.
+			if child := p.GetChild(base); child != nil {
+				continue
+			}
+			node, mode = &mountdir{perm: uint32(fileperm(mime)), mtime: mountmtime(fi)}, syscall.S_IFDIR
+		case mime == "gdsnap/symlink":
+			node, mode = &mountlink{gs: t.gs, fi: fi}, syscall.S_IFLNK
+		default:
+			node = &mountfile{gs: t.gs, fi: fi, size: -1}
+		}
+		p.AddChild(base, p.NewPersistentInode(ctx, node, fs.StableAttr{Mode: mode}), true)
+	}
+}
+
+// mountsnapshots is the snapshots/ directory, it has a mounttree for each snapshot.
+// the snapshots are loaded on the first access.
+type mountsnapshots struct {
+	mountdir
+	gs *gdsnap
+}
+
+func (d *mountsnapshots) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	ids, err := d.gs.snapshots()
+	if err != nil {
+		log.Printf("[warning] couldn't list the snapshots: %v", err)
+		return nil, syscall.EIO
+	}
+	entries := make([]fuse.DirEntry, len(ids))
+	for i, id := range ids {
+		entries[i] = fuse.DirEntry{Name: id, Mode: syscall.S_IFDIR}
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (d *mountsnapshots) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if child := d.GetChild(name); child != nil {
+		return child, 0
+	}
+	files, err := d.gs.readsnapshot(name)
+	if err != nil {
+		log.Printf("[warning] couldn't read snapshot %s: %v", name, err)
+		return nil, syscall.ENOENT
+	}
+	tree := newmounttree(d.gs, files)
+	tree.mtime, _ = time.Parse(tLayout, name)
+	child := d.NewPersistentInode(ctx, tree, fs.StableAttr{Mode: syscall.S_IFDIR})
+	d.AddChild(name, child, true)
+	return child, 0
+}
+
+// mountbytime is the by-time/ directory.
+// it looks empty but any time in the -t format can be looked up in it, e.g. by-time/2024-05-01 or by-time/36h.
+type mountbytime struct {
+	mountdir
+	gs *gdsnap
+}
+
+func (d *mountbytime) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return fs.NewListDirStream(nil), 0
+}
+
+func (d *mountbytime) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if child := d.GetChild(name); child != nil {
+		return child, 0
+	}
+	t, err := parsetime(name, time.Now())
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+	files, err := d.gs.treeat(t)
+	if err != nil {
+		log.Printf("[warning] couldn't list the files at %s: %v", t, err)
+		return nil, syscall.EIO
+	}
+	tree := newmounttree(d.gs, files)
+	tree.mtime, _ = time.Parse(tLayout, t)
+	child := d.NewPersistentInode(ctx, tree, fs.StableAttr{Mode: syscall.S_IFDIR})
+	d.AddChild(name, child, true)
+	return child, 0
+}
+
+// mountlink is a symlink of the mounted backup, its target is fetched on the first access.
+type mountlink struct {
+	fs.Inode
+	gs *gdsnap
+	fi fileinfo
+
+	mu     sync.Mutex
+	target []byte
+}
+
+func (l *mountlink) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	mtime := mountmtime(l.fi)
+	out.Mode = syscall.S_IFLNK | 0777
+	out.SetTimes(nil, &mtime, &mtime)
+	return 0
+}
+
+func (l *mountlink) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.target != nil {
+		return l.target, 0
+	}
+	_, _, content, err := l.gs.fetchrev(&l.fi, l.fi.HeadRevisionID, l.fi.MimeType)
+	if err == nil {
+		l.target, err = io.ReadAll(content)
+		content.Close()
+	}
+	if err != nil {
+		log.Printf("[warning] couldn't fetch %s: %v", namePart(l.fi.Name), err)
+		return nil, syscall.EIO
+	}
+	return l.target, 0
+}
+
+// mountfile is a file of the mounted backup, its content is fetched when it's opened.
+// the size is the stored size until the file is read because only the content tells the real one.
+type mountfile struct {
+	fs.Inode
+	gs *gdsnap
+	fi fileinfo
+
+	mu   sync.Mutex
+	size int64
+}
+
+func (f *mountfile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	mtime := mountmtime(f.fi)
+	out.Mode = syscall.S_IFREG | uint32(fileperm(f.fi.MimeType))&^0222
+	f.mu.Lock()
+	size := f.size
+	f.mu.Unlock()
+	if size < 0 {
+		size, _ = strconv.ParseInt(f.fi.Size, 10, 64)
+	}
+	out.Size = uint64(size)
+	out.SetTimes(nil, &mtime, &mtime)
+	return 0
+}
+
+// Open fetches the content.
+// the small files are read into memory at once, the gdsnap/stream ones are read as the reads come.
+func (f *mountfile) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	stream := strings.HasPrefix(f.fi.MimeType, "gdsnap/stream")
+	if strings.HasPrefix(f.fi.MimeType, "gdsnap/ref") {
+		target, err := f.gs.resolveref(&f.fi, f.fi.HeadRevisionID)
+		if err != nil {
+			log.Printf("[warning] couldn't resolve %s: %v", namePart(f.fi.Name), err)
+			return nil, 0, syscall.EIO
+		}
+		stream = target.stream
+	}
+	h := &mounthandle{f: f}
+	if stream {
+		return h, fuse.FOPEN_DIRECT_IO, 0
+	}
+	if errno := h.reopen(); errno != 0 {
+		return nil, 0, errno
+	}
+	content, err := io.ReadAll(h.rc)
+	h.Release(ctx)
+	if err != nil {
+		log.Printf("[warning] couldn't fetch %s: %v", namePart(f.fi.Name), err)
+		return nil, 0, syscall.EIO
+	}
+	f.setsize(int64(len(content)))
+	return &mounthandle{f: f, content: content}, 0, 0
+}
+
+func (f *mountfile) setsize(size int64) {
+	f.mu.Lock()
+	f.size = size
+	f.mu.Unlock()
+}
+
+// mounthandle is an open file, either with its whole content in memory
+// or with the gdsnap/stream content read sequentially.
+// a read before the current position of a stream restarts its download.
+type mounthandle struct {
+	f       *mountfile
+	content []byte
+
+	mu  sync.Mutex
+	rc  io.ReadCloser
+	pos int64
+}
+
+func (h *mounthandle) reopen() syscall.Errno {
+	if h.rc != nil {
+		h.rc.Close()
+	}
+	h.rc, h.pos = nil, 0
+	_, _, rc, err := h.f.gs.fetchrev(&h.f.fi, h.f.fi.HeadRevisionID, h.f.fi.MimeType)
+	if err != nil {
+		log.Printf("[warning] couldn't fetch %s: %v", namePart(h.f.fi.Name), err)
+		return syscall.EIO
+	}
+	h.rc = rc
+	return 0
+}
+
+func (h *mounthandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if h.content != nil {
+		end := min(off+int64(len(dest)), int64(len(h.content)))
+		return fuse.ReadResultData(h.content[min(off, end):end]), 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rc == nil || off < h.pos {
+		if errno := h.reopen(); errno != 0 {
+			return nil, errno
+		}
+	}
+	if off > h.pos {
+		n, err := io.CopyN(io.Discard, h.rc, off-h.pos)
+		h.pos += n
+		if err == io.EOF {
+			h.f.setsize(h.pos)
+			return fuse.ReadResultData(nil), 0
+		}
+		if err != nil {
+			log.Printf("[warning] couldn't read %s: %v", namePart(h.f.fi.Name), err)
+			return nil, syscall.EIO
+		}
+	}
+	n, err := io.ReadFull(h.rc, dest)
+	h.pos += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		h.f.setsize(h.pos)
+	} else if err != nil {
+		log.Printf("[warning] couldn't read %s: %v", namePart(h.f.fi.Name), err)
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (h *mounthandle) Release(ctx context.Context) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rc != nil {
+		h.rc.Close()
+		h.rc = nil
+	}
+	return 0
+}
+
+// mountroot is the root of the mounted backup.
+type mountroot struct {
+	mountdir
+	gs   *gdsnap
+	head map[string]fileinfo
+}
+
+func (r *mountroot) OnAdd(ctx context.Context) {
+	dir := fs.StableAttr{Mode: syscall.S_IFDIR}
+	r.AddChild("head", r.NewPersistentInode(ctx, newmounttree(r.gs, r.head), dir), true)
+	r.AddChild("snapshots", r.NewPersistentInode(ctx, &mountsnapshots{mountdir{perm: 0555}, r.gs}, dir), true)
+	r.AddChild("by-time", r.NewPersistentInode(ctx, &mountbytime{mountdir{perm: 0555}, r.gs}, dir), true)
+}
+
+// mount mounts the backup at mountpoint and returns the fuse server.
+func (gs *gdsnap) mount(mountpoint string) (*fuse.Server, error) {
+	if err := gs.listfiles(); err != nil {
+		return nil, err
+	}
+	head := map[string]fileinfo{}
+	for relpath, fi := range gs.files {
+		if !fi.Trashed {
+			head[relpath] = fi
+		}
+	}
+	root := &mountroot{mountdir{perm: 0555, mtime: time.Now()}, gs, head}
+	opts := &fs.Options{MountOptions: fuse.MountOptions{FsName: "gdsnap", Name: "gdsnap", DirectMount: true, Options: []string{"ro"}}}
+	server, err := fs.Mount(mountpoint, root, opts)
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.Mount: %v", err)
+	}
+	return server, nil
+}
+
+func (gs *gdsnap) subcommandMount(args []string) error {
+	if len(args) != 1 {
+		fmt.Println("usage: gdsnap [flags] mount [mountpoint]")
+		return nil
+	}
+	server, err := gs.mount(args[0])
+	if err != nil {
+		return err
+	}
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigch
+		log.Print("unmounting.")
+		if err := server.Unmount(); err != nil {
+			log.Printf("[warning] couldn't unmount %s, use fusermount -u to unmount it: %v", args[0], err)
+		}
+	}()
+	log.Printf("mounted the backup at %s, interrupt to unmount.", args[0])
+	server.Wait()
+	return nil
+}
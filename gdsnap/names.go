@@ -0,0 +1,168 @@
+package gdsnap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// nameBackend encrypts the names and the mimetypes of the files stored in another backend, see -encryptnames.
+// the relpath part of the names is padded to a multiple of namePadding bytes before the encryption to hide the exact lengths.
+// the checksum part of the names is already keyed in this mode, see gdsnap.contentsum.
+type nameBackend struct {
+	backend
+	keys *keyring
+}
+
+const namePadding = 32
+
+func (nb *nameBackend) seal(plaintext []byte) (string, error) {
+	aead := nb.keys.currentaead()
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("gdsnap.ReadNewNonce: %v", err)
+	}
+	return hex.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func (nb *nameBackend) open(s string) ([]byte, error) {
+	ciphertext, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	// the names don't record their key so try the current key first.
+	return nb.keys.open(nb.keys.current, ciphertext)
+}
+
+// splitname splits a fileinfo.Name into its relpath and checksum parts.
+func splitname(name string) (relpath, sum string) {
+	i := strings.LastIndexByte(name, '/')
+	if i == -1 {
+		return name, ""
+	}
+	return name[:i], name[i+1:]
+}
+
+func (nb *nameBackend) encryptname(name string) (string, error) {
+	relpath, sum := splitname(name)
+	padded := make([]byte, (len(relpath)+namePadding)/namePadding*namePadding)
+	copy(padded, relpath)
+	encrypted, err := nb.seal(padded)
+	return encrypted + "/" + sum, err
+}
+
+func (nb *nameBackend) decryptname(name string) (string, error) {
+	encrypted, sum := splitname(name)
+	padded, err := nb.open(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("gdsnap.DecryptName name=%q (is -encryptnames or -password different from when the file was saved?): %v", name, err)
+	}
+	return string(bytes.TrimRight(padded, "\x00")) + "/" + sum, nil
+}
+
+func (nb *nameBackend) encryptmime(mime string) (string, error) {
+	encrypted, err := nb.seal([]byte(mime))
+	return "gdsnap/enc" + encrypted, err
+}
+
+func (nb *nameBackend) decryptmime(mime string) (string, error) {
+	encrypted, ok := strings.CutPrefix(mime, "gdsnap/enc")
+	if !ok {
+		return "", fmt.Errorf("gdsnap.UnencryptedMimetype mimetype=%q (is -encryptnames different from when the file was saved?)", mime)
+	}
+	plaintext, err := nb.open(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("gdsnap.DecryptMimetype: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// decrypthead decrypts the name and the mimetype of a listed file.
+func (nb *nameBackend) decrypthead(fi fileinfo) (fileinfo, error) {
+	var err error
+	if fi.Name, err = nb.decryptname(fi.Name); err != nil {
+		return fi, err
+	}
+	if fi.MimeType, err = nb.decryptmime(fi.MimeType); err != nil {
+		return fi, fmt.Errorf("gdsnap.DecryptHead name=%s: %v", namePart(fi.Name), err)
+	}
+	return fi, nil
+}
+
+func (nb *nameBackend) list() (map[string]fileinfo, error) {
+	files, err := nb.backend.list()
+	if err != nil {
+		return nil, err
+	}
+	return nb.decryptlisting(files)
+}
+
+// decryptlisting decrypts the heads of a listing of the underlying backend and keys them by their relpath.
+func (nb *nameBackend) decryptlisting(files map[string]fileinfo) (map[string]fileinfo, error) {
+	decrypted := make(map[string]fileinfo, len(files))
+	for _, fi := range files {
+		fi, err := nb.decrypthead(fi)
+		if err != nil {
+			return nil, err
+		}
+		decrypted[namePart(fi.Name)] = fi
+	}
+	return decrypted, nil
+}
+
+func (nb *nameBackend) changes(token string) ([]fileinfo, string, error) {
+	files, token, err := nb.backend.changes(token)
+	if err != nil {
+		return nil, "", err
+	}
+	for i, fi := range files {
+		if fi.Name == "" {
+			continue
+		}
+		if files[i], err = nb.decrypthead(fi); err != nil {
+			return nil, "", err
+		}
+	}
+	return files, token, nil
+}
+
+func (nb *nameBackend) upload(fi fileinfo, r io.Reader) (fileinfo, error) {
+	name, mime := fi.Name, fi.MimeType
+	var err error
+	if fi.Name, err = nb.encryptname(name); err != nil {
+		return fi, err
+	}
+	if fi.MimeType, err = nb.encryptmime(mime); err != nil {
+		return fi, err
+	}
+	fi, err = nb.backend.upload(fi, r)
+	fi.Name, fi.MimeType = name, mime
+	return fi, err
+}
+
+func (nb *nameBackend) trash(fi fileinfo) (fileinfo, error) {
+	fi.Trashed, fi.MimeType, fi.ModifiedTime, fi.Size = true, "gdsnap/deleted", "", "0"
+	return nb.upload(fi, strings.NewReader(""))
+}
+
+func (nb *nameBackend) revisions(fi *fileinfo) ([]revinfo, error) {
+	revs, err := nb.backend.revisions(fi)
+	if err != nil {
+		return nil, err
+	}
+	for i := range revs {
+		if revs[i].MimeType, err = nb.decryptmime(revs[i].MimeType); err != nil {
+			return nil, fmt.Errorf("gdsnap.DecryptRevision name=%s rev=%s: %v", namePart(fi.Name), revs[i].ID, err)
+		}
+		if revs[i].OriginalFilename == "" {
+			continue
+		}
+		if revs[i].OriginalFilename, err = nb.decryptname(revs[i].OriginalFilename); err != nil {
+			return nil, err
+		}
+	}
+	return revs, nil
+}
@@ -0,0 +1,197 @@
+package gdsnap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkoverwrite returns an error if replacing the local file at abspath would lose data.
+// a missing file and a file whose content is one of the backed up revisions are safe to replace.
+// a directory is never replaced, only its metadata is restored if the backup is a directory too.
+func (gs *gdsnap) checkoverwrite(fi *fileinfo, abspath string) error {
+	finfo, err := os.Lstat(abspath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("gdsnap.StatLocal: %v", err)
+	}
+	if finfo.IsDir() && strings.HasPrefix(fi.MimeType, "gdsnap/dir") {
+		return nil
+	}
+	if finfo.IsDir() {
+		return fmt.Errorf("gdsnap.LocalIsDirectory")
+	}
+	var sum string
+	if finfo.Mode().IsRegular() {
+		if sum, err = gs.hashfile(abspath); err != nil {
+			return fmt.Errorf("gdsnap.HashLocal: %v", err)
+		}
+		if sum == shasumPart(fi.Name) {
+			return nil
+		}
+	} else if finfo.Mode().Type() != fs.ModeSymlink {
+		return fmt.Errorf("gdsnap.LocalNotRegular mode=%s", finfo.Mode())
+	}
+	revs, err := gs.backend.revisions(fi)
+	if err != nil {
+		return err
+	}
+	for _, r := range revs {
+		// the symlinks have no checksum so any symlink is replaceable if the file was ever a symlink.
+		if mime, _ := mimekey(r.MimeType); strings.HasPrefix(mime, "gdsnap/symlink") && sum == "" {
+			return nil
+		}
+		if sum != "" && r.OriginalFilename != "" && shasumPart(r.OriginalFilename) == sum {
+			return nil
+		}
+	}
+	return fmt.Errorf("gdsnap.LocalChangesNotBackedUp")
+}
+
+// restorefile writes the content to abspath through a temporary file in the same directory.
+// abspath is replaced only after the whole content is downloaded and decrypted.
+// the metadata is applied if it's not nil, failing to do so is only a warning.
+func restorefile(abspath, mime string, meta *metadata, content io.Reader) error {
+	applymeta := func(name string) {
+		if meta == nil {
+			return
+		}
+		if err := meta.apply(name); err != nil {
+			log.Printf("[warning] couldn't restore the metadata of %s: %v", abspath, err)
+		}
+	}
+	if strings.HasPrefix(mime, "gdsnap/dir") {
+		if err := os.MkdirAll(abspath, 0755); err != nil {
+			return fmt.Errorf("gdsnap.CreateDir: %v", err)
+		}
+		applymeta(abspath)
+		return os.Chmod(abspath, fileperm(mime))
+	}
+	dir := filepath.Dir(abspath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("gdsnap.CreateDir: %v", err)
+	}
+	f, err := os.CreateTemp(dir, ".gdsnap.restore.*")
+	if err != nil {
+		return fmt.Errorf("gdsnap.CreateTemp: %v", err)
+	}
+	tmpname := f.Name()
+	if mime == "gdsnap/symlink" {
+		f.Close()
+		os.Remove(tmpname)
+		var symlink []byte
+		if symlink, err = io.ReadAll(content); err == nil {
+			err = os.Symlink(string(symlink), tmpname)
+		}
+		if err == nil {
+			applymeta(tmpname)
+		}
+	} else {
+		_, err = io.Copy(f, content)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		// the chmod goes last because a chown clears the setuid bits.
+		if err == nil {
+			applymeta(tmpname)
+			err = os.Chmod(tmpname, fileperm(mime))
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmpname, abspath)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	return nil
+}
+
+// restoreat returns the revision that restore restores without fetching it, see revfetch.
+func (gs *gdsnap) restoreat(fi fileinfo) (fileinfo, error) {
+	if len(*snapshotFlag) > 0 || len(*tFlag) == 0 {
+		// the files of a -snapshot are already at the snapshot's revisions.
+		return fi, nil
+	}
+	return gs.revat(fi, *tFlag)
+}
+
+func (gs *gdsnap) subcommandRestore(args []string) error {
+	if len(args) == 0 {
+		fmt.Println("usage: gdsnap [flags] restore [globs...]")
+		return nil
+	}
+	if err := gs.listtree(); err != nil {
+		return err
+	}
+	root := gs.set.dir
+	if *stagedirFlag != "" {
+		root = *stagedirFlag
+	}
+
+	var conflicts, failures int
+	for _, relpath := range filterfiles(gs.files, args) {
+		fi := gs.files[relpath]
+		fullpath := filepath.Join(root, relpath)
+		if *stagedirFlag == "" && !*forceFlag {
+			if err := gs.checkoverwrite(&fi, fullpath); err != nil {
+				conflicts++
+				fmt.Printf("conflict %s: %v\n", relpath, err)
+				continue
+			}
+		}
+		if *dryrunFlag {
+			// the dry run doesn't fetch anything, the revision's mimetype tells what would happen.
+			at, err := gs.restoreat(fi)
+			if err != nil {
+				return err
+			}
+			if at.MimeType != "gdsnap/deleted" {
+				fmt.Printf("would restore %s.\n", relpath)
+			} else if _, err := os.Lstat(fullpath); err == nil {
+				fmt.Printf("would delete %s.\n", relpath)
+			}
+			continue
+		}
+		mime, meta, content, err := gs.revfetch(&fi, "")
+		if err != nil {
+			return err
+		}
+
+		if mime == "gdsnap/deleted" {
+			if _, err := os.Lstat(fullpath); err != nil {
+				continue
+			}
+			if err := os.Remove(fullpath); err != nil {
+				failures++
+				log.Printf("couldn't delete %s: %v", relpath, err)
+			} else {
+				log.Printf("deleted %s", relpath)
+			}
+			continue
+		}
+		err = restorefile(fullpath, mime, meta, content)
+		content.Close()
+		if err != nil {
+			failures++
+			log.Printf("couldn't restore %s: %v", relpath, err)
+			continue
+		}
+		log.Printf("successfully restored %s", relpath)
+	}
+	if *dryrunFlag && conflicts > 0 {
+		fmt.Printf("the restore would fail with %d conflicts (use -force to overwrite the conflicting files or -stagedir to restore elsewhere).\n", conflicts)
+		return nil
+	}
+	if conflicts+failures > 0 {
+		return fmt.Errorf("gdsnap.RestoreFailed conflicts=%d failures=%d (use -force to overwrite the conflicting files or -stagedir to restore elsewhere)", conflicts, failures)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package gdsnap
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retentiontier keeps one revision per interval among the revisions younger than age.
+// the interval is 0 if all revisions are kept.
+type retentiontier struct {
+	age, interval time.Duration
+}
+
+const forever = time.Duration(math.MaxInt64)
+
+// parseperiod parses a duration that can use the d (day), w (week) and y (365 days) units too.
+func parseperiod(s string) (time.Duration, error) {
+	for _, u := range []struct {
+		suffix string
+		unit   time.Duration
+	}{{"d", 24 * time.Hour}, {"w", 7 * 24 * time.Hour}, {"y", 365 * 24 * time.Hour}} {
+		if n, ok := strings.CutSuffix(s, u.suffix); ok {
+			f, err := strconv.ParseFloat(n, 64)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(f * float64(u.unit)), nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// parseretention parses the -retention flag.
+func parseretention(s string) ([]retentiontier, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var tiers []retentiontier
+	for _, entry := range strings.Split(s, ",") {
+		agestr, intervalstr, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("gdsnap.ParseRetention entry=%q: missing the :", entry)
+		}
+		var tier retentiontier
+		var err error
+		if agestr == "forever" {
+			tier.age = forever
+		} else if tier.age, err = parseperiod(agestr); err != nil {
+			return nil, fmt.Errorf("gdsnap.ParseRetentionAge entry=%q: %v", entry, err)
+		}
+		if intervalstr != "all" {
+			if tier.interval, err = parseperiod(intervalstr); err != nil || tier.interval <= 0 {
+				return nil, fmt.Errorf("gdsnap.ParseRetentionInterval entry=%q: %v", entry, err)
+			}
+		}
+		if len(tiers) > 0 && tier.age <= tiers[len(tiers)-1].age {
+			return nil, fmt.Errorf("gdsnap.RetentionAgesNotIncreasing entry=%q", entry)
+		}
+		tiers = append(tiers, tier)
+	}
+	return tiers, nil
+}
+
+// retained returns which of the chronologically ordered times the policy keeps.
+// the last one is always kept because it's the head.
+// from each interval of a tier the latest one is kept.
+// the unparsable times are kept to be on the safe side.
+func retained(times []string, now time.Time, tiers []retentiontier) []bool {
+	type bucket struct {
+		tier int
+		n    int64
+	}
+	keep := make([]bool, len(times))
+	seen := map[bucket]bool{}
+	for i := len(times) - 1; i >= 0; i-- {
+		t, err := time.Parse(tLayout, times[i])
+		if i == len(times)-1 || err != nil {
+			keep[i] = true
+			continue
+		}
+		age := now.Sub(t)
+		for tier, rt := range tiers {
+			if age >= rt.age {
+				continue
+			}
+			if rt.interval == 0 {
+				keep[i] = true
+			} else if b := (bucket{tier, t.UnixNano() / int64(rt.interval)}); !seen[b] {
+				keep[i], seen[b] = true, true
+			}
+			break
+		}
+	}
+	return keep
+}
+
+// retain marks the revisions of a file that the retention policy keeps to be kept forever.
+// watch calls it after each save so that gdrive's pruning doesn't delete them before the next prune.
+func (gs *gdsnap) retain(fi *fileinfo) error {
+	revs, err := gs.backend.revisions(fi)
+	if err != nil {
+		return err
+	}
+	times := make([]string, len(revs))
+	for i, r := range revs {
+		times[i] = r.ModifiedTime
+	}
+	keep := retained(times, time.Now(), gs.retention)
+	for i, r := range revs[:max(len(revs)-1, 0)] {
+		if keep[i] && !r.KeepForever {
+			if err := gs.backend.keep(fi, r.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prune enforces the retention policy on all the revisions and the snapshots.
+// the revisions referenced by a gdsnap/ref revision or by a retained snapshot are kept regardless of the policy.
+// in dry-run mode it only prints what it would delete.
+func (gs *gdsnap) prune(dryrun bool) error {
+	now := time.Now()
+	protected := map[string]bool{}
+
+	ids, err := gs.snapshots()
+	if err != nil {
+		return err
+	}
+	deletedsnapshots := 0
+	for i, keep := range retained(ids, now, gs.retention) {
+		if !keep {
+			deletedsnapshots++
+			if dryrun {
+				fmt.Printf("would delete snapshot %s.\n", ids[i])
+			} else if err := gs.backend.deletemeta("snapshot." + ids[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		files, err := gs.readsnapshot(ids[i])
+		if err != nil {
+			return err
+		}
+		for _, fi := range files {
+			protected[fi.ID+"/"+fi.HeadRevisionID] = true
+		}
+	}
+
+	if err := gs.listfiles(); err != nil {
+		return err
+	}
+	relpaths := filterfiles(gs.files, nil)
+	allrevs := map[string][]revinfo{}
+	for _, relpath := range relpaths {
+		fi := gs.files[relpath]
+		revs, err := gs.backend.revisions(&fi)
+		if err != nil {
+			return err
+		}
+		allrevs[relpath] = revs
+		for _, r := range revs {
+			if !strings.HasPrefix(r.MimeType, "gdsnap/ref") {
+				continue
+			}
+			target, err := gs.resolveref(&fi, r.ID)
+			if err != nil {
+				return fmt.Errorf("gdsnap.ResolveRef relpath=%s rev=%s: %v", relpath, r.ID, err)
+			}
+			protected[target.fileID+"/"+target.revID] = true
+		}
+	}
+
+	deletedrevs := 0
+	for _, relpath := range relpaths {
+		fi, revs := gs.files[relpath], allrevs[relpath]
+		times := make([]string, len(revs))
+		for i, r := range revs {
+			times[i] = r.ModifiedTime
+		}
+		keep := retained(times, now, gs.retention)
+		for i, r := range revs[:max(len(revs)-1, 0)] {
+			if keep[i] || protected[fi.ID+"/"+r.ID] {
+				if !r.KeepForever && !dryrun {
+					if err := gs.backend.keep(&fi, r.ID); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			deletedrevs++
+			if dryrun {
+				fmt.Printf("would delete %s revision %s from %s.\n", relpath, r.ID, r.ModifiedTime)
+			} else if err := gs.backend.deleterev(&fi, r.ID); err != nil {
+				return err
+			}
+		}
+	}
+	if dryrun {
+		fmt.Printf("would delete %d revisions and %d snapshots.\n", deletedrevs, deletedsnapshots)
+	} else {
+		log.Printf("pruned %d revisions and %d snapshots.", deletedrevs, deletedsnapshots)
+	}
+	return nil
+}
+
+func (gs *gdsnap) subcommandPrune(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("gdsnap.UnexpectedArgs")
+	}
+	if len(gs.retention) == 0 {
+		return fmt.Errorf("gdsnap.MissingRetention (set -retention for prune)")
+	}
+	return gs.prune(*dryrunFlag)
+}
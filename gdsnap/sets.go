@@ -0,0 +1,164 @@
+package gdsnap
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// backupset is a directory and the backup it's backed up into.
+// watch can back up several sets at once, see -sets, the other subcommands operate on the set of the flags.
+type backupset struct {
+	profile, backend, dir, gdir, password, retention string
+	encryptnames                                     bool
+	ignore                                           []string
+
+	// configured is set for the sets of -sets, they come from the config files rather than the flags.
+	configured bool
+}
+
+// setflags are the flags that can differ between the sets of -sets, the rest are shared.
+var setflags = []string{"backend", "dir", "encryptnames", "gdir", "ignore", "password", "retention"}
+
+// splitglobs splits the comma separated globs of -ignore.
+func splitglobs(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// flagset returns the set described by the flags.
+func flagset() *backupset {
+	return valueset(flagvalues())
+}
+
+// valueset returns the set described by the flag values keyed by the flag name, see flagvalues.
+func valueset(values map[string]string) *backupset {
+	// the flags and checkflagvalue accepted the value.
+	encryptnames, _ := strconv.ParseBool(values["encryptnames"])
+	return &backupset{
+		profile:      values["profile"],
+		backend:      values["backend"],
+		dir:          values["dir"],
+		gdir:         values["gdir"],
+		password:     values["password"],
+		retention:    values["retention"],
+		encryptnames: encryptnames,
+		ignore:       splitglobs(values["ignore"]),
+	}
+}
+
+// configset returns the set of a profile from the config lines of the profile and of *.
+// the setflags missing from the config have their default value except dir and gdir which are mandatory.
+func configset(profile string) (*backupset, error) {
+	values := map[string]string{}
+	err := configlines(profile, func(cfgfile, flagname, value string) error {
+		values[flagname] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"dir", "gdir"} {
+		if values[name] == "" {
+			return nil, fmt.Errorf("gdsnap.MissingSetFlag set=%s flag=%s (add a %q line for it to the config)", profile, name, profile+" "+name+` "..."`)
+		}
+	}
+	for _, name := range setflags {
+		if _, ok := values[name]; !ok {
+			values[name] = flag.Lookup(name).DefValue
+		}
+	}
+	set := &backupset{
+		profile:    profile,
+		backend:    values["backend"],
+		dir:        values["dir"],
+		gdir:       values["gdir"],
+		password:   values["password"],
+		retention:  values["retention"],
+		ignore:     splitglobs(values["ignore"]),
+		configured: true,
+	}
+	if !strings.HasSuffix(set.dir, "/") {
+		set.dir += "/"
+	}
+	if set.encryptnames, err = strconv.ParseBool(values["encryptnames"]); err != nil {
+		return nil, fmt.Errorf("gdsnap.ParseSetFlag set=%s flag=encryptnames: %v", profile, err)
+	}
+	return set, nil
+}
+
+// subcommandWatchSets runs watch for each set of -sets in one process.
+// the sets share the access token, the -jobs slots and the stats.
+func subcommandWatchSets(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("gdsnap.UnexpectedArgs")
+	}
+	var sets []*gdsnap
+	slots, tok, st := make(chan struct{}, max(*jobsFlag, 1)), &accesstoken{}, &stats{}
+	dirs := map[string]string{}
+	for _, name := range strings.Split(*setsFlag, ",") {
+		set, err := configset(name)
+		if err != nil {
+			return err
+		}
+		for dir, other := range dirs {
+			if strings.HasPrefix(set.dir, dir) || strings.HasPrefix(dir, set.dir) {
+				return fmt.Errorf("gdsnap.OverlappingSets sets=%s,%s dirs=%s,%s", other, name, dir, set.dir)
+			}
+		}
+		dirs[set.dir] = name
+		gs := &gdsnap{set: set, slots: slots, tok: tok, stats: st}
+		if err := gs.initbackend(); err != nil {
+			return fmt.Errorf("gdsnap.InitSet set=%s: %v", name, err)
+		}
+		release, err := gs.acquirelock("watch")
+		if err != nil {
+			return fmt.Errorf("gdsnap.LockSet set=%s: %v", name, err)
+		}
+		defer release()
+		if err := gs.initkeys(true); err != nil {
+			return fmt.Errorf("gdsnap.InitSet set=%s: %v", name, err)
+		}
+		log.Printf("backing up %s into the %s set.", set.dir, name)
+		sets = append(sets, gs)
+	}
+	return watchsets(sets)
+}
+
+// watchsets runs the watch loops of the sets until one of them fails or all of them quit.
+// a failing set stops the others, it returns only after all of them returned so that the caller can release their locks.
+func watchsets(sets []*gdsnap) error {
+	ctlch, stop, err := servedaemon(sets[0].stats)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	setchs := make([]chan ctlrequest, len(sets))
+	errch := make(chan error, len(sets))
+	for i, gs := range sets {
+		setchs[i] = make(chan ctlrequest)
+		go func() {
+			err := gs.watch(ctx, setchs[i])
+			if err != nil && gs.set.configured {
+				err = fmt.Errorf("gdsnap.WatchSet set=%s: %v", gs.set.profile, err)
+			}
+			errch <- err
+		}()
+	}
+	go dispatchcontrol(ctx, ctlch, sets, setchs)
+	var firsterr error
+	for range sets {
+		if err := <-errch; err != nil && firsterr == nil {
+			firsterr = err
+			cancel()
+		}
+	}
+	return firsterr
+}
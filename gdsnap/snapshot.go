@@ -0,0 +1,182 @@
+package gdsnap
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// snapshot is the manifest of the backed up tree at the end of a watch cycle.
+// it's stored as the "snapshot.[id]" metadata blob, compressed and encrypted like the file contents.
+// the encryption authenticates it so a tampered manifest fails to load.
+// the ID is the UTC time of the snapshot in the tLayout format.
+// it's inside the manifest too so that a manifest can't be passed off as another one by renaming it.
+type snapshot struct {
+	ID string
+
+	// Files are the non-deleted files keyed by the relpath.
+	// the HeadRevisionID is the revision at the time of the snapshot, not the current head.
+	Files map[string]fileinfo
+}
+
+// savesnapshot records the current tree as a snapshot unless it's the same as the last one.
+// the revisions it references are marked to be kept forever.
+func (gs *gdsnap) savesnapshot() error {
+	files := map[string]fileinfo{}
+	for relpath, fi := range gs.files {
+		if !fi.Trashed {
+			files[relpath] = fi
+		}
+	}
+	samerev := func(a, b fileinfo) bool { return a.ID == b.ID && a.HeadRevisionID == b.HeadRevisionID }
+	if gs.snapshot != nil && maps.EqualFunc(files, gs.snapshot, samerev) {
+		return nil
+	}
+	// gdrive purges the old revisions so the snapshot's revisions are kept forever before it's written.
+	// the ones in the previous snapshot are kept already.
+	var g errgroup.Group
+	g.SetLimit(cap(gs.slots))
+	for relpath, fi := range files {
+		if old, ok := gs.snapshot[relpath]; ok && samerev(old, fi) {
+			continue
+		}
+		g.Go(func() error {
+			if err := gs.backend.keep(&fi, fi.HeadRevisionID); err != nil {
+				return fmt.Errorf("gdsnap.KeepSnapshotRevision relpath=%s: %v", relpath, err)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	s := snapshot{ID: time.Now().UTC().Format(tLayout), Files: files}
+	data, err := gs.sealsnapshot(s)
+	if err != nil {
+		return err
+	}
+	if err := gs.backend.putmeta("snapshot."+s.ID, data); err != nil {
+		return err
+	}
+	gs.snapshot = files
+	return nil
+}
+
+// sealsnapshot returns the encrypted manifest of a snapshot.
+func (gs *gdsnap) sealsnapshot(s snapshot) ([]byte, error) {
+	js, err := json.Marshal(s)
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.MarshalSnapshot: %v", err)
+	}
+	data, err := gs.encrypt(js)
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.EncryptSnapshot: %v", err)
+	}
+	return data, nil
+}
+
+// snapshots returns the IDs of the snapshots, the oldest first.
+func (gs *gdsnap) snapshots() ([]string, error) {
+	names, err := gs.backend.listmeta("snapshot.")
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		names[i] = strings.TrimPrefix(name, "snapshot.")
+	}
+	return names, nil
+}
+
+// findsnapshot returns the ID of the snapshot described by s.
+// s is either a snapshot ID or a time in the -t format in which case the latest snapshot before that is picked.
+func (gs *gdsnap) findsnapshot(s string) (string, error) {
+	ids, err := gs.snapshots()
+	if err != nil {
+		return "", err
+	}
+	for _, id := range ids {
+		if id == s {
+			return id, nil
+		}
+	}
+	t, err := parsetime(s, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("gdsnap.SnapshotNotFound snapshot=%s: %v", s, err)
+	}
+	found := ""
+	for _, id := range ids {
+		if id <= t {
+			found = id
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("gdsnap.NoSnapshotBefore t=%s", t)
+	}
+	return found, nil
+}
+
+// readsnapshot returns the tree of a snapshot.
+func (gs *gdsnap) readsnapshot(id string) (map[string]fileinfo, error) {
+	if err := gs.needkeys(); err != nil {
+		return nil, err
+	}
+	data, err := gs.backend.getmeta("snapshot." + id)
+	if err != nil {
+		return nil, err
+	}
+	return gs.opensnapshot(id, data)
+}
+
+// opensnapshot decrypts the manifest of a snapshot and returns its tree.
+func (gs *gdsnap) opensnapshot(id string, data []byte) (map[string]fileinfo, error) {
+	compressed, err := gs.keys.open(gs.keys.current, data)
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.OpenSnapshot id=%s: %v", id, err)
+	}
+	js, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.DecompressSnapshot id=%s: %v", id, err)
+	}
+	var s snapshot
+	if err := json.Unmarshal(js, &s); err != nil {
+		return nil, fmt.Errorf("gdsnap.ParseSnapshot id=%s: %v", id, err)
+	}
+	if s.ID != id {
+		return nil, fmt.Errorf("gdsnap.SnapshotIDMismatch got=%s want=%s", s.ID, id)
+	}
+	return s.Files, nil
+}
+
+// listtree loads the tree the read-only subcommands operate on: the snapshot selected by -snapshot or the latest files.
+func (gs *gdsnap) listtree() error {
+	if *snapshotFlag == "" {
+		return gs.listfiles()
+	}
+	id, err := gs.findsnapshot(*snapshotFlag)
+	if err != nil {
+		return err
+	}
+	gs.files, err = gs.readsnapshot(id)
+	return err
+}
+
+func (gs *gdsnap) subcommandSnapshots(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("gdsnap.UnexpectedArgs")
+	}
+	ids, err := gs.snapshots()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		fmt.Println(id)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package gdsnap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// stats are the counters of the watch daemon that -statusaddr serves.
+// the zero value is ready to use and it's safe for concurrent use.
+type stats struct {
+	started atomic.Int64
+
+	uploads, deletions, uploadedbytes, failures atomic.Int64
+	cycles, cyclefailures                       atomic.Int64
+
+	// the times are unix nanoseconds, 0 if there was none yet.
+	lastcycle, lastsuccess, lastduration atomic.Int64
+
+	// pending is the number of the touched files waiting for the next cycle.
+	pending atomic.Int64
+	paused  atomic.Bool
+
+	quotafree, quotausage, quotalimit atomic.Int64
+}
+
+// status is the json form of the stats.
+type status struct {
+	Started          string  `json:"started"`
+	LastCycle        string  `json:"lastCycle,omitempty"`
+	LastSuccess      string  `json:"lastSuccess,omitempty"`
+	LastCycleSeconds float64 `json:"lastCycleSeconds"`
+	Pending          int64   `json:"pending"`
+	Paused           bool    `json:"paused"`
+	Uploads          int64   `json:"uploads"`
+	Deletions        int64   `json:"deletions"`
+	UploadedBytes    int64   `json:"uploadedBytes"`
+	Failures         int64   `json:"failures"`
+	Cycles           int64   `json:"cycles"`
+	CycleFailures    int64   `json:"cycleFailures"`
+	QuotaFreeMB      int64   `json:"quotaFreeMB"`
+	QuotaUsageMB     int64   `json:"quotaUsageMB"`
+	QuotaLimitMB     int64   `json:"quotaLimitMB"`
+}
+
+// cycled records the end of a backup cycle that started at start.
+func (st *stats) cycled(start time.Time, err error) {
+	now := time.Now()
+	st.cycles.Add(1)
+	st.lastcycle.Store(start.UnixNano())
+	st.lastduration.Store(int64(now.Sub(start)))
+	if err != nil {
+		st.cyclefailures.Add(1)
+	} else {
+		st.lastsuccess.Store(now.UnixNano())
+	}
+}
+
+func (st *stats) setquota(q quota) {
+	st.quotafree.Store(q.FreeMB)
+	st.quotausage.Store(q.UsageMB)
+	st.quotalimit.Store(q.LimitMB)
+}
+
+func (st *stats) status() status {
+	fmttime := func(ns int64) string {
+		if ns == 0 {
+			return ""
+		}
+		return time.Unix(0, ns).UTC().Format(tLayout)
+	}
+	return status{
+		Started:          fmttime(st.started.Load()),
+		LastCycle:        fmttime(st.lastcycle.Load()),
+		LastSuccess:      fmttime(st.lastsuccess.Load()),
+		LastCycleSeconds: time.Duration(st.lastduration.Load()).Seconds(),
+		Pending:          st.pending.Load(),
+		Paused:           st.paused.Load(),
+		Uploads:          st.uploads.Load(),
+		Deletions:        st.deletions.Load(),
+		UploadedBytes:    st.uploadedbytes.Load(),
+		Failures:         st.failures.Load(),
+		Cycles:           st.cycles.Load(),
+		CycleFailures:    st.cyclefailures.Load(),
+		QuotaFreeMB:      st.quotafree.Load(),
+		QuotaUsageMB:     st.quotausage.Load(),
+		QuotaLimitMB:     st.quotalimit.Load(),
+	}
+}
+
+// writemetrics writes the stats in the prometheus text format.
+func (st *stats) writemetrics(w io.Writer) {
+	metric := func(name, typ, help string, value any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+	}
+	s := st.status()
+	metric("gdsnap_uploads_total", "counter", "The number of the uploaded revisions.", s.Uploads)
+	metric("gdsnap_deletions_total", "counter", "The number of the files deleted from the backup.", s.Deletions)
+	metric("gdsnap_uploaded_bytes_total", "counter", "The number of the uploaded bytes after compression and encryption.", s.UploadedBytes)
+	metric("gdsnap_failures_total", "counter", "The number of the failed file backups.", s.Failures)
+	metric("gdsnap_cycles_total", "counter", "The number of the backup cycles.", s.Cycles)
+	metric("gdsnap_cycle_failures_total", "counter", "The number of the failed backup cycles.", s.CycleFailures)
+	metric("gdsnap_last_cycle_duration_seconds", "gauge", "The duration of the last backup cycle.", s.LastCycleSeconds)
+	metric("gdsnap_last_success_timestamp_seconds", "gauge", "The unix time of the end of the last successful backup cycle.", st.lastsuccess.Load()/1e9)
+	metric("gdsnap_pending_files", "gauge", "The number of the changed files waiting for the next backup cycle.", s.Pending)
+	paused := 0
+	if s.Paused {
+		paused = 1
+	}
+	metric("gdsnap_paused", "gauge", "1 if the backup cycles are paused via the control socket.", paused)
+	metric("gdsnap_quota_free_megabytes", "gauge", "The free gdrive quota.", s.QuotaFreeMB)
+	metric("gdsnap_quota_usage_megabytes", "gauge", "The used gdrive quota.", s.QuotaUsageMB)
+	metric("gdsnap_quota_limit_megabytes", "gauge", "The gdrive quota limit.", s.QuotaLimitMB)
+}
+
+// setpending updates the set's share of the pending files.
+// the sets of a watch share the stats so it adds the change since the last update.
+func (gs *gdsnap) setpending(n int) {
+	gs.stats.pending.Add(int64(n - gs.pending))
+	gs.pending = n
+}
+
+// countreader counts the bytes read through it.
+type countreader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countreader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// statuslisten listens on -statusaddr: an absolute path is a unix socket, anything else is a tcp address.
+func statuslisten(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "/") {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("gdsnap.ListenStatus addr=%s: %v", addr, err)
+		}
+		return ln, nil
+	}
+	// remove the socket of an earlier daemon that didn't clean up.
+	if finfo, err := os.Lstat(addr); err == nil && finfo.Mode().Type() == fs.ModeSocket {
+		os.Remove(addr)
+	}
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.ListenStatus addr=%s: %v", addr, err)
+	}
+	return ln, nil
+}
+
+// serve serves the stats on ln: the json status on /status and the prometheus metrics on /metrics.
+func (st *stats) serve(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st.status())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		st.writemetrics(w)
+	})
+	go func() {
+		if err := http.Serve(ln, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("[warning] the status endpoint stopped: %v", err)
+		}
+	}()
+}
+
+// fetchstatus queries an endpoint of a watch daemon's -statusaddr, e.g. /status.
+func fetchstatus(addr, endpoint string) ([]byte, error) {
+	client, u := http.DefaultClient, "http://"+addr+endpoint
+	if strings.HasPrefix(addr, "/") {
+		dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}
+		client, u = &http.Client{Transport: &http.Transport{DialContext: dial}}, "http://gdsnap"+endpoint
+	}
+	response, err := client.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.FetchStatus addr=%s (is watch running with this -statusaddr?): %v", addr, err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil || response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gdsnap.ReadStatus addr=%s status=%q: %v", addr, response.Status, err)
+	}
+	return body, nil
+}
+
+func subcommandStatus(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("gdsnap.UnexpectedArgs")
+	}
+	if *statusaddrFlag == "" {
+		return fmt.Errorf("gdsnap.MissingStatusaddr (set -statusaddr to the watch daemon's)")
+	}
+	body, err := fetchstatus(*statusaddrFlag, "/status")
+	if err != nil {
+		return err
+	}
+	if *jsonFlag {
+		os.Stdout.Write(body)
+		return nil
+	}
+	var s status
+	if err := json.Unmarshal(body, &s); err != nil {
+		return fmt.Errorf("gdsnap.ParseStatus: %v", err)
+	}
+	orNever := func(t string) string {
+		if t == "" {
+			return "never"
+		}
+		return t
+	}
+	fmt.Printf("started:      %s\n", s.Started)
+	fmt.Printf("last cycle:   %s (took %.1fs)\n", orNever(s.LastCycle), s.LastCycleSeconds)
+	fmt.Printf("last success: %s\n", orNever(s.LastSuccess))
+	fmt.Printf("pending:      %d files\n", s.Pending)
+	if s.Paused {
+		fmt.Println("paused:       yes")
+	}
+	fmt.Printf("uploads:      %d (%d bytes)\n", s.Uploads, s.UploadedBytes)
+	fmt.Printf("deletions:    %d\n", s.Deletions)
+	fmt.Printf("failures:     %d\n", s.Failures)
+	fmt.Printf("cycles:       %d (%d failed)\n", s.Cycles, s.CycleFailures)
+	fmt.Printf("quota:        %d MB free of %d MB\n", s.QuotaFreeMB, s.QuotaLimitMB)
+	return nil
+}
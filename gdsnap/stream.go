@@ -0,0 +1,141 @@
+package gdsnap
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// the gdsnap/stream format encrypts the content in chunks so that it can be streamed with bounded memory.
+// it starts with a random nonce followed by the sealed chunks.
+// each chunk has streamchunk bytes of plaintext except the last one which can be shorter, even empty.
+// the nonce of the nth chunk is the starting nonce with n xored into its last 8 bytes.
+// the additional data of the last chunk is 1, 0 for all the others so a truncated stream fails to open.
+const streamchunk = 1 << 20
+
+var (
+	streamMiddle = []byte{0}
+	streamLast   = []byte{1}
+)
+
+func chunknonce(nonce []byte, counter uint64) []byte {
+	n := append([]byte{}, nonce...)
+	var c [8]byte
+	binary.BigEndian.PutUint64(c[:], counter)
+	for i := range c {
+		n[len(n)-8+i] ^= c[i]
+	}
+	return n
+}
+
+// streamwriter encrypts the data written to it into w.
+// Close must be called to write the last chunk, it doesn't close w.
+type streamwriter struct {
+	aead    cipher.AEAD
+	w       io.Writer
+	nonce   []byte
+	counter uint64
+	buf     []byte
+}
+
+func newstreamwriter(aead cipher.AEAD, w io.Writer) (*streamwriter, error) {
+	sw := &streamwriter{aead: aead, w: w, nonce: make([]byte, aead.NonceSize()), buf: make([]byte, 0, streamchunk)}
+	if _, err := io.ReadFull(rand.Reader, sw.nonce); err != nil {
+		return nil, fmt.Errorf("gdsnap.ReadNewNonce: %v", err)
+	}
+	if _, err := w.Write(sw.nonce); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *streamwriter) seal(plaintext, ad []byte) error {
+	_, err := sw.w.Write(sw.aead.Seal(nil, chunknonce(sw.nonce, sw.counter), plaintext, ad))
+	sw.counter++
+	return err
+}
+
+func (sw *streamwriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(sw.buf) == streamchunk {
+			// only seal a full chunk once it's known that it's not the last one.
+			if err := sw.seal(sw.buf, streamMiddle); err != nil {
+				return n - len(p), err
+			}
+			sw.buf = sw.buf[:0]
+		}
+		k := min(len(p), streamchunk-len(sw.buf))
+		sw.buf, p = append(sw.buf, p[:k]...), p[k:]
+	}
+	return n, nil
+}
+
+func (sw *streamwriter) Close() error {
+	return sw.seal(sw.buf, streamLast)
+}
+
+// streamreader decrypts a gdsnap/stream content.
+// the first chunk is tried with each of the candidate keys, the rest of the chunks use the one that worked.
+type streamreader struct {
+	candidates []cipher.AEAD
+	aead       cipher.AEAD
+	r          *bufio.Reader
+	nonce      []byte
+	counter    uint64
+	chunk      []byte
+	plaintext  []byte
+	done       bool
+}
+
+func newstreamreader(candidates []cipher.AEAD, r io.Reader) (*streamreader, error) {
+	aead := candidates[0]
+	sr := &streamreader{candidates: candidates, aead: aead, r: bufio.NewReader(r), nonce: make([]byte, aead.NonceSize()), chunk: make([]byte, streamchunk+aead.Overhead())}
+	if _, err := io.ReadFull(sr.r, sr.nonce); err != nil {
+		return nil, fmt.Errorf("gdsnap.ReadStreamNonce: %v", err)
+	}
+	return sr, nil
+}
+
+func (sr *streamreader) Read(p []byte) (int, error) {
+	for len(sr.plaintext) == 0 {
+		if sr.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(sr.r, sr.chunk)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0, fmt.Errorf("gdsnap.ReadStreamChunk chunk=%d: %v", sr.counter, err)
+		}
+		if !last {
+			_, err := sr.r.Peek(1)
+			last = err == io.EOF
+		}
+		ad := streamMiddle
+		if last {
+			ad = streamLast
+		}
+		if sr.counter == 0 {
+			// a failed open zeroes its output so don't decrypt in place while trying the keys.
+			for _, aead := range sr.candidates {
+				if sr.plaintext, err = aead.Open(nil, chunknonce(sr.nonce, 0), sr.chunk[:n], ad); err == nil {
+					sr.aead = aead
+					break
+				}
+			}
+		} else {
+			sr.plaintext, err = sr.aead.Open(sr.chunk[:0], chunknonce(sr.nonce, sr.counter), sr.chunk[:n], ad)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("gdsnap.OpenStreamChunk chunk=%d last=%t: %v", sr.counter, last, err)
+		}
+		sr.counter++
+		sr.done = last
+	}
+	n := copy(p, sr.plaintext)
+	sr.plaintext = sr.plaintext[n:]
+	return n, nil
+}
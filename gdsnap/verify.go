@@ -0,0 +1,126 @@
+package gdsnap
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// verifyfile downloads, authenticates and decompresses the head revision of a file
+// and checks its plaintext against the checksum in its name.
+func (gs *gdsnap) verifyfile(fi fileinfo) error {
+	mime, _, content, err := gs.fetchrev(&fi, "", fi.MimeType)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, content); err != nil {
+		return err
+	}
+	// only the file contents have a checksum, the symlinks don't.
+	if ok, _ := hascontent(mime); ok {
+		if got, want := gs.contentsum(h.Sum(nil)), shasumPart(fi.Name); got != want {
+			return fmt.Errorf("gdsnap.ChecksumMismatch got=%s want=%s", got, want)
+		}
+	}
+	return nil
+}
+
+// localfiles returns the regular files, the symlinks and the empty directories under -dir that save would back up, keyed by the relpath.
+func (gs *gdsnap) localfiles() (map[string]fs.FileInfo, error) {
+	files := map[string]fs.FileInfo{}
+	err := filepath.WalkDir(gs.set.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relpath := strings.TrimPrefix(path, gs.set.dir)
+		if gs.ignore.ignored(relpath, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if entries, err := os.ReadDir(path); err != nil || len(entries) > 0 || relpath == "" {
+				return nil
+			}
+		}
+		finfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if finfo.Mode().IsRegular() || finfo.Mode().Type() == fs.ModeSymlink || finfo.IsDir() {
+			files[relpath] = finfo
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gdsnap.WalkDir: %v", err)
+	}
+	return files, nil
+}
+
+func (gs *gdsnap) subcommandVerify(args []string) error {
+	if err := gs.listfiles(); err != nil {
+		return err
+	}
+	local, err := gs.localfiles()
+	if err != nil {
+		return err
+	}
+
+	var corrupt, missing, extra, changed, verified int
+	for _, relpath := range filterfiles(gs.files, args) {
+		fi := gs.files[relpath]
+		if fi.Trashed {
+			continue
+		}
+		if rand.IntN(100) < *samplepctFlag {
+			verified++
+			if err := gs.verifyfile(fi); err != nil {
+				corrupt++
+				fmt.Printf("corrupt %s: %v\n", relpath, err)
+			}
+		}
+		finfo, ok := local[relpath]
+		if !ok && strings.HasPrefix(fi.MimeType, "gdsnap/dir") {
+			// the directory got files since it was backed up.
+			if finfo, err := os.Stat(filepath.Join(gs.set.dir, relpath)); err == nil && finfo.IsDir() {
+				continue
+			}
+		}
+		if !ok {
+			extra++
+			fmt.Printf("extra %s: it's backed up but it's not on disk.\n", relpath)
+			continue
+		}
+		if finfo.ModTime().UTC().Format(tLayout) == fi.ModifiedTime || finfo.Mode().Type() == fs.ModeSymlink || finfo.IsDir() {
+			continue
+		}
+		if sum, err := gs.hashfile(filepath.Join(gs.set.dir, relpath)); err != nil {
+			fmt.Printf("skipping %s because can't read it: %v.\n", relpath, err)
+		} else if sum != shasumPart(fi.Name) {
+			changed++
+			fmt.Printf("changed %s: the file on disk differs from the backup.\n", relpath)
+		}
+	}
+	for _, relpath := range filterfiles(local, args) {
+		if fi, ok := gs.files[relpath]; !ok || fi.Trashed {
+			missing++
+			fmt.Printf("missing %s: it's on disk but it's not backed up.\n", relpath)
+		}
+	}
+
+	fmt.Printf("verified %d files: %d corrupt, %d missing, %d extra, %d changed.\n", verified, corrupt, missing, extra, changed)
+	if corrupt+missing+extra+changed > 0 {
+		warn()
+		return fmt.Errorf("gdsnap.VerifyFailed corrupt=%d missing=%d extra=%d changed=%d", corrupt, missing, extra, changed)
+	}
+	return nil
+}
@@ -0,0 +1,380 @@
+package gdsnap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watcher streams the paths under a set's dir that might have changed, see -watcher.
+type watcher interface {
+	// watch sends the paths on filech.
+	// it starts with all the files under the dir so that the changes made before the watching started are not missed.
+	// it returns on error or with ctx's error once ctx is done.
+	watch(ctx context.Context, filech chan<- string) error
+}
+
+// newwatcher returns the watcher selected by -watcher for the dir of ig.
+// the walks of the watchers skip the directories that ig ignores.
+// the -scandur is read here once, the scanWatcher and the fallbacks to it use that.
+func newwatcher(ig *ignorer) (watcher, error) {
+	scandur := *scandurFlag
+	switch *watcherFlag {
+	case "inotify":
+		return inotifyWatcher{ig, scandur}, nil
+	case "fanotify":
+		return fanotifyWatcher{ig, scandur}, nil
+	case "scan":
+		return scanWatcher{ig, scandur}, nil
+	default:
+		return nil, fmt.Errorf("gdsnap.UnknownWatcher watcher=%q", *watcherFlag)
+	}
+}
+
+// sendall sends all files and empty directories under the dir of ig.
+// the non-empty directories are left out because their files recreate them, see savepath.
+func sendall(ctx context.Context, filech chan<- string, ig *ignorer) {
+	for path, empty := range walkdirs(ig, func(path string, d fs.DirEntry) { sendpath(ctx, filech, path) }) {
+		if empty {
+			sendpath(ctx, filech, path)
+		}
+	}
+}
+
+// sendpath sends path on filech unless ctx is done before filech has room for it.
+func sendpath(ctx context.Context, filech chan<- string, path string) {
+	select {
+	case filech <- path:
+	case <-ctx.Done():
+	}
+}
+
+// walkdirs walks the dir of ig, calls fn for each file and returns whether each directory is empty.
+// the dir itself is left out.
+func walkdirs(ig *ignorer, fn func(path string, d fs.DirEntry)) map[string]bool {
+	dirs := map[string]bool{}
+	filepath.WalkDir(ig.root, func(path string, d fs.DirEntry, err error) error {
+		if path != ig.root {
+			// the ignored entries count too like in savepath.
+			dirs[filepath.Dir(path)] = false
+		}
+		if err != nil {
+			log.Printf("[warning] can't walk %s: %v", path, err)
+			return nil
+		}
+		if !d.IsDir() {
+			fn(path, d)
+			return nil
+		}
+		if ig.ignoredabs(path, true) {
+			return fs.SkipDir
+		}
+		// the walk visits a directory before its entries.
+		if path != ig.root {
+			dirs[path] = true
+		}
+		return nil
+	})
+	delete(dirs, filepath.Clean(ig.root))
+	return dirs
+}
+
+// inotifyWatcher adds an inotify watch to each directory under -dir.
+// it falls back to the scanWatcher when it runs out of watches, see fs.inotify.max_user_watches.
+type inotifyWatcher struct {
+	ig      *ignorer
+	scandur time.Duration
+}
+
+func (w inotifyWatcher) watch(ctx context.Context, filech chan<- string) error {
+	log.Printf("initializing inotify rooted at %q.", w.ig.root)
+	watches := map[int]string{}
+	ifd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("gdsnap.InotifyInit: %v", err)
+	}
+	// the file reads via the runtime's poller so that closing it when ctx is done interrupts the read.
+	f := os.NewFile(uintptr(ifd), "inotify")
+	defer f.Close()
+	defer context.AfterFunc(ctx, func() { f.Close() })()
+	var watchpath func(string) error
+	watchpath = func(dirpath string) error {
+		var mask uint32
+		mask |= syscall.IN_CLOSE_WRITE
+		mask |= syscall.IN_CREATE
+		mask |= syscall.IN_DELETE
+		mask |= syscall.IN_MOVED_FROM
+		mask |= syscall.IN_MOVED_TO
+		mask |= syscall.IN_DONT_FOLLOW
+		mask |= syscall.IN_EXCL_UNLINK
+		mask |= syscall.IN_ONLYDIR
+		wd, err := syscall.InotifyAddWatch(ifd, dirpath, mask)
+		if err != nil {
+			return fmt.Errorf("gdsnap.InotifyAddWatch dir=%s: %w", dirpath, err)
+		}
+		watches[wd] = dirpath
+
+		walkfunc := func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				log.Printf("[warning] can't walk %s: %v", path, err)
+				warn()
+				return nil
+			}
+			if !d.IsDir() {
+				sendpath(ctx, filech, path)
+				return nil
+			}
+			if path == dirpath {
+				return nil
+			}
+			if w.ig.ignoredabs(path, true) {
+				return fs.SkipDir
+			}
+			if err := watchpath(path); err != nil {
+				return err
+			}
+			return fs.SkipDir
+		}
+		return filepath.WalkDir(dirpath, walkfunc)
+	}
+	// fallback switches to the periodic scans if the error is about running out of watches.
+	fallback := func(err error) error {
+		if !errors.Is(err, syscall.ENOSPC) {
+			return err
+		}
+		log.Printf("[warning] ran out of inotify watches, falling back to periodic scans (consider raising fs.inotify.max_user_watches): %v", err)
+		warn()
+		f.Close()
+		return scanWatcher{w.ig, w.scandur}.watch(ctx, filech)
+	}
+	if err := watchpath(w.ig.root); err != nil {
+		return fallback(err)
+	}
+
+	log.Print("watching inotify events.")
+	for {
+		const bufsize = 16384
+		eventbuf := [bufsize]byte{}
+		n, err := f.Read(eventbuf[:])
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if n <= 0 || err != nil {
+			return fmt.Errorf("gdsnap.InotifyRead n=%d: %v", n, err)
+		}
+		for offset := 0; offset < n; {
+			if n-offset < syscall.SizeofInotifyEvent {
+				return fmt.Errorf("gdsnap.InvalidInotifyRead n=%d offset=%d", n, offset)
+			}
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&eventbuf[offset]))
+			wd := int(event.Wd)
+			mask := int(event.Mask)
+			namelen := int(event.Len)
+			namebytes := (*[syscall.PathMax]byte)(unsafe.Pointer(&eventbuf[offset+syscall.SizeofInotifyEvent]))
+			name := string(bytes.TrimRight(namebytes[0:namelen], "\000"))
+			offset += syscall.SizeofInotifyEvent + namelen
+			if mask&syscall.IN_Q_OVERFLOW != 0 {
+				log.Print("[warning] the inotify queue overflowed, rescanning the whole directory.")
+				sendpath(ctx, filech, w.ig.root)
+				continue
+			}
+			dir, ok := watches[wd]
+			if !ok {
+				return fmt.Errorf("gdsnap.UnknownWatchDescriptor wd=%d", wd)
+			}
+			name = path.Join(dir, name)
+			if mask&syscall.IN_IGNORED != 0 {
+				delete(watches, wd)
+			}
+			if mask&syscall.IN_CREATE != 0 || mask&syscall.IN_MOVED_TO != 0 {
+				fi, err := os.Stat(name)
+				if err == nil && fi.IsDir() && !w.ig.ignoredabs(name, true) {
+					if err := watchpath(name); err != nil {
+						return fallback(err)
+					}
+				}
+			}
+			sendpath(ctx, filech, name)
+		}
+	}
+}
+
+// fanotifyWatcher puts a single fanotify mark on the filesystem of -dir so it needs no per-directory watches.
+// it needs CAP_SYS_ADMIN and linux 5.9 or newer, it falls back to the inotifyWatcher otherwise.
+type fanotifyWatcher struct {
+	ig      *ignorer
+	scandur time.Duration
+}
+
+func (w fanotifyWatcher) watch(ctx context.Context, filech chan<- string) error {
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK|unix.FAN_REPORT_DFID_NAME, unix.O_RDONLY|unix.O_LARGEFILE)
+	if err == nil {
+		mask := uint64(unix.FAN_CLOSE_WRITE | unix.FAN_CREATE | unix.FAN_DELETE | unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO | unix.FAN_ONDIR)
+		if err = unix.FanotifyMark(fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, mask, unix.AT_FDCWD, w.ig.root); err != nil {
+			unix.Close(fd)
+		}
+	}
+	if err != nil {
+		log.Printf("[warning] can't use fanotify, falling back to inotify: %v", err)
+		return inotifyWatcher{w.ig, w.scandur}.watch(ctx, filech)
+	}
+	// see inotifyWatcher.watch for the file.
+	f := os.NewFile(uintptr(fd), "fanotify")
+	defer f.Close()
+	defer context.AfterFunc(ctx, func() { f.Close() })()
+	// the directory handles in the events are opened relative to this.
+	mountfd, err := unix.Open(w.ig.root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("gdsnap.OpenDir: %v", err)
+	}
+	defer unix.Close(mountfd)
+
+	log.Printf("watching fanotify events on the filesystem of %q.", w.ig.root)
+	sendall(ctx, filech, w.ig)
+	dirs := map[string]string{}
+	buf := make([]byte, 65536)
+	for {
+		n, err := f.Read(buf)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if n <= 0 || err != nil {
+			return fmt.Errorf("gdsnap.FanotifyRead n=%d: %v", n, err)
+		}
+		for offset := 0; offset < n; {
+			if n-offset < int(unsafe.Sizeof(unix.FanotifyEventMetadata{})) {
+				return fmt.Errorf("gdsnap.InvalidFanotifyRead n=%d offset=%d", n, offset)
+			}
+			meta := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[offset]))
+			if meta.Vers != unix.FANOTIFY_METADATA_VERSION || int(meta.Event_len) < int(meta.Metadata_len) || offset+int(meta.Event_len) > n {
+				return fmt.Errorf("gdsnap.InvalidFanotifyEvent version=%d len=%d", meta.Vers, meta.Event_len)
+			}
+			event := buf[offset+int(meta.Metadata_len) : offset+int(meta.Event_len)]
+			offset += int(meta.Event_len)
+			if meta.Mask&unix.FAN_Q_OVERFLOW != 0 {
+				log.Print("[warning] the fanotify queue overflowed, rescanning the whole directory.")
+				sendpath(ctx, filech, w.ig.root)
+				continue
+			}
+			name, err := fanotifypath(mountfd, event, dirs)
+			if err != nil {
+				log.Printf("[warning] can't resolve a fanotify event: %v", err)
+				continue
+			}
+			if strings.HasPrefix(name, w.ig.root) {
+				sendpath(ctx, filech, name)
+			}
+		}
+	}
+}
+
+// fanotifypath returns the path from the DFID_NAME info record of a fanotify event.
+// the record is the 4 byte header, the 8 byte fsid, a file_handle of the directory and the nul terminated name.
+// the directory is resolved via its handle and dirs caches the resolved paths keyed by the handle
+// because a deleted directory can't be resolved anymore.
+func fanotifypath(mountfd int, info []byte, dirs map[string]string) (string, error) {
+	if len(info) < 20 || info[0] != unix.FAN_EVENT_INFO_TYPE_DFID_NAME {
+		return "", fmt.Errorf("gdsnap.UnexpectedFanotifyInfo len=%d", len(info))
+	}
+	info = info[:min(int(binary.NativeEndian.Uint16(info[2:4])), len(info))]
+	handle := info[12:]
+	size := int(binary.NativeEndian.Uint32(handle[0:4]))
+	if len(handle) < 8+size {
+		return "", fmt.Errorf("gdsnap.InvalidFanotifyHandle size=%d", size)
+	}
+	name, _, _ := bytes.Cut(handle[8+size:], []byte{0})
+	key := string(handle[:8+size])
+
+	var dir string
+	dirfd, err := unix.OpenByHandleAt(mountfd, unix.NewFileHandle(int32(binary.NativeEndian.Uint32(handle[4:8])), handle[8:8+size]), unix.O_PATH)
+	if err == nil {
+		dir, err = os.Readlink(fmt.Sprintf("/proc/self/fd/%d", dirfd))
+		unix.Close(dirfd)
+		if strings.HasSuffix(dir, " (deleted)") {
+			err = fs.ErrNotExist
+		}
+	}
+	if err == nil {
+		dirs[key] = dir
+	} else if cached, ok := dirs[key]; ok {
+		dir = cached
+	} else {
+		return "", fmt.Errorf("gdsnap.ResolveFanotifyDir: %v", err)
+	}
+	if len(name) == 0 || string(name) == "." {
+		return dir, nil
+	}
+	return filepath.Join(dir, string(name)), nil
+}
+
+// scanWatcher walks -dir every -scandur and sends the files whose metadata changed since the previous walk.
+// it sends the directories that appeared, disappeared or became empty or non-empty too
+// so that the empty directories are backed up like with the inotifyWatcher.
+// it needs no kernel resources but it notices the changes only with a delay.
+type scanWatcher struct {
+	ig      *ignorer
+	scandur time.Duration
+}
+
+// scanstate is the metadata of a file that the scanWatcher compares.
+type scanstate struct {
+	mtime int64
+	size  int64
+	mode  fs.FileMode
+}
+
+func (w scanWatcher) watch(ctx context.Context, filech chan<- string) error {
+	log.Printf("scanning %q every %s for changes.", w.ig.root, w.scandur)
+	var last map[string]scanstate
+	var lastdirs map[string]bool
+	for {
+		files := map[string]scanstate{}
+		dirs := walkdirs(w.ig, func(path string, d fs.DirEntry) {
+			finfo, err := d.Info()
+			if err != nil {
+				// deleted since the directory was read.
+				return
+			}
+			st := scanstate{finfo.ModTime().UnixNano(), finfo.Size(), finfo.Mode()}
+			files[path] = st
+			if old, ok := last[path]; !ok || old != st {
+				sendpath(ctx, filech, path)
+			}
+		})
+		for path := range last {
+			if _, ok := files[path]; !ok {
+				sendpath(ctx, filech, path)
+			}
+		}
+		// the first walk sends only the empty directories like sendall.
+		for path, empty := range dirs {
+			if old, ok := lastdirs[path]; ok && old != empty || !ok && (lastdirs != nil || empty) {
+				sendpath(ctx, filech, path)
+			}
+		}
+		for path := range lastdirs {
+			if _, ok := dirs[path]; !ok {
+				sendpath(ctx, filech, path)
+			}
+		}
+		last, lastdirs = files, dirs
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(w.scandur):
+		}
+	}
+}
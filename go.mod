@@ -5,10 +5,11 @@ go 1.24.2
 require golang.org/x/sync v0.13.0
 
 require (
+	github.com/hanwen/go-fuse/v2 v2.9.0
 	github.com/nitram509/gofritz v0.2.1
 	github.com/ypsu/efftesting v0.250504.0
 	github.com/ypsu/gosuflow v0.250507.0
 	golang.org/x/crypto v0.37.0
+	golang.org/x/sys v0.32.0
+	golang.org/x/term v0.31.0
 )
-
-require golang.org/x/sys v0.32.0 // indirect